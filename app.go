@@ -1,15 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"image"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"gioui.org/app"
 	"gioui.org/font"
 	"gioui.org/font/gofont"
+	"gioui.org/io/event"
 	"gioui.org/io/key"
 	"gioui.org/io/pointer"
 	"gioui.org/io/system"
@@ -32,6 +36,7 @@ const (
 	ModeRun
 	ModeMDI
 	ModeNum
+	ModeError
 )
 
 func (m Mode) String() string {
@@ -45,19 +50,33 @@ func (m Mode) String() string {
 		return "MDI"
 	} else if m == ModeNum {
 		return "NUM"
+	} else if m == ModeError {
+		return "ERR"
 	} else {
 		return "???"
 	}
 }
 
+// the parts of *app.Window that the app uses, so that tests can use a stub
+// instead of opening a real window
+type Window interface {
+	NextEvent() event.Event
+	Invalidate()
+}
+
 type App struct {
-	g     *Grbl
-	gs    GrblStatus
-	gsNew GrblStatus
+	g  *Grbl
+	gs GrblStatus
+
+	// gsNew is written by the status goroutine, and read by Layout() and
+	// by the macro and probe goroutines, so it goes through statusMu; use
+	// LatestStatus() rather than reading it directly
+	statusMu sync.Mutex
+	gsNew    GrblStatus
 
 	th              *material.Theme
 	InitialTextSize unit.Sp
-	w               *app.Window
+	w               Window
 	mode            Mode
 	modeStack       []Mode
 	autoConnect     bool
@@ -75,6 +94,11 @@ type App struct {
 	spindleOverrideEdit EditableNum
 
 	openBtn   *widget.Clickable
+	queueBtn  *widget.Clickable
+	xformBtn  *widget.Clickable
+	hmapBtn   *widget.Clickable
+	arrayBtn  *widget.Clickable
+	simBtn    *widget.Clickable
 	startBtn  *widget.Clickable
 	holdBtn   *widget.Clickable
 	resetBtn  *widget.Clickable
@@ -82,6 +106,17 @@ type App struct {
 	singleBtn *widget.Clickable
 	unlockBtn *widget.Clickable
 	m1Btn     *widget.Clickable
+	errPolBtn *widget.Clickable
+	skipBtn   *widget.Clickable
+	retryBtn  *widget.Clickable
+	abortBtn  *widget.Clickable
+
+	runAnywayBtn *widget.Clickable
+	cancelRunBtn *widget.Clickable
+
+	resume     *Checkpoint // interrupted job we're offering to resume, if any
+	resumeBtn  *widget.Clickable
+	discardBtn *widget.Clickable
 
 	tp *ToolpathView
 
@@ -96,6 +131,25 @@ type App struct {
 
 	gcode           *GCodeRunner
 	gcodeRunnerChan chan RunnerCmd
+	rs              RunnerState // snapshot of the runner state for the current frame
+	loadProgress    Progress
+	queue           *JobQueue
+	xform           *TransformPanel
+	hmap            *HeightMapPanel
+	array           *ArrayPanel
+	sim             *SimPanel
+	trace           Trace // where the machine has been
+	lint            *LintPanel
+	job             *JobPanel
+	processGen      atomic.Int64 // see Reprocess()
+
+	macros       []*Macro
+	runningMacro atomic.Pointer[Macro]
+	cancelMacro  atomic.Bool
+
+	keymap         *Keymap
+	showCheatsheet bool
+	cheatList      widget.List
 
 	img image.Image
 	mdi *MDI
@@ -119,6 +173,14 @@ func NewApp() *App {
 	a.InitialTextSize = th.TextSize
 
 	a.gcode = NewGCodeRunner(a)
+	a.queue = NewJobQueue(a)
+	a.queue.Load()
+	a.xform = NewTransformPanel(a)
+	a.hmap = NewHeightMapPanel(a)
+	a.array = NewArrayPanel(a)
+	a.sim = NewSimPanel(a)
+	a.lint = NewLintPanel(a)
+	a.job = NewJobPanel(a)
 
 	a.gsNew = DefaultGrblStatus()
 
@@ -193,6 +255,11 @@ func NewApp() *App {
 	}
 
 	a.openBtn = new(widget.Clickable)
+	a.queueBtn = new(widget.Clickable)
+	a.xformBtn = new(widget.Clickable)
+	a.hmapBtn = new(widget.Clickable)
+	a.arrayBtn = new(widget.Clickable)
+	a.simBtn = new(widget.Clickable)
 	a.startBtn = new(widget.Clickable)
 	a.holdBtn = new(widget.Clickable)
 	a.resetBtn = new(widget.Clickable)
@@ -200,6 +267,19 @@ func NewApp() *App {
 	a.singleBtn = new(widget.Clickable)
 	a.unlockBtn = new(widget.Clickable)
 	a.m1Btn = new(widget.Clickable)
+	a.errPolBtn = new(widget.Clickable)
+	a.skipBtn = new(widget.Clickable)
+	a.retryBtn = new(widget.Clickable)
+	a.abortBtn = new(widget.Clickable)
+	a.resumeBtn = new(widget.Clickable)
+	a.runAnywayBtn = new(widget.Clickable)
+	a.cancelRunBtn = new(widget.Clickable)
+	a.discardBtn = new(widget.Clickable)
+
+	a.resume = ReadCheckpoint()
+	a.macros = ReadMacros()
+	a.keymap = ReadKeymap(a.macros)
+	a.cheatList.Axis = layout.Vertical
 
 	var err error
 	a.img, err = loadImage("pugs.png")
@@ -282,8 +362,11 @@ func (a *App) Run() {
 				},
 			).Push(gtx.Ops)
 
-			keys := []string{
-				"(Ctrl)-+", "(Ctrl)--", "(Shift)-S", "(Shift)-R", "(Shift)-H", "(Shift)-X", "(Shift)-Y", "(Shift)-Z", "(Shift)-A", "(Shift)-G", "(Shift)-M", "(Shift)-J", "(Shift)-O", "(Shift)-I", "(Shift)-F", "(Shift)-U", "(Shift)-P", key.NameEscape, key.NameLeftArrow, key.NameRightArrow, key.NameUpArrow, key.NameDownArrow, key.NamePageUp, key.NamePageDown, key.NameShift,
+			keys := a.keymap.KeySet()
+			for _, m := range a.macros {
+				if m.Key != "" {
+					keys = append(keys, string(m.Key))
+				}
 			}
 			key.InputOp{
 				Keys: key.Set(strings.Join(keys, "|")),
@@ -303,8 +386,9 @@ func (a *App) Run() {
 
 			e.Frame(gtx.Ops)
 		case system.DestroyEvent:
-			// save work coordinates before exiting
+			// save work coordinates and the toolpath view before exiting
 			a.WriteConf(a.gs)
+			a.tp.WriteViewState()
 			os.Exit(0)
 		}
 	}
@@ -312,17 +396,18 @@ func (a *App) Run() {
 
 func (a *App) Connect(g *Grbl, ch chan GrblStatus) {
 	a.g = g
-	a.gsNew = g.status
+	a.SetLatestStatus(g.Status())
 	go a.ReadConf()
 
-	// write the current work coordinates to disk once per second
+	// write the current work coordinates and toolpath view to disk once per second
 	go func() {
 		ticker := time.NewTicker(time.Second)
 		for {
 			<-ticker.C
-			if !a.gs.Closed {
-				a.WriteConf(a.gs)
+			if gs := a.LatestStatus(); !gs.Closed {
+				a.WriteConf(gs)
 			}
+			a.tp.WriteViewState()
 		}
 	}()
 
@@ -330,31 +415,57 @@ func (a *App) Connect(g *Grbl, ch chan GrblStatus) {
 	// moved into a.gs at the start of the next frame
 	go func() {
 		for {
-			a.gsNew = <-ch
-			if a.gsNew.Closed {
+			gs := <-ch
+			a.SetLatestStatus(gs)
+			a.trace.Add(gs)
+			if gs.Closed {
 				a.ResetMode(ModeConnect)
 			} else if a.mode == ModeConnect {
 				a.ResetMode(ModeJog)
 			}
 			a.w.Invalidate()
-			if a.gsNew.Closed {
+			if gs.Closed {
 				return
 			}
 
-			if a.gcode.stopping {
-				// XXX: let the gcode runner discover a "Hold:0" status
-				a.gcodeRunnerChan <- CmdNone
-			}
+			// let the gcode runner see the new status (e.g. to discover a "Hold:0" status)
+			a.gcodeRunnerChan <- RunnerCmd{Kind: CmdStatus, Status: gs}
 		}
 	}()
 }
 
+// store the newest status from Grbl; it becomes a.gs at the start of the next frame
+func (a *App) SetLatestStatus(gs GrblStatus) {
+	a.statusMu.Lock()
+	a.gsNew = gs
+	a.statusMu.Unlock()
+}
+
+// return the newest status from Grbl; unlike a.gs, this is safe to call
+// from any goroutine
+func (a *App) LatestStatus() GrblStatus {
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+	return a.gsNew
+}
+
 func (a *App) Layout(gtx C) D {
-	// set the new GrblStatus at the start of Layout(), so that it doesn't
-	// change mid-layout
-	a.gs = a.gsNew
+	// set the new GrblStatus and runner state at the start of Layout(), so that
+	// they don't change mid-layout
+	a.gs = a.LatestStatus()
+	a.rs = a.gcode.State()
+
+	// show the error prompt while the runner is waiting for a decision
+	if a.rs.ErrorPrompt != nil && a.mode != ModeError {
+		a.PushMode(ModeError)
+	} else if a.rs.ErrorPrompt == nil && a.mode == ModeError {
+		a.PopMode()
+	}
+	if a.mode == ModeRun && a.rs.Finished() {
+		a.PopMode()
+	}
 
-	return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+	dims := layout.Flex{Axis: layout.Vertical}.Layout(gtx,
 		layout.Flexed(1, func(gtx C) D {
 			return a.split1.Layout(gtx, func(gtx C) D {
 				return Panel{Width: 1, Color: grey(128), Margin: layout.UniformInset(5), Padding: layout.UniformInset(5), BackgroundColor: grey(16), CornerRadius: 5}.Layout(gtx, func(gtx C) D {
@@ -365,6 +476,14 @@ func (a *App) Layout(gtx C) D {
 				return a.split2.Layout(gtx, func(gtx C) D {
 					return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
 						layout.Rigid(a.LayoutButtons),
+						layout.Rigid(a.LayoutMacroButtons),
+						layout.Rigid(a.queue.Layout),
+						layout.Rigid(a.xform.Layout),
+						layout.Rigid(a.array.Layout),
+						layout.Rigid(a.hmap.Layout),
+						layout.Rigid(a.sim.Layout),
+						layout.Rigid(a.job.Layout),
+						layout.Rigid(a.lint.Layout),
 						layout.Flexed(1, func(gtx C) D {
 							return a.LayoutGCode(gtx)
 						}),
@@ -376,6 +495,13 @@ func (a *App) Layout(gtx C) D {
 		}),
 		layout.Rigid(a.LayoutStatusBar),
 	)
+
+	a.LayoutErrorPrompt(gtx)
+	a.LayoutBoundsPrompt(gtx)
+	a.LayoutResumePrompt(gtx)
+	a.LayoutCheatsheet(gtx)
+
+	return dims
 }
 
 func (a *App) AlarmUnlock() {
@@ -386,42 +512,76 @@ func (a *App) LayoutButtons(gtx C) D {
 	for a.openBtn.Clicked(gtx) {
 		a.OpenFile()
 	}
+	for a.queueBtn.Clicked(gtx) {
+		a.queue.AddFiles()
+	}
+	for a.xformBtn.Clicked(gtx) {
+		a.xform.visible = !a.xform.visible
+	}
+	for a.arrayBtn.Clicked(gtx) {
+		a.array.visible = !a.array.visible
+	}
+	for a.simBtn.Clicked(gtx) {
+		a.sim.visible = !a.sim.visible
+	}
+	for a.hmapBtn.Clicked(gtx) {
+		a.hmap.visible = !a.hmap.visible
+	}
+	macroRunning := a.runningMacro.Load() != nil
 	for a.startBtn.Clicked(gtx) {
-		a.gcodeRunnerChan <- CmdStart
+		if macroRunning {
+			continue
+		}
+		a.gcodeRunnerChan <- RunnerCmd{Kind: CmdStart}
 	}
 	for a.holdBtn.Clicked(gtx) {
-		a.gcodeRunnerChan <- CmdPause
+		a.gcodeRunnerChan <- RunnerCmd{Kind: CmdPause}
 	}
 	for a.resetBtn.Clicked(gtx) {
-		a.gcodeRunnerChan <- CmdStop
+		a.gcodeRunnerChan <- RunnerCmd{Kind: CmdStop}
 	}
 	for a.drainBtn.Clicked(gtx) {
-		a.gcodeRunnerChan <- CmdDrain
+		a.gcodeRunnerChan <- RunnerCmd{Kind: CmdDrain}
 	}
 	for a.singleBtn.Clicked(gtx) {
-		a.gcodeRunnerChan <- CmdSingle
+		a.gcodeRunnerChan <- RunnerCmd{Kind: CmdSingle}
 	}
 	for a.unlockBtn.Clicked(gtx) {
 		a.AlarmUnlock()
 	}
 	for a.m1Btn.Clicked(gtx) {
-		a.gcodeRunnerChan <- CmdOptionalStop
+		a.gcodeRunnerChan <- RunnerCmd{Kind: CmdOptionalStop}
+	}
+	for a.errPolBtn.Clicked(gtx) {
+		a.gcodeRunnerChan <- RunnerCmd{Kind: CmdErrorPolicy}
 	}
 
 	m1Lbl := "+M1"
-	if a.gcode.optionalStop {
+	if a.rs.OptionalStop {
 		m1Lbl = "-M1"
 	}
 
 	return Toolbar{Inset: layout.UniformInset(5)}.Layout(gtx,
 		material.Button(a.th, a.openBtn, "OPEN").Layout,
-		material.Button(a.th, a.startBtn, "RUN").Layout,
+		material.Button(a.th, a.queueBtn, "QUEUE").Layout,
+		material.Button(a.th, a.xformBtn, "XFORM").Layout,
+		material.Button(a.th, a.arrayBtn, "ARRAY").Layout,
+		material.Button(a.th, a.simBtn, "SIM").Layout,
+		material.Button(a.th, a.hmapBtn, "HMAP").Layout,
+		func(gtx C) D {
+			b := material.Button(a.th, a.startBtn, "RUN")
+			if macroRunning {
+				b.Background = grey(64)
+			}
+			return b.Layout(gtx)
+		},
 		material.Button(a.th, a.holdBtn, "HOLD").Layout,
 		material.Button(a.th, a.resetBtn, "STOP").Layout,
 		material.Button(a.th, a.drainBtn, "DRAIN").Layout,
 		material.Button(a.th, a.singleBtn, "SINGLE").Layout,
 		material.Button(a.th, a.unlockBtn, "UNLOCK").Layout,
 		material.Button(a.th, a.m1Btn, m1Lbl).Layout,
+		material.Button(a.th, a.errPolBtn, "ERR:"+strings.ToUpper(a.rs.ErrorPolicy.String())).Layout,
 	)
 }
 
@@ -438,6 +598,10 @@ func (a *App) LayoutMDI(gtx C) D {
 
 func (a *App) MDIInput(line string) {
 	a.g.CommandIgnore(line)
+	if changesOffsets(line) {
+		// the line moves a work origin or a stored position
+		a.g.RequestOffsets()
+	}
 	fmt.Printf(" > [%s]\n", line)
 	if a.mode == ModeMDI && a.mdi.defocusOnSubmit {
 		a.mdi.Defocus()
@@ -479,84 +643,42 @@ func (a *App) ResetMode(m Mode) {
 }
 
 func (a *App) KeyPress(e key.Event) {
-	if a.mode == ModeJog || a.mode == ModeConnect {
-		if e.Name == "G" || e.Name == "M" {
-			// enter MDI
-			if a.mdi.editor.Text() == "" {
-				a.mdi.editor.SetText(e.Name)
-				a.mdi.editor.SetCaret(1, 1)
-			}
-			a.mdi.editor.Focus()
-			a.mdi.defocusOnSubmit = true
-			a.PushMode(ModeMDI)
-		} else if e.Name == "O" {
-			// open gcode file
-			a.OpenFile()
-		} else if e.Name == "I" {
-			// edit jog increment
-			a.jogIncEdit.ShowEditor()
-		} else if e.Name == "F" {
-			// edit jog feed
-			a.jogFeedEdit.ShowEditor()
-		} else if e.Name == "P" {
-			// edit fast jog feed
-			a.jogRapidFeedEdit.ShowEditor()
+	if a.resume != nil {
+		// the resume prompt captures all keys until the user decides
+		if e.Name == "R" {
+			a.ResumeJob()
+		} else if e.Name == key.NameEscape {
+			a.DiscardCheckpoint()
 		}
+		return
 	}
 
-	if a.mode == ModeJog || a.mode == ModeRun {
-		if e.Name == "H" {
-			// feed hold
-			a.gcodeRunnerChan <- CmdPause
-		} else if e.Name == "R" {
-			// soft reset
-			a.gcodeRunnerChan <- CmdStop
-		} else if e.Name == "S" {
-			// cycle start
-			a.gcodeRunnerChan <- CmdStart
-		} else if e.Name == "U" {
-			// alarm unlock
-			a.AlarmUnlock()
+	if a.rs.BoundsWarning != nil {
+		// so does the travel warning
+		if e.Name == "S" {
+			a.gcodeRunnerChan <- RunnerCmd{Kind: CmdStart, Force: true}
+		} else if e.Name == key.NameEscape {
+			a.gcodeRunnerChan <- RunnerCmd{Kind: CmdCancelStart}
 		}
+		return
+	}
+
+	if a.showCheatsheet && e.Name == key.NameEscape {
+		// escape closes the cheatsheet before doing anything else
+		a.showCheatsheet = false
+		return
 	}
 
 	if a.mode == ModeJog {
-		// JOG MODE
-		if e.Name == "X" {
-			a.xDro.ShowEditor()
-		} else if e.Name == "Y" {
-			a.yDro.ShowEditor()
-		} else if e.Name == "Z" {
-			if e.Modifiers.Contain(key.ModCtrl) {
-				// ctrl-z = undo WCO change
-				if a.canUndo {
-					a.SetWpos(a.gs.Mpos.Sub(a.undoWco))
-				}
-			} else {
-				a.zDro.ShowEditor()
-			}
-		} else if e.Name == "A" && a.gs.Has4thAxis {
-			a.aDro.ShowEditor()
+		// macro keys take priority over the keymap
+		if m := a.MacroForKey(e); m != nil {
+			a.RunMacro(m)
+			return
 		}
 	}
 
-	if e.Name == key.NameEscape {
-		// pop mode
-		if a.mode == ModeMDI {
-			a.mdi.Defocus()
-		}
-		if a.mode != ModeRun {
-			a.PopMode()
-		}
-	} else if e.Name == "+" && e.Modifiers.Contain(key.ModCtrl) {
-		// ctrl + = zoom in
-		a.SetTextSize(a.th.TextSize * 1.1)
-	} else if e.Name == "-" && e.Modifiers.Contain(key.ModCtrl) {
-		// ctrl - = zoom out
-		a.SetTextSize(a.th.TextSize / 1.1)
-	} else if e.Name == "0" && e.Modifiers.Contain(key.ModCtrl) {
-		// ctrl 0 = reset zoom
-		a.SetTextSize(a.InitialTextSize)
+	if ka, ok := a.keymap.Action(a.mode, e); ok && ka.Do != nil {
+		ka.Do(a, e)
 	}
 }
 
@@ -567,8 +689,22 @@ func (a *App) OpenFile() {
 		f, err := e.ChooseFile()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "explorer.ChooseFile(): %v\n", err)
-		} else {
-			a.gcode.Load(f)
+			return
+		}
+		defer f.Close()
+		p, err := LoadProgram(f, &a.loadProgress)
+		var perr *ProgramError
+		if errors.As(err, &perr) && perr.Program != nil {
+			// show the program with the error in the lint panel; the
+			// runner won't start it
+			fmt.Fprintf(os.Stderr, "load G-code: %v\n", err)
+			p = perr.Program
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "load G-code: %v\n", err)
+			return
+		}
+		if err := a.gcode.Load(p); err != nil {
+			fmt.Fprintf(os.Stderr, "load G-code: %v\n", err)
 		}
 	}()
 }
@@ -653,4 +789,8 @@ func (a *App) SetTextSize(sz unit.Sp) {
 	a.feedOverrideEdit.TextSize = a.th.TextSize * 1.6
 	a.rapidOverrideEdit.TextSize = a.th.TextSize * 1.6
 	a.spindleOverrideEdit.TextSize = a.th.TextSize * 1.6
+	a.xform.SetTextSize(a.th.TextSize * 1.6)
+	a.array.SetTextSize(a.th.TextSize * 1.6)
+	a.hmap.SetTextSize(a.th.TextSize * 1.6)
+	a.sim.SetTextSize(a.th.TextSize * 1.6)
 }
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gioui.org/layout"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+
+	"github.com/256dpi/gcode"
+)
+
+// a grid of copies of a program, for cutting several parts from one sheet;
+// the zero value is a single copy
+//
+// copies are numbered from 0, along X and then along Y
+type Array struct {
+	NX    int     // copies along X; 0 means 1
+	NY    int     // copies along Y; 0 means 1
+	Pitch V4d     // distance between copies in X and Y
+	SafeZ float64 // work Z to move between copies at, in the program's units
+	Skip  []int   // copies not to cut, in order
+}
+
+func (arr Array) IsIdentity() bool {
+	return arr.Count() <= 1
+}
+
+func (arr Array) Count() int {
+	nx, ny := arr.NX, arr.NY
+	if nx < 1 {
+		nx = 1
+	}
+	if ny < 1 {
+		ny = 1
+	}
+	return nx * ny
+}
+
+func (arr Array) Skipped(k int) bool {
+	i := sort.SearchInts(arr.Skip, k)
+	return i < len(arr.Skip) && arr.Skip[i] == k
+}
+
+// return a copy of the array with copy k skipped, or not skipped if it was
+func (arr Array) ToggleSkip(k int) Array {
+	skip := make([]int, 0, len(arr.Skip)+1)
+	for _, s := range arr.Skip {
+		if s != k {
+			skip = append(skip, s)
+		}
+	}
+	if !arr.Skipped(k) {
+		skip = append(skip, k)
+		sort.Ints(skip)
+	}
+	arr.Skip = skip
+	return arr
+}
+
+// return the offset of copy k from the original
+func (arr Array) Offset(k int) V4d {
+	nx := arr.NX
+	if nx < 1 {
+		nx = 1
+	}
+	return V4d{X: float64(k%nx) * arr.Pitch.X, Y: float64(k/nx) * arr.Pitch.Y}
+}
+
+// format the array for config files, e.g. "copies=3x2 pitch=50,40 safez=5 skip=1,4"
+func (arr Array) String() string {
+	if arr.IsIdentity() {
+		return ""
+	}
+	s := fmt.Sprintf("copies=%dx%d pitch=%s,%s safez=%s", max(arr.NX, 1), max(arr.NY, 1), formatNumber(arr.Pitch.X), formatNumber(arr.Pitch.Y), formatNumber(arr.SafeZ))
+	if len(arr.Skip) > 0 {
+		skip := make([]string, len(arr.Skip))
+		for i, k := range arr.Skip {
+			skip[i] = strconv.Itoa(k)
+		}
+		s += " skip=" + strings.Join(skip, ",")
+	}
+	return s
+}
+
+// parse the output of Array.String()
+func ParseArray(s string) (Array, error) {
+	arr := Array{}
+	for _, part := range strings.Fields(s) {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return arr, fmt.Errorf("bad array: [%s]", part)
+		}
+		if kv[0] == "copies" {
+			if _, err := fmt.Sscanf(kv[1], "%dx%d", &arr.NX, &arr.NY); err != nil {
+				return arr, fmt.Errorf("bad array: [%s]: %v", part, err)
+			}
+		} else if kv[0] == "pitch" {
+			v, n, err := ParseV4d(kv[1])
+			if err != nil || n != 2 {
+				return arr, fmt.Errorf("bad array: [%s]", part)
+			}
+			arr.Pitch = v
+		} else if kv[0] == "safez" {
+			z, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				return arr, fmt.Errorf("bad array: [%s]: %v", part, err)
+			}
+			arr.SafeZ = z
+		} else if kv[0] == "skip" {
+			for _, v := range strings.Split(kv[1], ",") {
+				k, err := strconv.Atoi(v)
+				if err != nil {
+					return arr, fmt.Errorf("bad array: [%s]: %v", part, err)
+				}
+				arr.Skip = append(arr.Skip, k)
+			}
+			sort.Ints(arr.Skip)
+		} else {
+			return arr, fmt.Errorf("unrecognised array: [%s]", part)
+		}
+	}
+	return arr, nil
+}
+
+// return the box around each copy, given the box around all of the copies
+// that aren't skipped, and whether each copy is skipped
+func (arr Array) Boxes(all Bounds) ([]Bounds, []bool) {
+	// the box around the copies is the box around one copy, grown by the
+	// offsets of the first and last copies on each axis
+	minOffset := EmptyBounds()
+	for k := 0; k < arr.Count(); k++ {
+		if !arr.Skipped(k) {
+			minOffset = minOffset.Add(arr.Offset(k))
+		}
+	}
+	if minOffset.Empty() {
+		return nil, nil
+	}
+	one := Bounds{Min: all.Min.Sub(minOffset.Min), Max: all.Max.Sub(minOffset.Max)}
+
+	boxes := make([]Bounds, arr.Count())
+	skipped := make([]bool, arr.Count())
+	for k := range boxes {
+		boxes[k] = one.Offset(arr.Offset(k))
+		skipped[k] = arr.Skipped(k)
+	}
+	return boxes, skipped
+}
+
+// return the first X and Y that the program moves to
+func firstXY(p *Program) (V4d, bool) {
+	pos := V4d{}
+	hasX, hasY := false, false
+	p.Each(func(i int, str string) bool {
+		line, err := ParseWords(str)
+		if err != nil {
+			return true
+		}
+		for _, c := range line.Codes {
+			if c.Letter == "X" {
+				pos.X, hasX = c.Value, true
+			} else if c.Letter == "Y" {
+				pos.Y, hasY = c.Value, true
+			}
+		}
+		return !(hasX && hasY)
+	})
+	return pos, hasX && hasY
+}
+
+// remove any M2 or M30 from the line, so that the program carries on to the next copy
+func removeProgramEnd(str string) string {
+	line, err := ParseWords(str)
+	if err != nil {
+		return str
+	}
+	codes := make([]gcode.GCode, 0, len(line.Codes))
+	removed := false
+	for _, c := range line.Codes {
+		if c.Letter == "M" && (c.Value == 2 || c.Value == 30) {
+			removed = true
+			continue
+		}
+		codes = append(codes, c)
+	}
+	if !removed {
+		return str
+	}
+	line.Codes = codes
+	return FormatWords(line)
+}
+
+// return a program that cuts every copy that isn't skipped, one after
+// another, moving between them at the safe Z
+func (arr Array) Apply(src *Program, progress *Progress) (*Program, error) {
+	pw, err := NewProgramWriter(src.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	copies := make([]int, 0)
+	for k := 0; k < arr.Count(); k++ {
+		if !arr.Skipped(k) {
+			copies = append(copies, k)
+		}
+	}
+	if len(copies) == 0 {
+		pw.Discard()
+		return nil, fmt.Errorf("every copy is skipped")
+	}
+
+	start, haveStart := firstXY(src)
+	total := int64(src.Len() * len(copies))
+	for n, k := range copies {
+		offset := arr.Offset(k)
+		pw.WriteLine(fmt.Sprintf("(copy %d of %d at X%s Y%s)", k+1, arr.Count(), formatNumber(offset.X), formatNumber(offset.Y)))
+		if n > 0 {
+			pw.WriteLine(fmt.Sprintf("G90 G0 Z%s", formatNumber(arr.SafeZ)))
+			if haveStart {
+				pw.WriteLine(fmt.Sprintf("G0 X%s Y%s", formatNumber(start.X+offset.X), formatNumber(start.Y+offset.Y)))
+			}
+		}
+
+		t := Transform{Move: offset}
+		in := NewInterpreter(defaultArcTolerance)
+		last := n == len(copies)-1
+		var applyErr error
+		src.Each(func(i int, str string) bool {
+			if progress != nil && i%programBlockLines == 0 {
+				progress.Set(int64(n*src.Len()+i), total)
+			}
+			out, err := t.applyLine(i, str, in)
+			if err != nil {
+				applyErr = &ProgramError{Line: i, Msg: err.Error()}
+				return false
+			}
+			if !last {
+				out = removeProgramEnd(out)
+				if out == "" {
+					return true
+				}
+			}
+			pw.WriteLine(out)
+			return true
+		})
+		if applyErr != nil {
+			pw.Discard()
+			return nil, applyErr
+		}
+	}
+	if progress != nil {
+		progress.Set(total, total)
+	}
+
+	p, err := pw.Program()
+	if err != nil {
+		return nil, err
+	}
+	p.Source = src
+	p.Array = arr
+	return p, nil
+}
+
+// the panel for setting up step-and-repeat of the loaded program
+type ArrayPanel struct {
+	app     *App
+	visible bool
+
+	nxEdit     EditableNum
+	nyEdit     EditableNum
+	pitchXEdit EditableNum
+	pitchYEdit EditableNum
+	safeZEdit  EditableNum
+
+	resetBtn widget.Clickable
+	copyBtns []widget.Clickable
+}
+
+func NewArrayPanel(app *App) *ArrayPanel {
+	ap := &ArrayPanel{app: app}
+
+	edit := func(e *EditableNum, label string, isInt bool, set func(arr *Array, v float64)) {
+		e.app = app
+		e.Label = label
+		e.Int = isInt
+		e.Callback = func(v float64) {
+			arr := ap.Current()
+			set(&arr, v)
+			ap.Set(arr)
+		}
+	}
+	// the numbering of the copies changes with the counts, so forget which were skipped
+	edit(&ap.nxEdit, "X copies", true, func(arr *Array, v float64) { arr.NX = int(v); arr.Skip = nil })
+	edit(&ap.nyEdit, "Y copies", true, func(arr *Array, v float64) { arr.NY = int(v); arr.Skip = nil })
+	edit(&ap.pitchXEdit, " X pitch", false, func(arr *Array, v float64) { arr.Pitch.X = v })
+	edit(&ap.pitchYEdit, " Y pitch", false, func(arr *Array, v float64) { arr.Pitch.Y = v })
+	edit(&ap.safeZEdit, "  Safe Z", false, func(arr *Array, v float64) { arr.SafeZ = v })
+
+	return ap
+}
+
+// return the array of the loaded program
+func (ap *ArrayPanel) Current() Array {
+	if ap.app.rs.Program == nil {
+		return Array{}
+	}
+	return ap.app.rs.Program.Array
+}
+
+func (ap *ArrayPanel) Set(arr Array) {
+	prog := ap.app.rs.Program
+	if prog == nil {
+		return
+	}
+	ap.app.Reprocess(prog.Transform, arr, prog.HeightMap)
+}
+
+func (ap *ArrayPanel) Layout(gtx C) D {
+	if !ap.visible {
+		return D{}
+	}
+
+	arr := ap.Current()
+	for ap.resetBtn.Clicked(gtx) {
+		ap.Set(Array{})
+	}
+	if len(ap.copyBtns) < arr.Count() {
+		ap.copyBtns = make([]widget.Clickable, arr.Count())
+	}
+	for k := 0; k < arr.Count(); k++ {
+		for ap.copyBtns[k].Clicked(gtx) {
+			ap.Set(arr.ToggleSkip(k))
+		}
+	}
+
+	nx := max(arr.NX, 1)
+	ny := max(arr.NY, 1)
+
+	children := []layout.FlexChild{
+		layout.Rigid(func(gtx C) D {
+			return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx,
+				material.H6(ap.app.th, "Array ").Layout,
+				material.Button(ap.app.th, &ap.resetBtn, "RESET").Layout,
+			)
+		}),
+		layout.Rigid(func(gtx C) D {
+			return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx,
+				func(gtx C) D { return ap.nxEdit.Layout(gtx, float64(nx)) },
+				func(gtx C) D { return ap.nyEdit.Layout(gtx, float64(ny)) },
+				func(gtx C) D { return ap.pitchXEdit.Layout(gtx, arr.Pitch.X) },
+				func(gtx C) D { return ap.pitchYEdit.Layout(gtx, arr.Pitch.Y) },
+				func(gtx C) D { return ap.safeZEdit.Layout(gtx, arr.SafeZ) },
+			)
+		}),
+	}
+
+	if !arr.IsIdentity() {
+		// a button per copy, laid out like the copies, with +Y at the top
+		for j := ny - 1; j >= 0; j-- {
+			j := j
+			children = append(children, layout.Rigid(func(gtx C) D {
+				btns := make([]layout.Widget, nx)
+				for i := 0; i < nx; i++ {
+					k := j*nx + i
+					lbl := fmt.Sprintf("%d", k+1)
+					if arr.Skipped(k) {
+						lbl = "SKIP"
+					}
+					btns[i] = material.Button(ap.app.th, &ap.copyBtns[k], lbl).Layout
+				}
+				return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx, btns...)
+			}))
+		}
+	}
+
+	return Panel{Width: 1, CornerRadius: 5, Color: grey(128), BackgroundColor: grey(16), Margin: layout.UniformInset(5), Padding: layout.UniformInset(5)}.Layout(gtx, func(gtx C) D {
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx, children...)
+	})
+}
+
+func (ap *ArrayPanel) SetTextSize(sz unit.Sp) {
+	for _, e := range []*EditableNum{&ap.nxEdit, &ap.nyEdit, &ap.pitchXEdit, &ap.pitchYEdit, &ap.safeZEdit} {
+		e.TextSize = sz
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/op/paint"
+	"gioui.org/widget/material"
+)
+
+// an axis-aligned box
+type Bounds struct {
+	Min V4d
+	Max V4d
+}
+
+// return a box that contains nothing, so that the first Add() gives a box
+// around only that point
+func EmptyBounds() Bounds {
+	inf := math.Inf(1)
+	return Bounds{Min: V4d{X: inf, Y: inf, Z: inf, A: inf}, Max: V4d{X: -inf, Y: -inf, Z: -inf, A: -inf}}
+}
+
+func (b Bounds) Empty() bool {
+	return b.Min.X > b.Max.X
+}
+
+// return the box grown to contain pos
+func (b Bounds) Add(pos V4d) Bounds {
+	b.Min = V4d{X: math.Min(b.Min.X, pos.X), Y: math.Min(b.Min.Y, pos.Y), Z: math.Min(b.Min.Z, pos.Z), A: math.Min(b.Min.A, pos.A)}
+	b.Max = V4d{X: math.Max(b.Max.X, pos.X), Y: math.Max(b.Max.Y, pos.Y), Z: math.Max(b.Max.Z, pos.Z), A: math.Max(b.Max.A, pos.A)}
+	return b
+}
+
+// return the box grown to contain the axes of pos that the interpreter
+// knows in work coordinates
+func (b Bounds) AddKnown(pos V4d, in *Interpreter) Bounds {
+	for _, axis := range []string{"X", "Y", "Z", "A"} {
+		if in.Known(axis) {
+			v := *pos.Select(axis)
+			*b.Min.Select(axis) = math.Min(*b.Min.Select(axis), v)
+			*b.Max.Select(axis) = math.Max(*b.Max.Select(axis), v)
+		}
+	}
+	return b
+}
+
+// return the box with each axis that has nothing on it set to 0 (where the
+// interpreter starts), unless the whole box is empty
+func (b Bounds) FillEmptyAxes() Bounds {
+	empty := true
+	for _, axis := range []string{"X", "Y", "Z", "A"} {
+		if *b.Min.Select(axis) <= *b.Max.Select(axis) {
+			empty = false
+		}
+	}
+	if empty {
+		return b
+	}
+	for _, axis := range []string{"X", "Y", "Z", "A"} {
+		if *b.Min.Select(axis) > *b.Max.Select(axis) {
+			*b.Min.Select(axis) = 0
+			*b.Max.Select(axis) = 0
+		}
+	}
+	return b
+}
+
+// return the box moved by offset
+func (b Bounds) Offset(offset V4d) Bounds {
+	return Bounds{Min: b.Min.Add(offset), Max: b.Max.Add(offset)}
+}
+
+// return the machine coordinates that the machine can reach, from the max
+// travel ($130, $131, $132) and the homing direction ($23); false if the
+// machine doesn't home, or we don't know its config
+//
+// Grbl puts machine zero at the home position, so by default (homing
+// towards positive) the travel is from -max to 0, and for each axis with its
+// bit set in $23 it is from 0 to max
+func (gs GrblStatus) Envelope() (Bounds, bool) {
+	if gs.GrblConfig[22] != 1 {
+		// machine coordinates mean nothing without homing
+		return Bounds{}, false
+	}
+	b := Bounds{}
+	dirMask := int(gs.GrblConfig[23])
+	for i, axis := range []string{"X", "Y", "Z"} {
+		travel, ok := gs.GrblConfig[130+i]
+		if !ok || travel <= 0 {
+			return Bounds{}, false
+		}
+		if dirMask&(1<<i) != 0 {
+			*b.Max.Select(axis) = travel
+		} else {
+			*b.Min.Select(axis) = -travel
+		}
+	}
+	return b, true
+}
+
+// return a warning for each axis on which the box (in machine coordinates)
+// goes outside the envelope
+func (b Bounds) Overruns(envelope Bounds) []string {
+	warnings := make([]string, 0)
+	for _, axis := range []string{"X", "Y", "Z"} {
+		lo, hi := *b.Min.Select(axis), *b.Max.Select(axis)
+		envLo, envHi := *envelope.Min.Select(axis), *envelope.Max.Select(axis)
+		if lo < envLo {
+			warnings = append(warnings, fmt.Sprintf("%s goes %.3f mm past the end of travel at %s%.3f", axis, envLo-lo, axis, envLo))
+		}
+		if hi > envHi {
+			warnings = append(warnings, fmt.Sprintf("%s goes %.3f mm past the end of travel at %s%.3f", axis, hi-envHi, axis, envHi))
+		}
+	}
+	return warnings
+}
+
+const boundsUnknownWarning = "the program is still being read, so its extent isn't known yet"
+
+// check that the program would stay within the machine's travel with the
+// current work offset; only call this from the runner goroutine
+//
+// the program's bounds leave out moves to machine coordinates (G53) and
+// stored positions (G28, G30), which don't move with the work offset
+func (r *GCodeRunner) CheckBounds() []string {
+	envelope, ok := r.gs.Envelope()
+	if !ok || r.program == nil {
+		return nil
+	}
+	b, known := r.program.Bounds()
+	if !known {
+		// the toolpath view is still reading the program
+		return []string{boundsUnknownWarning}
+	}
+	if b.Empty() {
+		return nil
+	}
+	return b.Offset(r.gs.Wco).Overruns(envelope)
+}
+
+// warn that the program goes outside the machine's travel, and let the user
+// run it anyway or cancel
+func (a *App) LayoutBoundsPrompt(gtx C) D {
+	warnings := a.rs.BoundsWarning
+	if warnings == nil {
+		return D{}
+	}
+
+	title := "Program exceeds machine travel"
+	if len(warnings) == 1 && warnings[0] == boundsUnknownWarning {
+		title = "Can't check machine travel yet"
+		if _, known := a.rs.Program.Bounds(); known {
+			// the toolpath view has finished reading the program, so try again
+			a.gcodeRunnerChan <- RunnerCmd{Kind: CmdStart}
+		}
+	}
+
+	for a.runAnywayBtn.Clicked(gtx) {
+		a.gcodeRunnerChan <- RunnerCmd{Kind: CmdStart, Force: true}
+	}
+	for a.cancelRunBtn.Clicked(gtx) {
+		a.gcodeRunnerChan <- RunnerCmd{Kind: CmdCancelStart}
+	}
+
+	macro := op.Record(gtx.Ops)
+
+	paint.Fill(gtx.Ops, rgba(0, 0, 0, 230))
+
+	gtx.Constraints.Min = gtx.Constraints.Max
+	layout.Center.Layout(gtx, func(gtx C) D {
+		gtx.Constraints.Min.X = 0
+		gtx.Constraints.Min.Y = 0
+		return Panel{Width: 1, CornerRadius: 5, Color: grey(128), BackgroundColor: grey(32), Padding: layout.UniformInset(10)}.Layout(gtx, func(gtx C) D {
+			children := []layout.FlexChild{
+				layout.Rigid(material.H5(a.th, title).Layout),
+				layout.Rigid(layout.Spacer{Height: 5}.Layout),
+			}
+			for _, w := range warnings {
+				children = append(children, layout.Rigid(material.Body1(a.th, w).Layout))
+			}
+			children = append(children,
+				layout.Rigid(material.Body1(a.th, fmt.Sprintf("with WCO X%.3f Y%.3f Z%.3f", a.gs.Wco.X, a.gs.Wco.Y, a.gs.Wco.Z)).Layout),
+				layout.Rigid(layout.Spacer{Height: 5}.Layout),
+				layout.Rigid(func(gtx C) D {
+					return Toolbar{Inset: layout.UniformInset(5)}.Layout(gtx,
+						material.Button(a.th, a.runAnywayBtn, "RUN ANYWAY (S)").Layout,
+						material.Button(a.th, a.cancelRunBtn, "CANCEL (Esc)").Layout,
+					)
+				}),
+			)
+			return layout.Flex{Axis: layout.Vertical}.Layout(gtx, children...)
+		})
+	})
+
+	op.Defer(gtx.Ops, macro.Stop())
+
+	return D{}
+}
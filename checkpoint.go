@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/op/paint"
+	"gioui.org/widget/material"
+
+	"github.com/256dpi/gcode"
+)
+
+// enough state to resume a job that was interrupted by e.g. a power cut
+type Checkpoint struct {
+	File   string
+	Line   int    // index of the last line we think has been executed
+	GCodes string // modal state, as reported by "$G"
+	Wco    V4d    // the total offset, as reported in the status
+	Offset V4d    // of the active work coordinate system, from "$#"
+	G92    V4d    // from "$#"
+	TLO    float64
+	// false for checkpoints written before we recorded the offsets
+	// separately, in which case Offset is the same as Wco
+	HaveOffsets bool
+	Time        time.Time
+	Transform   Transform // applied to the file when it was loaded
+	Array       Array     // applied after Transform
+	HeightMap   string    // file of the height map applied last, if any
+}
+
+func CheckpointFile() string {
+	return filepath.Join(ConfDir(), "checkpoint.conf")
+}
+
+// write a checkpoint for the current program; only call this from the runner goroutine
+func (r *GCodeRunner) WriteCheckpoint() {
+	if r.lastAcked < 0 || !filepath.IsAbs(r.program.Name) {
+		// nothing executed yet, or we wouldn't be able to find the file again
+		return
+	}
+
+	// lines that Grbl has accepted might still be waiting in the planner, so
+	// assume one planner block per line to get a conservative estimate of
+	// the last line that was actually executed
+	gs := r.gs
+	executed := r.lastAcked - (gs.PlannerSize - gs.PlannerFree)
+	if executed < 0 {
+		executed = 0
+	}
+
+	filename := CheckpointFile()
+	// write to a temporary file and rename it, so that we never leave a half-written checkpoint
+	tmpname := filename + ".tmp"
+	f, err := os.Create(tmpname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "write %s: %v\n", tmpname, err)
+		return
+	}
+	fmt.Fprintf(f, "file=%s\n", r.program.Name)
+	fmt.Fprintf(f, "line=%d\n", executed+1)
+	fmt.Fprintf(f, "gcodes=%s\n", gs.GCodes)
+	fmt.Fprintf(f, "wco=%.3f,%.3f,%.3f,%.3f\n", gs.Wco.X, gs.Wco.Y, gs.Wco.Z, gs.Wco.A)
+	if gs.HaveOffsets {
+		offset := gs.WcsOffset()
+		fmt.Fprintf(f, "offset=%.3f,%.3f,%.3f,%.3f\n", offset.X, offset.Y, offset.Z, offset.A)
+		fmt.Fprintf(f, "g92=%.3f,%.3f,%.3f,%.3f\n", gs.G92Offset.X, gs.G92Offset.Y, gs.G92Offset.Z, gs.G92Offset.A)
+		fmt.Fprintf(f, "tlo=%.3f\n", gs.TLO)
+	}
+	fmt.Fprintf(f, "time=%s\n", time.Now().Format(time.RFC3339))
+	if !r.program.Transform.IsIdentity() {
+		fmt.Fprintf(f, "transform=%s\n", r.program.Transform)
+	}
+	if !r.program.Array.IsIdentity() {
+		fmt.Fprintf(f, "array=%s\n", r.program.Array)
+	}
+	if hm := r.program.HeightMap; hm != nil && hm.File != "" {
+		fmt.Fprintf(f, "heightmap=%s\n", hm.File)
+	}
+	if err := f.Sync(); err != nil {
+		fmt.Fprintf(os.Stderr, "sync %s: %v\n", tmpname, err)
+	}
+	f.Close()
+
+	if err := os.Rename(tmpname, filename); err != nil {
+		fmt.Fprintf(os.Stderr, "rename %s: %v\n", tmpname, err)
+	}
+}
+
+// return the saved checkpoint, or nil if there is none
+func ReadCheckpoint() *Checkpoint {
+	filename := CheckpointFile()
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "read %s: %v\n", filename, err)
+		}
+		return nil
+	}
+	defer f.Close()
+
+	c := &Checkpoint{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			fmt.Fprintf(os.Stderr, "%s: unrecognised line: [%s]\n", filename, line)
+			continue
+		}
+		key := parts[0]
+		val := parts[1]
+
+		if key == "file" {
+			c.File = val
+		} else if key == "line" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: strconv.Atoi(%s): %v\n", filename, val, err)
+				return nil
+			}
+			c.Line = n - 1
+		} else if key == "gcodes" {
+			c.GCodes = val
+		} else if key == "wco" {
+			c.Wco, _, _ = ParseV4d(val)
+		} else if key == "offset" {
+			c.Offset, _, _ = ParseV4d(val)
+			c.HaveOffsets = true
+		} else if key == "g92" {
+			c.G92, _, _ = ParseV4d(val)
+		} else if key == "tlo" {
+			c.TLO, _ = strconv.ParseFloat(val, 64)
+		} else if key == "time" {
+			c.Time, _ = time.Parse(time.RFC3339, val)
+		} else if key == "transform" {
+			t, err := ParseTransform(val)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+				return nil
+			}
+			c.Transform = t
+		} else if key == "array" {
+			arr, err := ParseArray(val)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+				return nil
+			}
+			c.Array = arr
+		} else if key == "heightmap" {
+			c.HeightMap = val
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: unrecognised checkpoint key: [%s]\n", filename, key)
+		}
+	}
+
+	if c.File == "" {
+		return nil
+	}
+	if !c.HaveOffsets {
+		c.Offset = c.Wco
+	}
+	return c
+}
+
+func RemoveCheckpoint() {
+	err := os.Remove(CheckpointFile())
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "remove checkpoint: %v\n", err)
+	}
+}
+
+// load the checkpointed file, and tell the runner to start the next run with a
+// recovery preamble followed by the program from a safe line near the checkpoint
+func (r *GCodeRunner) Resume(c *Checkpoint, homing bool) error {
+	p, err := LoadProgramFile(c.File, &r.app.loadProgress)
+	if err != nil {
+		return err
+	}
+	var hm *HeightMap
+	if c.HeightMap != "" {
+		hm, err = ReadHeightMapFile(c.HeightMap)
+		if err != nil {
+			return err
+		}
+	}
+	p, err = ProcessProgram(p, c.Transform, c.Array, hm, &r.app.loadProgress)
+	if err != nil {
+		return err
+	}
+
+	resumeLine := p.SafeResumeLine(c.Line + 1)
+	pos, safeZ := p.StateBefore(resumeLine)
+	preamble := ResumePreamble(c, pos, safeZ, homing)
+
+	fmt.Printf("resuming %s from line %d with preamble:\n", c.File, resumeLine+1)
+	for _, line := range preamble {
+		fmt.Printf("  %s\n", line)
+	}
+
+	return r.LoadFrom(p, resumeLine, preamble)
+}
+
+// back up from line n to the start of any run of non-motion lines before it, so
+// that modal changes made just before the resume point (feed, speed, tool...) get
+// re-sent
+func (p *Program) SafeResumeLine(n int) int {
+	if n > p.Len() {
+		n = p.Len()
+	}
+	for n > 0 && !hasAxisWords(p.Line(n-1)) {
+		n--
+	}
+	return n
+}
+
+// return the position before line n is executed, in the program's
+// coordinates and in mm, and the highest Z reached so far, in the same
+// coordinates
+func (p *Program) StateBefore(n int) (V4d, float64) {
+	in := NewInterpreter(defaultArcTolerance)
+	maxZ := 0.0
+
+	p.Each(func(i int, str string) bool {
+		if i >= n {
+			return false
+		}
+		// lines that fail are ignored, like in ParseSegments()
+		segs, _ := in.Line(i, str)
+		for _, seg := range segs {
+			if seg.End.Z > maxZ {
+				maxZ = seg.End.Z
+			}
+		}
+		return true
+	})
+
+	// maxZ is in our coordinates, which are the same as the program's at the start
+	return in.WorkPos(), maxZ - in.offset().Z
+}
+
+// generate the lines to restore modal state, restart the spindle, and reposition
+// the tool at pos, from above; pos and safeZ are in mm
+func ResumePreamble(c *Checkpoint, pos V4d, safeZ float64, homing bool) []string {
+	modes := make([]string, 0)
+	spindle := ""
+	coolant := make([]string, 0)
+	feed := ""
+	speed := ""
+	wcs := "G54"
+	incremental := false
+	inches := false
+
+	for _, word := range strings.Fields(c.GCodes) {
+		if strings.HasPrefix(word, "G") {
+			n, err := strconv.ParseFloat(word[1:], 64)
+			if err != nil || n <= 3 || (n >= 38 && n < 39) || n == 80 {
+				// don't restore motion modes
+				continue
+			}
+			if n >= 54 && n <= 59 {
+				wcs = word
+			}
+			if n == 91 {
+				// reposition in absolute mode, and restore G91 at the end
+				incremental = true
+				continue
+			}
+			if n == 20 {
+				// reposition in mm, and restore G20 at the end
+				inches = true
+				continue
+			}
+			if n == 43.1 || n == 49 {
+				// the tool length offset needs a value, see below
+				continue
+			}
+			modes = append(modes, word)
+		} else if word == "M3" || word == "M4" {
+			spindle = word
+		} else if word == "M7" || word == "M8" {
+			coolant = append(coolant, word)
+		} else if strings.HasPrefix(word, "F") {
+			feed = word
+		} else if strings.HasPrefix(word, "S") {
+			speed = word
+		}
+	}
+
+	lines := make([]string, 0)
+	lines = append(lines, fmt.Sprintf("(resume %s after line %d)", filepath.Base(c.File), c.Line+1))
+	lines = append(lines, "G21")
+
+	// the G92 offset to restore once the tool is in place
+	g92 := V4d{}
+	if homing {
+		// machine coordinates survive a restart if the machine is homed, so
+		// restore the offsets that were in effect at the checkpoint; otherwise
+		// we rely on the saved work position, see App.ReadConf()
+		wcsNum := 1
+		for i, name := range wcsNames {
+			if name == wcs {
+				wcsNum = i + 1
+			}
+		}
+		lines = append(lines, fmt.Sprintf("G10 L2 P%d X%.3f Y%.3f Z%.3f", wcsNum, c.Offset.X, c.Offset.Y, c.Offset.Z))
+		if c.HaveOffsets {
+			if c.TLO != 0 {
+				lines = append(lines, fmt.Sprintf("G43.1 Z%.3f", c.TLO))
+			}
+			// move without G92, then set it so that the tool is at pos
+			lines = append(lines, "G92.1")
+			g92 = c.G92
+		}
+	}
+
+	if len(modes) > 0 {
+		lines = append(lines, strings.Join(modes, " "))
+	}
+	lines = append(lines, "G90")
+	lines = append(lines, fmt.Sprintf("G0 Z%.3f", safeZ+g92.Z))
+	if spindle != "" {
+		lines = append(lines, strings.TrimSpace(spindle+" "+speed))
+		// give the spindle time to spin up
+		lines = append(lines, "G4 P5")
+	}
+	lines = append(lines, coolant...)
+	lines = append(lines, fmt.Sprintf("G0 X%.3f Y%.3f", pos.X+g92.X, pos.Y+g92.Y))
+	mmFeed := feed
+	if feed != "" && inches {
+		// the feed rate from "$G" is in the program's units
+		if f, err := strconv.ParseFloat(feed[1:], 64); err == nil {
+			mmFeed = fmt.Sprintf("F%g", f*25.4)
+		}
+	}
+	lines = append(lines, strings.TrimSpace(fmt.Sprintf("G1 Z%.3f %s", pos.Z+g92.Z, mmFeed)))
+	if g92 != (V4d{}) {
+		lines = append(lines, fmt.Sprintf("G92 X%.3f Y%.3f Z%.3f", pos.X, pos.Y, pos.Z))
+	}
+	if inches {
+		lines = append(lines, "G20")
+		if feed != "" {
+			// and put the feed rate back in inches
+			lines = append(lines, feed)
+		}
+	}
+	if incremental {
+		lines = append(lines, "G91")
+	}
+
+	return lines
+}
+
+func hasAxisWords(str string) bool {
+	line, err := gcode.ParseLine(str)
+	if err != nil {
+		return false
+	}
+	var v V4d
+	for _, gc := range line.Codes {
+		if v.Select(gc.Letter) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *App) ResumeJob() {
+	c := a.resume
+	a.resume = nil
+	if c == nil {
+		return
+	}
+	// machine coordinates only survive a restart if the machine homes
+	homing := a.gs.GrblConfig[22] == 1
+	go func() {
+		err := a.gcode.Resume(c, homing)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "resume %s: %v\n", c.File, err)
+		}
+		a.w.Invalidate()
+	}()
+}
+
+func (a *App) DiscardCheckpoint() {
+	a.resume = nil
+	RemoveCheckpoint()
+}
+
+// offer to resume an interrupted job, if there is one
+func (a *App) LayoutResumePrompt(gtx C) D {
+	c := a.resume
+	if c == nil {
+		return D{}
+	}
+
+	for a.resumeBtn.Clicked(gtx) {
+		a.ResumeJob()
+	}
+	for a.discardBtn.Clicked(gtx) {
+		a.DiscardCheckpoint()
+	}
+
+	macro := op.Record(gtx.Ops)
+
+	paint.Fill(gtx.Ops, rgba(0, 0, 0, 230))
+
+	gtx.Constraints.Min = gtx.Constraints.Max
+	layout.Center.Layout(gtx, func(gtx C) D {
+		gtx.Constraints.Min.X = 0
+		gtx.Constraints.Min.Y = 0
+		return Panel{Width: 1, CornerRadius: 5, Color: grey(128), BackgroundColor: grey(32), Padding: layout.UniformInset(10)}.Layout(gtx, func(gtx C) D {
+			return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+				layout.Rigid(material.H5(a.th, "Interrupted job").Layout),
+				layout.Rigid(layout.Spacer{Height: 5}.Layout),
+				layout.Rigid(material.Body1(a.th, c.File).Layout),
+				layout.Rigid(material.Body1(a.th, fmt.Sprintf("executed up to line %d at %s", c.Line+1, c.Time.Format("2006-01-02 15:04:05"))).Layout),
+				layout.Rigid(material.Body1(a.th, fmt.Sprintf("WCO was X%.3f Y%.3f Z%.3f", c.Wco.X, c.Wco.Y, c.Wco.Z)).Layout),
+				layout.Rigid(material.Body1(a.th, c.GCodes).Layout),
+				layout.Rigid(func(gtx C) D {
+					if c.Transform.IsIdentity() {
+						return D{}
+					}
+					return material.Body1(a.th, "transform: "+c.Transform.String()).Layout(gtx)
+				}),
+				layout.Rigid(func(gtx C) D {
+					if c.Array.IsIdentity() {
+						return D{}
+					}
+					return material.Body1(a.th, "array: "+c.Array.String()).Layout(gtx)
+				}),
+				layout.Rigid(func(gtx C) D {
+					if c.HeightMap == "" {
+						return D{}
+					}
+					return material.Body1(a.th, "height map: "+c.HeightMap).Layout(gtx)
+				}),
+				layout.Rigid(layout.Spacer{Height: 5}.Layout),
+				layout.Rigid(func(gtx C) D {
+					return Toolbar{Inset: layout.UniformInset(5)}.Layout(gtx,
+						material.Button(a.th, a.resumeBtn, "RESUME (R)").Layout,
+						material.Button(a.th, a.discardBtn, "DISCARD (Esc)").Layout,
+					)
+				}),
+			)
+		})
+	})
+
+	op.Defer(gtx.Ops, macro.Stop())
+
+	return D{}
+}
@@ -18,6 +18,7 @@ func (a *App) WriteConf(gs GrblStatus) {
 	defer f.Close()
 
 	fmt.Fprintf(f, "wpos=%.3f,%.3f,%.3f,%.3f\n", gs.Wpos.X, gs.Wpos.Y, gs.Wpos.Z, gs.Wpos.A)
+	fmt.Fprintf(f, "errorpolicy=%s\n", a.gcode.State().DefaultErrorPolicy)
 }
 
 func (a *App) ReadConf() {
@@ -42,8 +43,17 @@ func (a *App) ReadConf() {
 			// XXX: assigning to gsNew is kind of a bodge, but we want this so
 			// that when the application first loads up and is not yet connected
 			// to grbl, it shows the saved coordinates
+			a.statusMu.Lock()
 			a.gsNew.Wpos = valv4d
-			a.gsNew.Wco = a.gs.Mpos.Sub(valv4d)
+			a.gsNew.Wco = a.gsNew.Mpos.Sub(valv4d)
+			a.statusMu.Unlock()
+		} else if key == "errorpolicy" {
+			policy, ok := ParseErrorPolicy(val)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "%s: unrecognised error policy: [%s]\n", filename, val)
+				continue
+			}
+			a.gcodeRunnerChan <- RunnerCmd{Kind: CmdDefaultErrorPolicy, Policy: policy}
 		} else {
 			fmt.Fprintf(os.Stderr, "%s: unrecognised config key: [%s]\n", filename, key)
 		}
@@ -51,6 +61,11 @@ func (a *App) ReadConf() {
 }
 
 func (a *App) ConfFile() string {
+	return filepath.Join(ConfDir(), "pugsender.conf")
+}
+
+// return the pugsender config directory, creating it if necessary
+func ConfDir() string {
 	confdir, err := os.UserConfigDir()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "os.UserConfigDir: %v; reverting to '.'\n", err)
@@ -58,5 +73,5 @@ func (a *App) ConfFile() string {
 	}
 	dir := filepath.Join(confdir, "pugsender")
 	os.MkdirAll(dir, os.ModePerm)
-	return filepath.Join(dir, "pugsender.conf")
+	return dir
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/op/paint"
+	"gioui.org/widget/material"
+)
+
+// draw the "what to do about this error?" popup on top of everything else,
+// if the runner is waiting for a decision
+func (a *App) LayoutErrorPrompt(gtx C) D {
+	e := a.rs.ErrorPrompt
+	if e == nil {
+		return D{}
+	}
+
+	for a.skipBtn.Clicked(gtx) {
+		a.gcodeRunnerChan <- RunnerCmd{Kind: CmdSkip}
+	}
+	for a.retryBtn.Clicked(gtx) {
+		a.gcodeRunnerChan <- RunnerCmd{Kind: CmdRetry}
+	}
+	for a.abortBtn.Clicked(gtx) {
+		a.gcodeRunnerChan <- RunnerCmd{Kind: CmdAbort}
+	}
+
+	where := fmt.Sprintf("line %d", e.Line+1)
+	if e.Line < 0 {
+		where = "preamble"
+	}
+
+	// XXX: like NumPop, defer drawing until the end of the frame so that
+	// the prompt is on top of everything else
+	macro := op.Record(gtx.Ops)
+
+	// dim the rest of the screen
+	paint.Fill(gtx.Ops, rgba(0, 0, 0, 230))
+
+	gtx.Constraints.Min = gtx.Constraints.Max
+	layout.Center.Layout(gtx, func(gtx C) D {
+		gtx.Constraints.Min.X = 0
+		gtx.Constraints.Min.Y = 0
+		return Panel{Width: 1, CornerRadius: 5, Color: grey(128), BackgroundColor: grey(32), Padding: layout.UniformInset(10)}.Layout(gtx, func(gtx C) D {
+			return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+				layout.Rigid(material.H5(a.th, e.Response).Layout),
+				layout.Rigid(layout.Spacer{Height: 5}.Layout),
+				layout.Rigid(material.Body1(a.th, fmt.Sprintf("%s: %s", where, e.Command)).Layout),
+				layout.Rigid(layout.Spacer{Height: 5}.Layout),
+				layout.Rigid(func(gtx C) D {
+					return Toolbar{Inset: layout.UniformInset(5)}.Layout(gtx,
+						material.Button(a.th, a.skipBtn, fmt.Sprintf("SKIP (%s)", a.keymap.KeysFor(ModeError, "skip"))).Layout,
+						material.Button(a.th, a.retryBtn, fmt.Sprintf("RETRY (%s)", a.keymap.KeysFor(ModeError, "retry"))).Layout,
+						material.Button(a.th, a.abortBtn, fmt.Sprintf("ABORT (%s)", a.keymap.KeysFor(ModeError, "abort"))).Layout,
+					)
+				}),
+			)
+		})
+	})
+
+	op.Defer(gtx.Ops, macro.Stop())
+
+	return D{}
+}
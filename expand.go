@@ -0,0 +1,1038 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// the sender expands a LinuxCNC-style subset of G-code that Grbl doesn't
+// understand, before it is streamed:
+//
+//	#1=10 #<depth>=[#1/4]      parameters, numbered or named
+//	G1 X[#1*2] Y#<depth>       expressions in brackets
+//	O100 sub ... O100 endsub   subroutines, with arguments in #1..#30
+//	O100 call [1] [2]
+//	O101 repeat [5] ... O101 endrepeat
+//	O102 while [#1 LT 10] ... O102 endwhile (also do/while, break, continue)
+//	O103 if [#1 EQ 0] ... O103 elseif [...] ... O103 else ... O103 endif
+//
+// expressions use LinuxCNC's operators and precedence (** before * / MOD
+// before + - before EQ NE GT GE LT LE before AND OR XOR) and functions
+// (SIN, COS, TAN, ASIN, ACOS, ATAN[y]/[x], SQRT, ABS, ROUND, FIX, FUP, EXP,
+// LN, EXISTS); trig functions work in degrees, like LinuxCNC
+
+const (
+	maxExpandedLines = 20000000  // give up if the expanded program is longer than this
+	maxExpandSteps   = 100000000 // give up if we execute this many source lines (probably an infinite loop)
+	maxCallDepth     = 100
+)
+
+// an error at a particular line of a program
+type ProgramError struct {
+	Line    int // index into the program
+	Msg     string
+	Program *Program // the program Line is in, if it should be shown to the user
+}
+
+func (e *ProgramError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line+1, e.Msg)
+}
+
+// a line with an O-word
+type oLine struct {
+	label   string
+	keyword string // "sub", "call", "if", etc.
+	arg     string // the rest of the line after the keyword
+	match   int    // for sub/if/repeat/while/do: the closing line; for everything else: the opening line
+	next    int    // for if/elseif/else: the next branch, or the endif
+	doWhile bool   // for while: this is the end of a do/while loop
+}
+
+type expandFrame struct {
+	kind     string // "call" or "repeat"
+	start    int    // line of the sub or repeat
+	returnTo int    // for "call": the line after the call
+	count    int    // for "repeat": repeats remaining
+	saved    map[string]float64
+}
+
+type expander struct {
+	src    *Program
+	out    *ProgramWriter
+	params map[string]float64
+	oLines map[int]*oLine
+	subs   map[string]int // sub label to line index
+	stack  []expandFrame
+}
+
+var oKeywords = []string{"sub", "endsub", "return", "call", "do", "while", "endwhile", "repeat", "endrepeat", "if", "elseif", "else", "endif", "break", "continue"}
+
+var exprFunctions = []string{"SIN", "COS", "TAN", "ASIN", "ACOS", "ATAN", "SQRT", "ABS", "ROUND", "FIX", "FUP", "EXP", "LN", "EXISTS"}
+
+// true if the line uses anything that needs expanding
+func needsExpansion(line string) bool {
+	code := stripComments(line)
+	if strings.ContainsAny(code, "#[") {
+		return true
+	}
+	_, keyword, _ := parseOWord(code)
+	return keyword != ""
+}
+
+// return the line with (comments) and ;comments removed
+func stripComments(line string) string {
+	var b strings.Builder
+	inComment := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if inComment {
+			if c == ')' {
+				inComment = false
+			}
+		} else if c == '(' {
+			inComment = true
+		} else if c == ';' {
+			break
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parse an O-word line like "O100 call [1] [2]", returning keyword "" if
+// the line isn't one we understand (e.g. a bare program number)
+func parseOWord(code string) (label string, keyword string, arg string) {
+	code = strings.TrimSpace(code)
+	if len(code) < 2 || (code[0] != 'O' && code[0] != 'o') {
+		return "", "", ""
+	}
+	i := 1
+	if code[i] == '<' {
+		j := strings.IndexByte(code, '>')
+		if j < 0 {
+			return "", "", ""
+		}
+		label = strings.ToLower(code[1 : j+1])
+		i = j + 1
+	} else {
+		for i < len(code) && code[i] >= '0' && code[i] <= '9' {
+			i++
+		}
+		if i == 1 {
+			return "", "", ""
+		}
+		n, _ := strconv.Atoi(code[1:i])
+		label = strconv.Itoa(n)
+	}
+	rest := strings.TrimSpace(code[i:])
+	j := 0
+	for j < len(rest) && isLetter(rest[j]) {
+		j++
+	}
+	word := strings.ToLower(rest[:j])
+	for _, kw := range oKeywords {
+		if word == kw {
+			return label, kw, strings.TrimSpace(rest[j:])
+		}
+	}
+	return "", "", ""
+}
+
+// expand parameters, expressions, and O-word control flow in the program,
+// returning a new program that Grbl can run
+func ExpandProgram(src *Program, progress *Progress) (*Program, error) {
+	e := &expander{
+		src:    src,
+		params: make(map[string]float64),
+		oLines: make(map[int]*oLine),
+		subs:   make(map[string]int),
+	}
+
+	err := e.index()
+	if err != nil {
+		return nil, err
+	}
+
+	e.out, err = NewProgramWriter(src.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = e.run(progress)
+	if progress != nil {
+		progress.Set(int64(src.Len()), int64(src.Len()))
+	}
+	if err != nil {
+		e.out.Discard()
+		return nil, err
+	}
+	return e.out.Program()
+}
+
+// find the O-word lines and match up the blocks
+func (e *expander) index() error {
+	open := make([]int, 0) // lines of blocks that haven't been closed yet
+	lastBranch := make(map[int]int)
+
+	var indexErr error
+	e.src.Each(func(i int, line string) bool {
+		label, keyword, arg := parseOWord(stripComments(line))
+		if keyword == "" {
+			return true
+		}
+		o := &oLine{label: label, keyword: keyword, arg: arg, match: -1, next: -1}
+		e.oLines[i] = o
+
+		// find the innermost open block with this label and one of the given keywords
+		find := func(keywords ...string) int {
+			for j := len(open) - 1; j >= 0; j-- {
+				start := e.oLines[open[j]]
+				if start.label != label {
+					continue
+				}
+				for _, kw := range keywords {
+					if start.keyword == kw {
+						return open[j]
+					}
+				}
+			}
+			return -1
+		}
+		// close the innermost open block, which must have this label and keyword
+		closeBlock := func(keyword string) bool {
+			if len(open) == 0 || e.oLines[open[len(open)-1]].label != label || e.oLines[open[len(open)-1]].keyword != keyword {
+				indexErr = &ProgramError{Line: i, Msg: fmt.Sprintf("O%s %s without matching %s", label, o.keyword, keyword)}
+				return false
+			}
+			start := open[len(open)-1]
+			open = open[:len(open)-1]
+			e.oLines[start].match = i
+			o.match = start
+			return true
+		}
+
+		if keyword == "sub" {
+			if _, ok := e.subs[label]; ok {
+				indexErr = &ProgramError{Line: i, Msg: fmt.Sprintf("O%s sub defined twice", label)}
+				return false
+			}
+			e.subs[label] = i
+			open = append(open, i)
+		} else if keyword == "endsub" {
+			return closeBlock("sub")
+		} else if keyword == "repeat" || keyword == "if" || keyword == "do" {
+			open = append(open, i)
+			lastBranch[i] = i
+		} else if keyword == "while" {
+			if len(open) > 0 && e.oLines[open[len(open)-1]].label == label && e.oLines[open[len(open)-1]].keyword == "do" {
+				o.doWhile = true
+				return closeBlock("do")
+			}
+			open = append(open, i)
+		} else if keyword == "endwhile" {
+			return closeBlock("while")
+		} else if keyword == "endrepeat" {
+			return closeBlock("repeat")
+		} else if keyword == "elseif" || keyword == "else" || keyword == "endif" {
+			start := -1
+			if len(open) > 0 && e.oLines[open[len(open)-1]].label == label && e.oLines[open[len(open)-1]].keyword == "if" {
+				start = open[len(open)-1]
+			}
+			if start < 0 || (keyword != "endif" && e.oLines[lastBranch[start]].keyword == "else") {
+				indexErr = &ProgramError{Line: i, Msg: fmt.Sprintf("O%s %s without matching if", label, keyword)}
+				return false
+			}
+			e.oLines[lastBranch[start]].next = i
+			lastBranch[start] = i
+			if keyword == "endif" {
+				return closeBlock("if")
+			}
+			o.match = start
+		} else if keyword == "break" || keyword == "continue" {
+			o.match = find("while", "repeat", "do")
+			if o.match < 0 {
+				indexErr = &ProgramError{Line: i, Msg: fmt.Sprintf("O%s %s outside a loop", label, keyword)}
+				return false
+			}
+		} else if keyword == "return" {
+			o.match = find("sub")
+			if o.match < 0 {
+				indexErr = &ProgramError{Line: i, Msg: fmt.Sprintf("O%s return outside a sub", label)}
+				return false
+			}
+		}
+		return true
+	})
+	if indexErr != nil {
+		return indexErr
+	}
+	if len(open) > 0 {
+		start := e.oLines[open[len(open)-1]]
+		return &ProgramError{Line: open[len(open)-1], Msg: fmt.Sprintf("O%s %s is never closed", start.label, start.keyword)}
+	}
+	return nil
+}
+
+func (e *expander) run(progress *Progress) error {
+	n := e.src.Len()
+	pc := 0
+	steps := 0
+	for pc < n {
+		steps++
+		if steps > maxExpandSteps {
+			return &ProgramError{Line: pc, Msg: "too many steps; infinite loop?"}
+		}
+		if e.out.p.nLines > maxExpandedLines {
+			return &ProgramError{Line: pc, Msg: "expanded program is too long"}
+		}
+		if progress != nil && steps%programBlockLines == 0 {
+			progress.Set(int64(pc), int64(n))
+		}
+
+		o := e.oLines[pc]
+		if o == nil {
+			line, err := e.expandLine(e.src.Line(pc))
+			if err != nil {
+				return &ProgramError{Line: pc, Msg: err.Error()}
+			}
+			if line != "" {
+				e.out.WriteLine(line)
+			}
+			pc++
+			continue
+		}
+
+		next, err := e.control(pc, o)
+		if err != nil {
+			return &ProgramError{Line: pc, Msg: err.Error()}
+		}
+		pc = next
+	}
+
+	if len(e.stack) > 0 {
+		return &ProgramError{Line: e.stack[len(e.stack)-1].start, Msg: "program ended inside a call"}
+	}
+	return nil
+}
+
+// execute the O-word line at pc, and return the next line to execute
+func (e *expander) control(pc int, o *oLine) (int, error) {
+	if o.keyword == "sub" {
+		// skip over the definition
+		return o.match + 1, nil
+
+	} else if o.keyword == "call" {
+		start, ok := e.subs[o.label]
+		if !ok {
+			return 0, fmt.Errorf("no such sub: O%s", o.label)
+		}
+		if len(e.stack) >= maxCallDepth {
+			return 0, fmt.Errorf("calls nested too deeply")
+		}
+		args, err := e.callArgs(o.arg)
+		if err != nil {
+			return 0, err
+		}
+
+		// #1..#30 and named parameters without a leading underscore are local to the sub
+		saved := make(map[string]float64)
+		for name, val := range e.params {
+			if isLocalParam(name) {
+				saved[name] = val
+				delete(e.params, name)
+			}
+		}
+		for i, val := range args {
+			e.params[strconv.Itoa(i+1)] = val
+		}
+		e.stack = append(e.stack, expandFrame{kind: "call", start: start, returnTo: pc + 1, saved: saved})
+		return start + 1, nil
+
+	} else if o.keyword == "endsub" || o.keyword == "return" {
+		if o.arg != "" {
+			val, err := e.condition(o.arg)
+			if err != nil {
+				return 0, err
+			}
+			e.params["<_value>"] = val
+		}
+		// unwind any loops inside the sub
+		for len(e.stack) > 0 && e.stack[len(e.stack)-1].kind != "call" {
+			e.stack = e.stack[:len(e.stack)-1]
+		}
+		if len(e.stack) == 0 {
+			return 0, fmt.Errorf("O%s %s outside a call", o.label, o.keyword)
+		}
+		frame := e.stack[len(e.stack)-1]
+		e.stack = e.stack[:len(e.stack)-1]
+		for name := range e.params {
+			if isLocalParam(name) {
+				delete(e.params, name)
+			}
+		}
+		for name, val := range frame.saved {
+			e.params[name] = val
+		}
+		return frame.returnTo, nil
+
+	} else if o.keyword == "repeat" {
+		count, err := e.condition(o.arg)
+		if err != nil {
+			return 0, err
+		}
+		if count < 1 {
+			return o.match + 1, nil
+		}
+		e.stack = append(e.stack, expandFrame{kind: "repeat", start: pc, count: int(count)})
+		return pc + 1, nil
+
+	} else if o.keyword == "endrepeat" {
+		l := len(e.stack)
+		if l == 0 || e.stack[l-1].kind != "repeat" || e.stack[l-1].start != o.match {
+			return 0, fmt.Errorf("O%s endrepeat outside its repeat", o.label)
+		}
+		e.stack[l-1].count--
+		if e.stack[l-1].count > 0 {
+			return o.match + 1, nil
+		}
+		e.stack = e.stack[:l-1]
+		return pc + 1, nil
+
+	} else if o.keyword == "do" {
+		return pc + 1, nil
+
+	} else if o.keyword == "while" {
+		cond, err := e.condition(o.arg)
+		if err != nil {
+			return 0, err
+		}
+		if o.doWhile {
+			if cond != 0 {
+				return o.match + 1, nil
+			}
+			return pc + 1, nil
+		}
+		if cond != 0 {
+			return pc + 1, nil
+		}
+		return o.match + 1, nil
+
+	} else if o.keyword == "endwhile" {
+		// re-evaluate the condition
+		return o.match, nil
+
+	} else if o.keyword == "if" {
+		// find the first branch whose condition is true
+		cond, err := e.condition(o.arg)
+		if err != nil {
+			return 0, err
+		}
+		branch := pc
+		for cond == 0 {
+			branch = e.oLines[branch].next
+			b := e.oLines[branch]
+			if b.keyword == "else" {
+				break
+			} else if b.keyword == "endif" {
+				return branch + 1, nil
+			}
+			cond, err = e.condition(b.arg)
+			if err != nil {
+				return 0, &ProgramError{Line: branch, Msg: err.Error()}
+			}
+		}
+		return branch + 1, nil
+
+	} else if o.keyword == "elseif" || o.keyword == "else" {
+		// we've run a branch, so skip to the endif
+		return e.oLines[o.match].match + 1, nil
+
+	} else if o.keyword == "endif" {
+		return pc + 1, nil
+
+	} else if o.keyword == "break" {
+		loop := e.oLines[o.match]
+		if loop.keyword == "repeat" && len(e.stack) > 0 {
+			e.stack = e.stack[:len(e.stack)-1]
+		}
+		return loop.match + 1, nil
+
+	} else if o.keyword == "continue" {
+		loop := e.oLines[o.match]
+		if loop.keyword == "while" {
+			return o.match, nil
+		}
+		// the endrepeat, or the while at the end of a do
+		return loop.match, nil
+	}
+
+	return 0, fmt.Errorf("unexpected O%s %s", o.label, o.keyword)
+}
+
+func isLocalParam(name string) bool {
+	if strings.HasPrefix(name, "<") {
+		return !strings.HasPrefix(name, "<_")
+	}
+	n, err := strconv.Atoi(name)
+	return err == nil && n >= 1 && n <= 30
+}
+
+// evaluate the "[...]" argument to an O-word
+func (e *expander) condition(arg string) (float64, error) {
+	arg = strings.TrimSpace(arg)
+	if !strings.HasPrefix(arg, "[") {
+		return 0, fmt.Errorf("expected [expression], got [%s]", arg)
+	}
+	val, _, err := e.evalBracket(arg, 0)
+	return val, err
+}
+
+// evaluate the arguments to a call, e.g. "[1] [#2+3]"
+func (e *expander) callArgs(arg string) ([]float64, error) {
+	args := make([]float64, 0)
+	i := skipSpaces(arg, 0)
+	for i < len(arg) {
+		if arg[i] == '(' || arg[i] == ';' {
+			break
+		}
+		if arg[i] != '[' {
+			return nil, fmt.Errorf("expected [argument], got [%s]", arg[i:])
+		}
+		val, next, err := e.evalBracket(arg, i)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, val)
+		i = skipSpaces(arg, next)
+	}
+	if len(args) > 30 {
+		return nil, fmt.Errorf("too many arguments")
+	}
+	return args, nil
+}
+
+// substitute parameters and expressions in a line, and apply any parameter
+// assignments; returns "" if nothing is left to send
+func (e *expander) expandLine(line string) (string, error) {
+	var b strings.Builder
+	type assignment struct {
+		name string
+		val  float64
+	}
+	assignments := make([]assignment, 0)
+
+	i := 0
+	for i < len(line) {
+		c := line[i]
+		if c == '(' {
+			j := strings.IndexByte(line[i:], ')')
+			if j < 0 {
+				j = len(line) - i - 1
+			}
+			b.WriteString(line[i : i+j+1])
+			i += j + 1
+		} else if c == ';' {
+			b.WriteString(line[i:])
+			break
+		} else if (c == '-' || c == '+') && startsExpression(line, skipSpaces(line, i+1)) {
+			// fold the sign into the value, so that X-#1 with #1=-5 is X5
+			// rather than X--5
+			val, next, err := e.value(line, skipSpaces(line, i+1))
+			if err != nil {
+				return "", err
+			}
+			if c == '-' {
+				val = -val
+			}
+			b.WriteString(formatNumber(val))
+			i = next
+		} else if c == '#' {
+			name, next, err := e.paramName(line, i)
+			if err != nil {
+				return "", err
+			}
+			k := skipSpaces(line, next)
+			if k < len(line) && line[k] == '=' {
+				// parameters take their new values after the whole line is read
+				val, next, err := e.value(line, skipSpaces(line, k+1))
+				if err != nil {
+					return "", err
+				}
+				assignments = append(assignments, assignment{name, val})
+				i = next
+				continue
+			}
+			val, err := e.param(name)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(formatNumber(val))
+			i = next
+		} else if c == '[' {
+			val, next, err := e.evalBracket(line, i)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(formatNumber(val))
+			i = next
+		} else if isLetter(c) {
+			j := i
+			for j < len(line) && isLetter(line[j]) {
+				j++
+			}
+			if startsExpression(line, i) {
+				val, next, err := e.function(strings.ToUpper(line[i:j]), line, j)
+				if err != nil {
+					return "", err
+				}
+				b.WriteString(formatNumber(val))
+				i = next
+			} else {
+				b.WriteString(line[i:j])
+				i = j
+			}
+		} else {
+			b.WriteByte(c)
+			i++
+		}
+	}
+
+	for _, a := range assignments {
+		e.params[a.name] = a.val
+	}
+
+	out := strings.TrimSpace(b.String())
+	if out == "" && len(assignments) > 0 {
+		return "", nil
+	}
+	return out, nil
+}
+
+// true if line[i] starts a parameter, [expression] or function, whose value
+// is substituted into the line
+func startsExpression(line string, i int) bool {
+	if i >= len(line) {
+		return false
+	}
+	if line[i] == '#' || line[i] == '[' {
+		return true
+	}
+	j := i
+	for j < len(line) && isLetter(line[j]) {
+		j++
+	}
+	k := skipSpaces(line, j)
+	return j > i && isEvalFunction(strings.ToUpper(line[i:j]), exprFunctions) && k < len(line) && line[k] == '['
+}
+
+// parse a parameter reference starting at line[i] == '#', and return its
+// canonical name ("5" or "<name>") and the index after it
+func (e *expander) paramName(line string, i int) (string, int, error) {
+	i++
+	if i >= len(line) {
+		return "", i, fmt.Errorf("# at end of line")
+	}
+	c := line[i]
+	if c == '<' {
+		j := strings.IndexByte(line[i:], '>')
+		if j < 0 {
+			return "", i, fmt.Errorf("unterminated parameter name")
+		}
+		// LinuxCNC ignores case and spaces in parameter names
+		name := strings.ToLower(strings.ReplaceAll(line[i:i+j+1], " ", ""))
+		return name, i + j + 1, nil
+	}
+	if c == '#' || c == '[' {
+		var val float64
+		var next int
+		var err error
+		if c == '#' {
+			var name string
+			name, next, err = e.paramName(line, i)
+			if err == nil {
+				val, err = e.param(name)
+			}
+		} else {
+			val, next, err = e.evalBracket(line, i)
+		}
+		if err != nil {
+			return "", next, err
+		}
+		return strconv.Itoa(int(math.Round(val))), next, nil
+	}
+	j := i
+	for j < len(line) && line[j] >= '0' && line[j] <= '9' {
+		j++
+	}
+	if j == i {
+		return "", i, fmt.Errorf("bad parameter reference")
+	}
+	n, _ := strconv.Atoi(line[i:j])
+	return strconv.Itoa(n), j, nil
+}
+
+func (e *expander) param(name string) (float64, error) {
+	val, ok := e.params[name]
+	if !ok && strings.HasPrefix(name, "<") {
+		return 0, fmt.Errorf("unknown parameter #%s", name)
+	}
+	// numbered parameters start out as 0
+	return val, nil
+}
+
+// parse a single value (number, parameter, [expression] or function) starting at line[i]
+func (e *expander) value(line string, i int) (float64, int, error) {
+	if i >= len(line) {
+		return 0, i, fmt.Errorf("missing value")
+	}
+	c := line[i]
+	if c == '[' {
+		return e.evalBracket(line, i)
+	} else if c == '#' {
+		name, next, err := e.paramName(line, i)
+		if err != nil {
+			return 0, next, err
+		}
+		val, err := e.param(name)
+		return val, next, err
+	} else if isLetter(c) {
+		j := i
+		for j < len(line) && isLetter(line[j]) {
+			j++
+		}
+		name := strings.ToUpper(line[i:j])
+		if !isEvalFunction(name, exprFunctions) {
+			return 0, i, fmt.Errorf("unknown function %s", name)
+		}
+		return e.function(name, line, j)
+	}
+	j := i
+	if c == '-' || c == '+' {
+		j++
+	}
+	for j < len(line) && (line[j] == '.' || (line[j] >= '0' && line[j] <= '9')) {
+		j++
+	}
+	val, err := strconv.ParseFloat(line[i:j], 64)
+	if err != nil {
+		return 0, j, fmt.Errorf("bad number [%s]", line[i:j])
+	}
+	return val, j, nil
+}
+
+// evaluate the bracketed expression starting at s[i] == '[', and return the
+// value and the index after the closing ']'
+func (e *expander) evalBracket(s string, i int) (float64, int, error) {
+	depth := 0
+	for j := i; j < len(s); j++ {
+		if s[j] == '[' {
+			depth++
+		} else if s[j] == ']' {
+			depth--
+			if depth == 0 {
+				val, err := e.evalExpr(s[i+1 : j])
+				return val, j + 1, err
+			}
+		}
+	}
+	return 0, len(s), fmt.Errorf("unbalanced [brackets]")
+}
+
+// the binary operators in expressions, and their precedence
+var exprOperators = map[string]int{
+	"**":  5,
+	"*":   4,
+	"/":   4,
+	"MOD": 4,
+	"+":   3,
+	"-":   3,
+	"EQ":  2,
+	"NE":  2,
+	"GT":  2,
+	"GE":  2,
+	"LT":  2,
+	"LE":  2,
+	"AND": 1,
+	"OR":  1,
+	"XOR": 1,
+}
+
+// evaluate the inside of a bracketed expression: parameters, nested
+// brackets and functions are replaced by their values, and the values and
+// operators between them are combined in order of precedence
+func (e *expander) evalExpr(expr string) (float64, error) {
+	vals := make([]float64, 0)
+	ops := make([]string, 0)
+	sign := 1.0 // unary minus before the next value
+
+	addValue := func(val float64) error {
+		if len(vals) > len(ops) {
+			return fmt.Errorf("missing operator in [%s]", expr)
+		}
+		vals = append(vals, sign*val)
+		sign = 1
+		return nil
+	}
+	addOp := func(op string) error {
+		if len(vals) == len(ops) {
+			return fmt.Errorf("missing value before %s in [%s]", op, expr)
+		}
+		ops = append(ops, op)
+		return nil
+	}
+
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		var val float64
+		var next int
+		var err error
+		if c == ' ' || c == '\t' {
+			i++
+			continue
+		} else if c == '[' {
+			val, next, err = e.evalBracket(expr, i)
+		} else if c == '#' {
+			var name string
+			name, next, err = e.paramName(expr, i)
+			if err == nil {
+				val, err = e.param(name)
+			}
+		} else if c == '.' || (c >= '0' && c <= '9') {
+			next = i
+			for next < len(expr) && (expr[next] == '.' || (expr[next] >= '0' && expr[next] <= '9')) {
+				next++
+			}
+			val, err = strconv.ParseFloat(expr[i:next], 64)
+			if err != nil {
+				return 0, fmt.Errorf("bad number [%s]", expr[i:next])
+			}
+		} else if isLetter(c) {
+			j := i
+			for j < len(expr) && isLetter(expr[j]) {
+				j++
+			}
+			name := strings.ToUpper(expr[i:j])
+			if _, ok := exprOperators[name]; ok {
+				if err := addOp(name); err != nil {
+					return 0, err
+				}
+				i = j
+				continue
+			} else if isEvalFunction(name, exprFunctions) {
+				val, next, err = e.function(name, expr, j)
+			} else {
+				return 0, fmt.Errorf("unknown word %s in [%s]", name, expr)
+			}
+		} else if strings.IndexByte("+-*/", c) >= 0 {
+			op := string(c)
+			if strings.HasPrefix(expr[i:], "**") {
+				op = "**"
+			}
+			i += len(op)
+			if len(vals) == len(ops) && (op == "-" || op == "+") {
+				// a sign rather than an operator
+				if op == "-" {
+					sign = -sign
+				}
+				continue
+			}
+			if err := addOp(op); err != nil {
+				return 0, err
+			}
+			continue
+		} else {
+			return 0, fmt.Errorf("unexpected '%c' in [%s]", c, expr)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := addValue(val); err != nil {
+			return 0, err
+		}
+		i = next
+	}
+	if len(vals) == 0 || len(vals) == len(ops) {
+		return 0, fmt.Errorf("missing value in [%s]", expr)
+	}
+
+	// operators of equal precedence are applied left to right, except **
+	stack := []float64{vals[0]}
+	opStack := make([]string, 0)
+	reduce := func() error {
+		op := opStack[len(opStack)-1]
+		a, b := stack[len(stack)-2], stack[len(stack)-1]
+		val, err := applyOperator(op, a, b)
+		if err != nil {
+			return fmt.Errorf("%v in [%s]", err, expr)
+		}
+		opStack = opStack[:len(opStack)-1]
+		stack = append(stack[:len(stack)-2], val)
+		return nil
+	}
+	for k, op := range ops {
+		for len(opStack) > 0 && exprOperators[opStack[len(opStack)-1]] >= exprOperators[op] && op != "**" {
+			if err := reduce(); err != nil {
+				return 0, err
+			}
+		}
+		opStack = append(opStack, op)
+		stack = append(stack, vals[k+1])
+	}
+	for len(opStack) > 0 {
+		if err := reduce(); err != nil {
+			return 0, err
+		}
+	}
+	return stack[0], nil
+}
+
+func applyOperator(op string, a, b float64) (float64, error) {
+	truth := func(r bool) float64 {
+		if r {
+			return 1
+		}
+		return 0
+	}
+	if op == "**" {
+		return math.Pow(a, b), nil
+	} else if op == "*" {
+		return a * b, nil
+	} else if op == "/" {
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return a / b, nil
+	} else if op == "MOD" {
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		// like LinuxCNC, the result is never negative
+		r := math.Mod(a, b)
+		if r < 0 {
+			r += math.Abs(b)
+		}
+		return r, nil
+	} else if op == "+" {
+		return a + b, nil
+	} else if op == "-" {
+		return a - b, nil
+	} else if op == "EQ" {
+		return truth(a == b), nil
+	} else if op == "NE" {
+		return truth(a != b), nil
+	} else if op == "GT" {
+		return truth(a > b), nil
+	} else if op == "GE" {
+		return truth(a >= b), nil
+	} else if op == "LT" {
+		return truth(a < b), nil
+	} else if op == "LE" {
+		return truth(a <= b), nil
+	} else if op == "AND" {
+		return truth(a != 0 && b != 0), nil
+	} else if op == "OR" {
+		return truth(a != 0 || b != 0), nil
+	} else if op == "XOR" {
+		return truth((a != 0) != (b != 0)), nil
+	}
+	return 0, fmt.Errorf("unknown operator %s", op)
+}
+
+// evaluate the function whose name ends at s[i], with its [argument] following
+func (e *expander) function(name string, s string, i int) (float64, int, error) {
+	i = skipSpaces(s, i)
+	if i >= len(s) || s[i] != '[' {
+		return 0, i, fmt.Errorf("%s needs an [argument]", name)
+	}
+
+	if name == "EXISTS" {
+		j := strings.IndexByte(s[i:], ']')
+		if j < 0 {
+			return 0, len(s), fmt.Errorf("unbalanced [brackets]")
+		}
+		pname, _, err := e.paramName(strings.TrimSpace(s[i+1:i+j]), 0)
+		if err != nil {
+			return 0, i + j + 1, err
+		}
+		_, ok := e.params[pname]
+		if ok {
+			return 1, i + j + 1, nil
+		}
+		return 0, i + j + 1, nil
+	}
+
+	arg, next, err := e.evalBracket(s, i)
+	if err != nil {
+		return 0, next, err
+	}
+
+	rad := math.Pi / 180
+	if name == "ATAN" {
+		// ATAN[y]/[x]
+		j := skipSpaces(s, next)
+		if j >= len(s) || s[j] != '/' {
+			return 0, j, fmt.Errorf("ATAN needs two arguments, like ATAN[y]/[x]")
+		}
+		x, next, err := e.evalBracket(s, skipSpaces(s, j+1))
+		if err != nil {
+			return 0, next, err
+		}
+		return math.Atan2(arg, x) / rad, next, nil
+	}
+
+	var val float64
+	if name == "SIN" {
+		val = math.Sin(arg * rad)
+	} else if name == "COS" {
+		val = math.Cos(arg * rad)
+	} else if name == "TAN" {
+		val = math.Tan(arg * rad)
+	} else if name == "ASIN" {
+		val = math.Asin(arg) / rad
+	} else if name == "ACOS" {
+		val = math.Acos(arg) / rad
+	} else if name == "SQRT" {
+		val = math.Sqrt(arg)
+	} else if name == "ABS" {
+		val = math.Abs(arg)
+	} else if name == "ROUND" {
+		val = math.Round(arg)
+	} else if name == "FIX" {
+		val = math.Floor(arg)
+	} else if name == "FUP" {
+		val = math.Ceil(arg)
+	} else if name == "EXP" {
+		val = math.Exp(arg)
+	} else if name == "LN" {
+		val = math.Log(arg)
+	}
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return 0, next, fmt.Errorf("%s[%g] is out of range", name, arg)
+	}
+	return val, next, nil
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func skipSpaces(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// format a number for a G-code word
+func formatNumber(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 4, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" {
+		s = "0"
+	}
+	return s
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// expand src and return the lines Grbl would be sent
+func expandTest(t *testing.T, src string) ([]string, error) {
+	t.Helper()
+	p, err := LoadProgram(strings.NewReader(src), nil)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, 0, p.Len())
+	p.Each(func(i int, line string) bool {
+		lines = append(lines, line)
+		return true
+	})
+	return lines, nil
+}
+
+func TestExpandProgram(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string // expanded lines, separated by "|"
+	}{
+		// signs
+		{"negative parameter", "#1=-5\nG1 X-#1 Y+#1 Z#1", "G1 X5 Y-5 Z-5"},
+		{"negative expression", "#1=2\nG1 X-[#1*3] Y-[-#1]", "G1 X-6 Y2"},
+		{"negative function", "G1 X-ABS[-2] Y-SQRT[9]", "G1 X-2 Y-3"},
+		{"unary minus", "G1 X[-2+5] Y[3*-2] Z[--1]", "G1 X3 Y-6 Z1"},
+
+		// precedence
+		{"mod", "G1 X[2*7 MOD 4] Y[7 MOD 4*2] Z[1+7 MOD 4]", "G1 X2 Y6 Z4"},
+		{"mod of negative", "G1 X[-1 MOD 4]", "G1 X3"},
+		{"power", "G1 X[2*3**2] Y[2**3**2]", "G1 X18 Y512"},
+		{"comparison", "G1 X[1+1 EQ 2] Y[2*3 GT 5] Z[1 LT 2 EQ 1]", "G1 X1 Y1 Z1"},
+		{"logic", "G1 X[1 GT 2 OR 2 GT 1] Y[1 AND 0 OR 1] Z[1 XOR 1]", "G1 X1 Y1 Z0"},
+		{"brackets", "G1 X[[1+2]*3] Y[2*[7 MOD 4]]", "G1 X9 Y6"},
+
+		// O-words
+		{"sub and call", "O100 sub\nG1 X#1 Y#2\nO100 endsub\nO100 call [1] [2+3]\nO100 call [4] [5]", "G1 X1 Y5|G1 X4 Y5"},
+		{"return", "O100 sub\nG1 X1\nO101 if [#1 GT 0]\nO100 return\nO101 endif\nG1 X2\nO100 endsub\nO100 call [1]\nO100 call [0]", "G1 X1|G1 X1|G1 X2"},
+		{"while", "#1=0\nO100 while [#1 LT 3]\nG1 X#1\n#1=[#1+1]\nO100 endwhile", "G1 X0|G1 X1|G1 X2"},
+		{"do while", "#1=5\nO100 do\nG1 X#1\n#1=[#1+1]\nO100 while [#1 LT 3]", "G1 X5"},
+		{"break and continue", "#1=0\nO100 while [1]\n#1=[#1+1]\nO101 if [#1 EQ 2]\nO100 continue\nO101 endif\nO102 if [#1 GT 3]\nO100 break\nO102 endif\nG1 X#1\nO100 endwhile", "G1 X1|G1 X3"},
+		{"if elseif else", "O100 sub\nO101 if [#1 EQ 1]\nG1 X1\nO101 elseif [#1 EQ 2]\nG1 X2\nO101 else\nG1 X3\nO101 endif\nO100 endsub\nO100 call [1]\nO100 call [2]\nO100 call [7]", "G1 X1|G1 X2|G1 X3"},
+		{"repeat", "O100 repeat [2]\nG1 X1\nO100 endrepeat", "G1 X1|G1 X1"},
+
+		// parameters
+		{"assignment after the line", "#1=1\n#1=2 G1 X#1", "G1 X1"},
+		{"named", "#<depth>=2\nG1 Z-#<De Pth>", "G1 Z-2"},
+		{"local scope", "#1=9 #31=9 #<x>=9 #<_x>=9\nO100 sub\n#1=1 #31=1 #<x>=1 #<_x>=1\nO100 endsub\nO100 call\nG1 X#1 Y#31 Z#<_x>\nG1 X#<x>", "G1 X9 Y1 Z1|G1 X9"},
+		{"arguments are local", "#2=7\nO100 sub\nG1 X#1 Y#2\nO100 endsub\nO100 call [1]\nG1 X#1 Y#2", "G1 X1 Y0|G1 X0 Y7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines, err := expandTest(t, tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := strings.Join(lines, "|")
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandProgramErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string // in the error
+	}{
+		{"missing value", "G1 X[1+]", "missing value"},
+		{"missing operator", "G1 X[1 2]", "missing operator"},
+		{"division by zero", "G1 X[1/0]", "division by zero"},
+		{"mod by zero", "G1 X[1 MOD 0]", "division by zero"},
+		{"unknown named parameter", "G1 X#<nope>", "unknown parameter"},
+		{"return outside sub", "O100 return", "outside a sub"},
+		{"unclosed while", "O100 while [1]\nG1 X1", "never closed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := expandTest(t, tt.src)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"io"
 	"os"
-
-	"github.com/256dpi/gcode"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -17,68 +17,246 @@ const (
 	CmdDrain
 	CmdSingle
 	CmdOptionalStop
+	CmdSkip
+	CmdRetry
+	CmdAbort
+	CmdErrorPolicy
+	CmdDefaultErrorPolicy
+	CmdLoad
+	CmdStatus
+	CmdCancelStart
+)
+
+// a message to the runner goroutine; all changes to the runner's state go
+// through these, see GCodeRunner.Run()
+type RunnerCmd struct {
+	Kind int
+
+	Force    bool        // for CmdStart: start even if the program exceeds the machine's travel
+	Program  *Program    // for CmdLoad
+	NextLine int         // for CmdLoad
+	Preamble []string    // for CmdLoad
+	Reply    chan error  // for CmdLoad: receives nil once the program is loaded, or why it wasn't
+	Policy   ErrorPolicy // for CmdDefaultErrorPolicy
+	Status   GrblStatus  // for CmdStatus
+}
+
+// what to do when Grbl responds to a line of the program with anything other than "ok"
+type ErrorPolicy int
+
+const (
+	ErrorStop     ErrorPolicy = iota // stop sending and feed hold
+	ErrorAsk                         // feed hold and ask the user whether to skip, retry, or abort
+	ErrorContinue                    // log the error and carry on
 )
 
-type RunnerCmd int
+func (p ErrorPolicy) String() string {
+	if p == ErrorStop {
+		return "stop"
+	} else if p == ErrorAsk {
+		return "ask"
+	} else if p == ErrorContinue {
+		return "continue"
+	} else {
+		return "???"
+	}
+}
+
+func ParseErrorPolicy(s string) (ErrorPolicy, bool) {
+	for _, p := range []ErrorPolicy{ErrorStop, ErrorAsk, ErrorContinue} {
+		if strings.EqualFold(s, p.String()) {
+			return p, true
+		}
+	}
+	return ErrorStop, false
+}
+
+// an error response to a line of the program, and what we decided to do about it
+type RunnerError struct {
+	Time     time.Time
+	Line     int // index into the program, or -1 if unknown
+	Command  string
+	Response string
+	Policy   ErrorPolicy
+	Decision string
+}
+
+// a snapshot of the runner's state, for use outside the runner goroutine
+type RunnerState struct {
+	Program            *Program
+	NextLine           int
+	LastAcked          int // index of the last line that Grbl accepted, or -1
+	Running            bool
+	Stopping           bool
+	OptionalStop       bool
+	ErrorPolicy        ErrorPolicy
+	DefaultErrorPolicy ErrorPolicy
+	ErrorPrompt        *RunnerError // never modified once published
+	BoundsWarning      []string     // why the program can't start, see CheckBounds(); never modified once published
+}
+
+// true if the whole program has been sent
+func (s RunnerState) Finished() bool {
+	return !s.Running && s.NextLine >= s.Program.Len()
+}
 
+// everything except "app" and "state" is owned by the runner goroutine
 type GCodeRunner struct {
-	app      *App
-	gcode    []string
+	app *App
+
+	program  *Program
 	nextLine int
+	gs       GrblStatus // latest status, received via CmdStatus
 
 	running      bool
 	stopping     bool
 	optionalStop bool
+
+	defaultErrorPolicy ErrorPolicy // applied to each newly-loaded program
+	errorPolicy        ErrorPolicy
+	errorPrompt        *RunnerError // error waiting for the user to decide, if any
+	errorLog           []RunnerError
+	boundsWarning      []string
+
+	preamble     []string // lines to send before carrying on from nextLine, e.g. to resume a job
+	lastAcked    int      // index of the last line that Grbl accepted, or -1
+	checkpointed int      // value of lastAcked when the checkpoint was last written
+
+	mu    sync.Mutex
+	state RunnerState
 }
 
-func NewGCodeRunner(app *App) *GCodeRunner {
-	return &GCodeRunner{app: app}
+// a line that has been sent to Grbl and is awaiting a response
+type sentLine struct {
+	num     int // index into the program, or -1 if not from the program
+	command string
 }
 
-func (r *GCodeRunner) Load(reader io.Reader) {
-	gcode := make([]string, 0)
+func NewGCodeRunner(app *App) *GCodeRunner {
+	return &GCodeRunner{app: app, gs: DefaultGrblStatus()}
+}
 
-	scanner := bufio.NewScanner(reader)
+// return a snapshot of the runner's state
+func (r *GCodeRunner) State() RunnerState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		gcode = append(gcode, line)
+// publish the runner's current state for State() to return
+func (r *GCodeRunner) publish() {
+	r.mu.Lock()
+	r.state = RunnerState{
+		Program:            r.program,
+		NextLine:           r.nextLine,
+		LastAcked:          r.lastAcked,
+		Running:            r.running,
+		Stopping:           r.stopping,
+		OptionalStop:       r.optionalStop,
+		ErrorPolicy:        r.errorPolicy,
+		DefaultErrorPolicy: r.defaultErrorPolicy,
+		ErrorPrompt:        r.errorPrompt,
+		BoundsWarning:      r.boundsWarning,
 	}
+	r.mu.Unlock()
+	r.app.w.Invalidate()
+}
 
-	r.gcode = gcode
-	r.nextLine = 0
+// ask the runner goroutine to switch to the given program; this blocks until
+// the runner has loaded it, or refused to because a program is running, so
+// don't call it from the runner goroutine
+func (r *GCodeRunner) Load(p *Program) error {
+	return r.LoadFrom(p, 0, nil)
+}
 
-	r.app.tp.path.SetGCode(r.Path())
+// like Load(), but carry on from line nextLine after sending the preamble
+func (r *GCodeRunner) LoadFrom(p *Program, nextLine int, preamble []string) error {
+	reply := make(chan error, 1)
+	r.app.gcodeRunnerChan <- RunnerCmd{Kind: CmdLoad, Program: p, NextLine: nextLine, Preamble: preamble, Reply: reply}
+	return <-reply
+}
+
+func (r *GCodeRunner) load(p *Program) {
+	r.program = p
+	r.nextLine = 0
+	r.running = false
+	r.errorPolicy = r.defaultErrorPolicy
+	r.errorPrompt = nil
+	r.preamble = nil
+	r.lastAcked = -1
+	r.checkpointed = -1
+	r.boundsWarning = nil
+	r.app.lint.Start(p)
+	r.app.job.Start(p, r.gs.RapidRates())
+	go r.app.queue.ProgramLoaded(p)
 }
 
 func (r *GCodeRunner) Run(ch chan RunnerCmd) {
 	r.running = false
 	r.optionalStop = true
+	r.lastAcked = -1
+	r.checkpointed = -1
+	r.publish()
 
 	waiting := 0
+	sentLines := make([]sentLine, 0) // lines awaiting a response, in order
 
 	respChan := make(chan string)
 
+	checkpointTicker := time.NewTicker(2 * time.Second)
+
 	for {
 		sendLine := false
 
 		select {
 		case cmd := <-ch:
-			switch cmd {
+			switch cmd.Kind {
 			case CmdStart:
 				// start running gcode
-				r.running = true
-				if r.nextLine > len(r.gcode) {
+				if m := r.app.runningMacro.Load(); m != nil {
+					// the macro is driving Grbl itself
+					fmt.Fprintf(os.Stderr, "can't start the program while macro %s is running\n", m.Name)
+					break
+				}
+				if r.program != nil && r.program.ExpandErr != nil {
+					fmt.Fprintf(os.Stderr, "can't start the program: %v\n", r.program.ExpandErr)
+					break
+				}
+				if r.errorPrompt != nil {
+					r.ResolveError("skip")
+				}
+				if r.nextLine > r.program.Len() {
 					// reset to start if run was previously completed
 					r.nextLine = 0
 				}
+				if !r.running && r.nextLine == 0 && !cmd.Force {
+					// check the program fits in the machine before starting from the top
+					if warnings := r.CheckBounds(); len(warnings) > 0 {
+						r.boundsWarning = warnings
+						break
+					}
+				}
+				r.boundsWarning = nil
+				if !r.running && r.nextLine == 0 {
+					// forget the progress of any earlier run
+					r.lastAcked = -1
+				}
+				r.running = true
 				r.CycleStart()
 
+			case CmdCancelStart:
+				// the user decided not to run a program that exceeds the machine's travel
+				r.boundsWarning = nil
+
 			case CmdStop:
 				// send a feed hold now, and a soft-reset once the status is "Hold:0"
+				if r.errorPrompt != nil {
+					r.ResolveError("abort")
+				}
 				r.running = false
 				r.stopping = true
 				r.FeedHold()
+				go r.app.queue.JobStopped(r.program)
 
 			case CmdPause:
 				// feed hold
@@ -99,28 +277,118 @@ func (r *GCodeRunner) Run(ch chan RunnerCmd) {
 			case CmdOptionalStop:
 				// toggle optional stopping
 				r.optionalStop = !r.optionalStop
+
+			case CmdSkip:
+				// carry on from the line after the one that failed
+				if r.errorPrompt != nil {
+					r.ResolveError("skip")
+					r.running = true
+					r.CycleStart()
+				}
+
+			case CmdRetry:
+				// resend the line that failed
+				if r.errorPrompt != nil {
+					if r.errorPrompt.Line >= 0 {
+						r.nextLine = r.errorPrompt.Line
+					} else {
+						r.preamble = append([]string{r.errorPrompt.Command}, r.preamble...)
+					}
+					r.ResolveError("retry")
+					r.running = true
+					r.CycleStart()
+				}
+
+			case CmdAbort:
+				// give up on the program, same as CmdStop
+				if r.errorPrompt != nil {
+					r.ResolveError("abort")
+					r.running = false
+					r.stopping = true
+					r.FeedHold()
+					go r.app.queue.JobStopped(r.program)
+				}
+
+			case CmdErrorPolicy:
+				// cycle through error policies for the current program
+				r.errorPolicy = (r.errorPolicy + 1) % 3
+
+			case CmdDefaultErrorPolicy:
+				// set the policy for this and future programs
+				r.defaultErrorPolicy = cmd.Policy
+				r.errorPolicy = cmd.Policy
+
+			case CmdLoad:
+				// switch to a new program, optionally starting part-way through
+				var err error
+				if r.running || r.stopping {
+					err = fmt.Errorf("can't load %s while a program is running", cmd.Program.Name)
+				} else {
+					r.load(cmd.Program)
+					r.nextLine = cmd.NextLine
+					r.preamble = cmd.Preamble
+				}
+				if cmd.Reply != nil {
+					cmd.Reply <- err
+				} else if err != nil {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+				}
+
+			case CmdStatus:
+				// new status from Grbl
+				r.gs = cmd.Status
 			}
 
 		case resp := <-respChan:
-			if resp != "ok" {
-				r.running = false
-				r.FeedHold()
-			}
 			waiting--
+			sent := sentLine{num: -1}
+			if len(sentLines) > 0 {
+				sent = sentLines[0]
+				sentLines = sentLines[1:]
+			}
+			if resp == "ok" {
+				if sent.num >= 0 {
+					r.lastAcked = sent.num
+				}
+			} else if resp != "fail:aborted" {
+				// "fail:aborted" means we soft-reset on purpose, so it's not worth reporting
+				r.HandleError(sent.num, sent.command, resp)
+			}
+
+		case <-checkpointTicker.C:
+			// write a checkpoint if Grbl has accepted any lines since the last one
+			if r.lastAcked != r.checkpointed && r.nextLine < r.program.Len() {
+				r.WriteCheckpoint()
+				r.checkpointed = r.lastAcked
+			}
 		}
 
-		if r.stopping && r.app.gs.Status == "Hold:0" {
+		if r.stopping && r.gs.Status == "Hold:0" {
 			// XXX: call r.SoftReset() twice, because sometimes the first one doesn't work (???)
 			r.SoftReset()
 			r.SoftReset()
 			r.stopping = false
 			r.running = false
 			r.nextLine = 0
+			r.preamble = nil
+			RemoveCheckpoint()
 		}
 
 		if sendLine || (r.running && waiting == 0) {
-			if r.nextLine < len(r.gcode) {
-				line := r.gcode[r.nextLine]
+			if len(r.preamble) > 0 {
+				line := r.preamble[0]
+				r.preamble = r.preamble[1:]
+
+				fmt.Printf("> [%s]\n", line)
+				if r.app.g.Command(line, respChan) {
+					waiting++
+					sentLines = append(sentLines, sentLine{num: -1, command: line})
+				}
+				if changesOffsets(line) {
+					r.app.g.RequestOffsets()
+				}
+			} else if r.nextLine < r.program.Len() {
+				line := r.program.Line(r.nextLine)
 				r.nextLine += 1
 
 				if r.optionalStop && line == "M1" {
@@ -131,19 +399,84 @@ func (r *GCodeRunner) Run(ch chan RunnerCmd) {
 				fmt.Printf("> [%s]\n", line)
 				if r.app.g.Command(line, respChan) {
 					waiting++
+					sentLines = append(sentLines, sentLine{num: r.nextLine - 1, command: line})
+				}
+				if changesOffsets(line) {
+					// keep the offsets current for the checkpoint
+					r.app.g.RequestOffsets()
 				}
 
 				r.app.g.RequestGCodes()
 			} else {
 				// program is complete
 				r.running = false
+				RemoveCheckpoint()
 
-				if r.app.mode == ModeRun {
-					r.app.PopMode()
-				}
+				// start the next job, if there is a queue
+				go r.app.queue.JobComplete(r.program)
 			}
 		}
+
+		r.publish()
+	}
+}
+
+// apply the error policy to an error response from Grbl
+func (r *GCodeRunner) HandleError(lineNum int, command string, resp string) {
+	e := RunnerError{
+		Time:     time.Now(),
+		Line:     lineNum,
+		Command:  command,
+		Response: resp,
+		Policy:   r.errorPolicy,
+	}
+
+	if r.errorPolicy == ErrorContinue {
+		e.Decision = "continue"
+		r.RecordError(e)
+		return
+	}
+
+	r.running = false
+	r.FeedHold()
+
+	if r.errorPolicy == ErrorAsk && r.errorPrompt == nil {
+		// wait for CmdSkip, CmdRetry, or CmdAbort; the UI enters ModeError
+		// when it sees the prompt
+		r.errorPrompt = &e
+	} else {
+		e.Decision = "stop"
+		r.RecordError(e)
+	}
+}
+
+// record the user's decision about the pending error prompt, and dismiss it
+func (r *GCodeRunner) ResolveError(decision string) {
+	e := *r.errorPrompt
+	e.Decision = decision
+	r.RecordError(e)
+	r.errorPrompt = nil
+}
+
+// add the error to the log, and append it to errors.log in the config directory
+func (r *GCodeRunner) RecordError(e RunnerError) {
+	r.errorLog = append(r.errorLog, e)
+
+	name := "<none>"
+	if r.program != nil {
+		name = r.program.Name
+	}
+	logLine := fmt.Sprintf("%s %s line %d [%s]: %s: policy=%s decision=%s", e.Time.Format(time.RFC3339), name, e.Line+1, e.Command, e.Response, e.Policy, e.Decision)
+	fmt.Println(logLine)
+
+	filename := filepath.Join(ConfDir(), "errors.log")
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "write %s: %v\n", filename, err)
+		return
 	}
+	defer f.Close()
+	fmt.Fprintln(f, logLine)
 }
 
 func (r *GCodeRunner) CycleStart() {
@@ -158,36 +491,3 @@ func (r *GCodeRunner) SoftReset() {
 func (r *GCodeRunner) FeedHold() {
 	r.app.g.CommandRealtime('!')
 }
-
-func (r *GCodeRunner) Path() []V4d {
-	pos := V4d{}
-
-	path := make([]V4d, 0)
-
-	for _, str := range r.gcode {
-		line, err := gcode.ParseLine(str)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error parsing gcode line: [%s]: %s, ignoring\n", str, err)
-			continue
-		}
-		G := -1
-		for _, gc := range line.Codes {
-			if gc.Letter == "G" {
-				G = int(gc.Value)
-			} else if gc.Letter == "X" {
-				pos.X = gc.Value
-			} else if gc.Letter == "Y" {
-				pos.Y = gc.Value
-			} else if gc.Letter == "Z" {
-				pos.Z = gc.Value
-			} else if gc.Letter == "A" {
-				pos.A = gc.Value
-			}
-		}
-		if G == 0 || G == 1 || G == 2 || G == 3 {
-			path = append(path, pos)
-		}
-	}
-
-	return path
-}
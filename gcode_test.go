@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gioui.org/io/event"
+)
+
+// a window that never has any events, and ignores Invalidate()
+type stubWindow struct{}
+
+func (stubWindow) NextEvent() event.Event { select {} }
+func (stubWindow) Invalidate()            {}
+
+// make an App with just enough in it for the gcode runner and job queue,
+// talking to a GrblSim
+func newRunnerTestApp(t *testing.T) *App {
+	// keep the queue and checkpoint files out of the real config directory
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	a := &App{
+		w:               stubWindow{},
+		gcodeRunnerChan: make(chan RunnerCmd),
+	}
+	a.gcode = NewGCodeRunner(a)
+	a.queue = NewJobQueue(a)
+	a.lint = NewLintPanel(a)
+	a.job = NewJobPanel(a)
+	a.SetLatestStatus(DefaultGrblStatus())
+
+	sim := NewGrblSim()
+	go sim.Run()
+	a.g = NewGrbl(sim, "sim")
+	ch := make(chan GrblStatus)
+	go a.g.Monitor(ch)
+	go a.gcode.Run(a.gcodeRunnerChan)
+
+	// forward status updates the way Connect() does
+	go func() {
+		for gs := range ch {
+			a.SetLatestStatus(gs)
+			if gs.Closed {
+				return
+			}
+			a.gcodeRunnerChan <- RunnerCmd{Kind: CmdStatus, Status: gs}
+		}
+	}()
+	t.Cleanup(func() { a.g.Close() })
+
+	// wait for the first status report
+	deadline := time.Now().Add(5 * time.Second)
+	for !a.LatestStatus().Ready {
+		if time.Now().After(deadline) {
+			t.Fatal("no status from GrblSim")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return a
+}
+
+func testProgram(t *testing.T, name string, n int) *Program {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sb, "G1 X%d Y%d F1000\n", i%10, i%7)
+	}
+	p, err := LoadProgram(strings.NewReader(sb.String()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Name = name
+	return p
+}
+
+// load, start and stop from several goroutines at once; run with -race
+func TestRunnerConcurrentCommands(t *testing.T) {
+	a := newRunnerTestApp(t)
+	progs := []*Program{testProgram(t, "a", 50), testProgram(t, "b", 80)}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 3; w++ {
+		wg.Add(3)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				// Load is refused while a program is running, so the
+				// error is expected here
+				a.gcode.Load(progs[(w+i)%len(progs)])
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				a.gcodeRunnerChan <- RunnerCmd{Kind: CmdStart}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				a.gcodeRunnerChan <- RunnerCmd{Kind: CmdStop}
+				// read everything the UI would read while the runner works
+				rs := a.gcode.State()
+				_ = rs.Program.Len()
+				gs := a.LatestStatus()
+				_ = gs.RapidRates()
+				_, _ = gs.Envelope()
+				_ = a.g.Status().GrblConfig[12]
+				time.Sleep(2 * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// after a final stop the runner must settle
+	a.gcodeRunnerChan <- RunnerCmd{Kind: CmdStop}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rs := a.gcode.State()
+		if !rs.Running && !rs.Stopping {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("runner didn't stop: %+v", rs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := a.gcode.Load(progs[0]); err != nil {
+		t.Errorf("load after stop: %v", err)
+	}
+}
+
+// a macro drives Grbl itself, so the program mustn't start under it
+func TestRunnerRefusesStartDuringMacro(t *testing.T) {
+	a := newRunnerTestApp(t)
+	if err := a.gcode.Load(testProgram(t, "a", 50)); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Macro{Name: "test"}
+	a.runningMacro.Store(m)
+	a.gcodeRunnerChan <- RunnerCmd{Kind: CmdStart}
+	// the runner handles commands in order, so once this is answered the
+	// start has been seen
+	a.gcode.Load(testProgram(t, "b", 50))
+	if a.gcode.State().Running {
+		t.Fatal("program started while a macro was running")
+	}
+}
+
+// a program that isn't the queue's mustn't complete or replace a queued job
+// without the queue noticing
+func TestQueueIgnoresOtherPrograms(t *testing.T) {
+	a := newRunnerTestApp(t)
+	path := filepath.Join(t.TempDir(), "job.gcode")
+	if err := os.WriteFile(path, []byte("G0 X1 Y1\nG1 X2 F100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	first := &Job{Path: path, Pause: true}
+	second := &Job{Path: path}
+	a.queue.jobs = []*Job{first, second}
+	a.queue.Start()
+
+	a.queue.mu.Lock()
+	loaded := a.queue.current == first && a.queue.waiting
+	a.queue.mu.Unlock()
+	if !loaded {
+		t.Fatal("first job isn't loaded and waiting")
+	}
+
+	other := testProgram(t, "other", 5)
+	a.queue.JobComplete(other)
+	a.queue.mu.Lock()
+	status := first.Status
+	a.queue.mu.Unlock()
+	if status != JobRunning {
+		t.Fatalf("another program's completion changed the job to %v", status)
+	}
+
+	if err := a.gcode.Load(other); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.queue.mu.Lock()
+		current, firstStatus, secondStatus := a.queue.current, first.Status, second.Status
+		a.queue.mu.Unlock()
+		if current == nil {
+			if firstStatus != JobPending || secondStatus != JobPending {
+				t.Errorf("after loading another program, jobs are %v and %v, want pending", firstStatus, secondStatus)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the queue still thinks its job is loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -8,28 +8,79 @@ import (
 
 var list *widget.List
 var scrolledTo int
+var highlightLine = -1 // line picked from the lint list, or -1
+var highlightProgram *Program
 
-func (a *App) LayoutGCode(gtx C) D {
+// clickables for the visible lines, indexed by line number modulo the size
+var lineBtns [256]widget.Clickable
+
+func gcodeList() *widget.List {
 	if list == nil {
 		var l widget.List
 		l.Axis = layout.Vertical
 		list = &l
 	}
+	return list
+}
+
+// scroll the G-code view to line i, and highlight it
+func (a *App) ScrollGCodeTo(i int) {
+	top := i - 5
+	if top < 0 {
+		top = 0
+	}
+	gcodeList().ScrollTo(top)
+	highlightLine = i
+	highlightProgram = a.rs.Program
+	a.w.Invalidate()
+}
+
+func (a *App) LayoutGCode(gtx C) D {
+	list := gcodeList()
 
 	// auto-scroll the view whenever a new line is sent
-	scrollTarget := a.gcode.nextLine - 15
+	scrollTarget := a.rs.NextLine - 15
 	if scrolledTo != scrollTarget {
 		list.ScrollTo(scrollTarget)
 		scrolledTo = scrollTarget
 	}
 
 	return Panel{Width: 1, CornerRadius: 5, Color: grey(128), BackgroundColor: grey(16), Margin: layout.UniformInset(5), Padding: layout.UniformInset(5)}.Layout(gtx, func(gtx C) D {
-		return material.List(a.th, list).Layout(gtx, len(a.gcode.gcode), func(gtx C, i int) D {
-			if i < a.gcode.nextLine {
-				return LayoutColour(gtx, grey(32), material.Body1(a.th, a.gcode.gcode[i]).Layout)
-			} else {
-				return material.Body1(a.th, a.gcode.gcode[i]).Layout(gtx)
+		prog := a.rs.Program
+		lint := a.lint.Result(prog)
+		hovered := -1
+		dims := material.List(a.th, list).Layout(gtx, prog.Len(), func(gtx C, i int) D {
+			btn := &lineBtns[i%len(lineBtns)]
+			for btn.Clicked(gtx) {
+				// select the line, to show its move in the toolpath view
+				highlightLine = i
+				highlightProgram = prog
+			}
+			if btn.Hovered() {
+				hovered = i
 			}
+			return material.Clickable(gtx, btn, func(gtx C) D {
+				return a.layoutGCodeLine(gtx, prog, lint, i)
+			})
 		})
+		// highlight the hovered line's moves in the toolpath view
+		a.tp.hoverLine = hovered
+		return dims
 	})
 }
+
+func (a *App) layoutGCodeLine(gtx C, prog *Program, lint *LintResult, i int) D {
+	label := material.Body1(a.th, prog.Line(i))
+	if lint != nil {
+		if isError, ok := lint.Lines[i]; ok {
+			label.Color = lintColour(isError)
+		}
+	}
+	if i == highlightLine && prog == highlightProgram {
+		return LayoutColour(gtx, rgb(64, 64, 0), label.Layout)
+	} else if i < a.rs.NextLine {
+		return LayoutColour(gtx, grey(32), label.Layout)
+	} else {
+		return label.Layout(gtx)
+	}
+}
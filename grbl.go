@@ -8,12 +8,18 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Grbl struct {
-	serialPort    io.ReadWriteCloser
-	status        GrblStatus
+	serialPort io.ReadWriteCloser
+
+	// status is written by Monitor() and by callers of Command(), so
+	// all access goes through mu; other goroutines take a copy with Status()
+	mu     sync.Mutex
+	status GrblStatus
+
 	writeChan     chan GrblResponse
 	responseQueue []GrblResponse
 }
@@ -40,6 +46,13 @@ func NewGrbl(port io.ReadWriteCloser, portName string) *Grbl {
 	return g
 }
 
+// return a copy of the current status, safe to call from any goroutine
+func (g *Grbl) Status() GrblStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.status
+}
+
 // add the given line to the command queue, sending the response
 // to the given channel, and return true,
 // or return false if the command was not sent
@@ -47,21 +60,25 @@ func NewGrbl(port io.ReadWriteCloser, portName string) *Grbl {
 // only use this function for commands that expect a response,
 // use CommandRealtime() for commands that give no response
 func (g *Grbl) Command(line string, respChan chan string) bool {
+	// canonicalise line ending
+	line = strings.TrimSpace(line) + "\n"
+
+	g.mu.Lock()
 	if !g.status.Ready {
+		g.mu.Unlock()
 		return false
 	}
 
-	// canonicalise line ending
-	line = strings.TrimSpace(line) + "\n"
-
 	// not enough space in Grbl's input buffer? reject the command
 	// +1 because we need to leave at least 1 byte free else Grbl locks up
 	if g.status.SerialFree <= len(line)+1 {
+		g.mu.Unlock()
 		fmt.Fprintf(os.Stderr, "not running command because serial is full: %s\n", line)
 		return false
 	}
 
 	g.status.SerialFree -= len(line)
+	g.mu.Unlock()
 	g.writeChan <- GrblResponse{responseChan: respChan, command: line}
 
 	return true
@@ -72,7 +89,7 @@ func (g *Grbl) Command(line string, respChan chan string) bool {
 //
 // spawn a goroutine to consume and ignore the response
 func (g *Grbl) CommandIgnore(line string) bool {
-	if !g.status.Ready {
+	if !g.Status().Ready {
 		return false
 	}
 	c := make(chan string)
@@ -88,7 +105,7 @@ func (g *Grbl) CommandIgnore(line string) bool {
 //
 // block until the response is received
 func (g *Grbl) CommandWait(line string) (bool, string) {
-	if !g.status.Ready {
+	if !g.Status().Ready {
 		return false, ""
 	}
 	c := make(chan string, 1)
@@ -102,7 +119,7 @@ func (g *Grbl) CommandWait(line string) (bool, string) {
 // send the given realtime command, return true if successful
 // or false if not
 func (g *Grbl) CommandRealtime(cmd byte) bool {
-	if g.status.Closed {
+	if g.Status().Closed {
 		return false
 	}
 	g.writeChan <- GrblResponse{command: string(cmd)}
@@ -111,12 +128,15 @@ func (g *Grbl) CommandRealtime(cmd byte) bool {
 
 // implements io.Closer
 func (g *Grbl) Close() error {
+	g.mu.Lock()
 	if g.status.Closed {
+		g.mu.Unlock()
 		return nil
 	}
 	g.status.Closed = true
 	g.status.Ready = false
 	g.status.Status = "Disconnected"
+	g.mu.Unlock()
 	var err error
 	if g.serialPort != nil {
 		err = g.serialPort.Close()
@@ -178,7 +198,10 @@ loop:
 				continue loop
 			}
 
-			if g.status.SerialFree < len(r.command) {
+			g.mu.Lock()
+			full := g.status.SerialFree < len(r.command)
+			g.mu.Unlock()
+			if full {
 				fmt.Fprintf(os.Stderr, "(in writechan) not running command because serial is full: %s\n", r.command)
 				if r.responseChan != nil {
 					r.responseChan <- "fail:buffer full"
@@ -208,6 +231,12 @@ loop:
 			} else if strings.HasPrefix(line, "[GC:") {
 				// g-codes update
 				g.ParseGCodes(line)
+			} else if strings.HasPrefix(line, "[PRB:") {
+				// probe result
+				g.ParseProbe(line)
+			} else if strings.HasPrefix(line, "[G5") || strings.HasPrefix(line, "[G28:") || strings.HasPrefix(line, "[G30:") || strings.HasPrefix(line, "[G92:") || strings.HasPrefix(line, "[TLO:") {
+				// coordinate offset, from "$#"
+				g.ParseOffset(line)
 			} else if configRe.MatchString(line) {
 				// config value ("$120=25.000")
 				vals := configRe.FindStringSubmatch(line)
@@ -221,7 +250,16 @@ loop:
 					fmt.Fprintf(os.Stderr, "%s: strconv.ParseFloat(%s): %v\n", line, vals[2], err)
 					continue loop
 				}
-				g.status.GrblConfig[int(key)] = val
+				// copy-on-write, because earlier copies of the status
+				// share the map with whoever they were published to
+				g.mu.Lock()
+				config := make(map[int]float64, len(g.status.GrblConfig)+1)
+				for k, v := range g.status.GrblConfig {
+					config[k] = v
+				}
+				config[int(key)] = val
+				g.status.GrblConfig = config
+				g.mu.Unlock()
 			} else if strings.HasPrefix(line, "ok") || strings.HasPrefix(line, "error") {
 				g.SendResponse(line)
 			}
@@ -245,19 +283,20 @@ func (g *Grbl) RequestStatusUpdate() bool {
 
 // request active gcodes, return true if ok or false if not
 func (g *Grbl) RequestGCodes() bool {
+	g.mu.Lock()
 	if g.status.Closed {
+		g.mu.Unlock()
 		return false
 	}
-	if !g.status.Ready {
-		return true
-	}
-	if g.status.WaitingForGCodes {
+	if !g.status.Ready || g.status.WaitingForGCodes {
 		// don't have more than one request in-flight at any time
+		g.mu.Unlock()
 		return true
 	}
 	g.status.WaitingForGCodes = true
+	g.mu.Unlock()
 	ok := g.CommandIgnore("$G")
-	if !ok && g.status.Closed {
+	if !ok && g.Status().Closed {
 		return false
 	}
 	return true
@@ -267,9 +306,19 @@ func (g *Grbl) RequestGrblConfig() bool {
 	return g.CommandIgnore("$$")
 }
 
+// request the work coordinate offsets and the G28/G30 positions, return
+// true if ok or false if not
+func (g *Grbl) RequestOffsets() bool {
+	g.mu.Lock()
+	g.status.WaitingForOffsets = true
+	g.mu.Unlock()
+	return g.CommandIgnore("$#")
+}
+
 // "status" should be a status report line from Grbl
 // send a struct{} to the StatusUpdate channel whenever there isa new status report
 func (g *Grbl) ParseStatus(status string, ch chan GrblStatus) {
+	g.mu.Lock()
 	g.status.Ready = true
 
 	prevMpos := g.status.Mpos
@@ -279,15 +328,12 @@ func (g *Grbl) ParseStatus(status string, ch chan GrblStatus) {
 	parts := strings.Split(status, "|")
 	g.status.Status = parts[0]
 
-	if g.status.GCodes == "" {
-		// at startup, get the active g-codes without having to wait for the timer to fire
-		g.RequestGCodes()
-	}
-
-	if len(g.status.GrblConfig) == 0 {
-		// at startup, grab the grbl config
-		g.RequestGrblConfig()
-	}
+	// at startup, get the active g-codes without having to wait for the
+	// timer to fire, and grab the grbl config and the coordinate offsets;
+	// the requests go out once the lock is released
+	needGCodes := g.status.GCodes == ""
+	needConfig := len(g.status.GrblConfig) == 0
+	needOffsets := !g.status.HaveOffsets && !g.status.WaitingForOffsets
 
 	// grbl in theory should give us either a wpos or an mpos
 	// every time, but track them separately just in case
@@ -364,21 +410,101 @@ func (g *Grbl) ParseStatus(status string, ch chan GrblStatus) {
 
 	distanceMoved := g.status.Mpos.Sub(prevMpos)
 	g.status.Vel = distanceMoved.Div(g.status.UpdateTime.Sub(prevUpdateTime).Minutes())
+	gs := g.status
+	g.mu.Unlock()
+
+	if needGCodes {
+		g.RequestGCodes()
+	}
+	if needConfig {
+		g.RequestGrblConfig()
+	}
+	if needOffsets {
+		g.RequestOffsets()
+	}
 
 	if ch != nil {
 		// send a status update unless doing so would block
 		select {
-		case ch <- g.status:
+		case ch <- gs:
 		default:
 		}
 	}
 }
 
 func (g *Grbl) ParseGCodes(line string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	g.status.GCodes = strings.TrimRight(strings.TrimPrefix(line, "[GC:"), "]")
 	g.status.WaitingForGCodes = false
 }
 
+// "line" should be a probe result like "[PRB:0.000,0.000,-1.234:1]"; it is
+// passed on with the next status update
+func (g *Grbl) ParseProbe(line string) {
+	line = strings.TrimRight(strings.TrimPrefix(line, "[PRB:"), "]")
+	parts := strings.Split(line, ":")
+	pos, _, err := ParseV4d(parts[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unrecognised probe result [%s]: %v\n", line, err)
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.status.ProbePos = pos
+	g.status.ProbeOk = len(parts) > 1 && parts[1] == "1"
+	g.status.ProbeCount++
+}
+
+// "line" should be a coordinate offset like "[G54:0.000,0.000,0.000]", or the
+// tool length offset like "[TLO:0.000]"
+func (g *Grbl) ParseOffset(line string) {
+	line = strings.TrimRight(strings.TrimPrefix(line, "["), "]")
+	name, coords, _ := strings.Cut(line, ":")
+	if name == "TLO" {
+		tlo, err := strconv.ParseFloat(coords, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unrecognised tool length offset [%s]: %v\n", line, err)
+			return
+		}
+		g.mu.Lock()
+		g.status.TLO = tlo
+		g.mu.Unlock()
+		return
+	}
+	pos, _, err := ParseV4d(coords)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unrecognised offset [%s]: %v\n", line, err)
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(name) == 3 && name >= "G54" && name <= "G59" {
+		g.status.CoordOffsets[name[2]-'4'] = pos
+	} else if name == "G28" {
+		g.status.G28Pos = pos
+	} else if name == "G30" {
+		g.status.G30Pos = pos
+		// the last of the ones we need for the markers; G92 and TLO follow
+		g.status.HaveOffsets = true
+		g.status.WaitingForOffsets = false
+	} else if name == "G92" {
+		g.status.G92Offset = pos
+	}
+}
+
+// true if the line might change a work offset, the G92 or tool length
+// offset, or a stored position, so that we need to ask for them again
+func changesOffsets(line string) bool {
+	code := strings.ToUpper(strings.ReplaceAll(line, " ", ""))
+	for _, g := range []string{"G10", "G28.1", "G30.1", "G92", "G43.1", "G49"} {
+		if strings.Contains(code, g) {
+			return true
+		}
+	}
+	return false
+}
+
 func (g *Grbl) SendResponse(line string) {
 	l := len(g.responseQueue)
 	if l == 0 {
@@ -393,7 +519,9 @@ func (g *Grbl) SendResponse(line string) {
 		fmt.Printf("[%s]: %s\n", r.command, line)
 	}
 
+	g.mu.Lock()
 	g.status.SerialFree += len(r.command)
+	g.mu.Unlock()
 	r.responseChan <- line
 }
 
@@ -406,27 +534,34 @@ func (g *Grbl) doAbortCommands() {
 		r.responseChan <- "fail:aborted"
 	}
 	g.responseQueue = make([]GrblResponse, 0)
+	g.mu.Lock()
 	g.status.SerialFree = g.status.SerialSize
+	g.mu.Unlock()
 }
 
 func (g *Grbl) SetWpos(p V4d) bool {
 	// XXX: uses CommandWait, which can block the main UI thread
 	// because of https://github.com/gnea/grbl/wiki/Grbl-v1.1-Interface#eeprom-issues
 	// we need to wait until a G10 is acknowledged before proceeding
-	if g.status.Status != "Idle" {
+	gs := g.Status()
+	if gs.Status != "Idle" {
 		// only allow setting WCO in Idle state
 		return false
 	}
 	line := fmt.Sprintf("G10L20P1X%.3fY%.3fZ%.3f", p.X, p.Y, p.Z)
-	if g.status.Has4thAxis {
+	if gs.Has4thAxis {
 		line += fmt.Sprintf("A%.3f", p.A)
 	}
 	ok, _ := g.CommandWait(line)
+	if ok {
+		// G54 has moved
+		g.RequestOffsets()
+	}
 	return ok
 }
 
 func (g *Grbl) SetFeedOverride(v int) bool {
-	delta := v - int(g.status.FeedOverride)
+	delta := v - int(g.Status().FeedOverride)
 	return g.SendOverrideDelta(delta, 0x91, 0x92, 0x93, 0x94)
 }
 
@@ -444,7 +579,7 @@ func (g *Grbl) SetRapidOverride(v int) bool {
 }
 
 func (g *Grbl) SetSpindleOverride(v int) bool {
-	delta := v - int(g.status.SpindleOverride)
+	delta := v - int(g.Status().SpindleOverride)
 	return g.SendOverrideDelta(delta, 0x9a, 0x9b, 0x9c, 0x9d)
 }
 
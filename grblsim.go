@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 
 	"github.com/256dpi/gcode"
 )
@@ -18,14 +19,17 @@ type GrblSim struct {
 	readBuf  []byte
 	writeBuf []byte
 
-	in  chan []byte
-	out chan []byte
+	in   chan []byte
+	out  chan []byte
+	done chan struct{} // closed by Close()
+	once sync.Once
 }
 
 func NewGrblSim() *GrblSim {
 	g := &GrblSim{
-		in:  make(chan []byte, 3),
-		out: make(chan []byte, 3),
+		in:   make(chan []byte, 3),
+		out:  make(chan []byte, 3),
+		done: make(chan struct{}),
 	}
 
 	g.s.Status = "Idle"
@@ -59,12 +63,17 @@ func (g *GrblSim) Read(p []byte) (int, error) {
 }
 
 func (g *GrblSim) Write(p []byte) (int, error) {
-	g.in <- p
-	return len(p), nil
+	select {
+	case g.in <- p:
+		return len(p), nil
+	case <-g.done:
+		return 0, io.ErrClosedPipe
+	}
 }
 
+// Close can race with Write, so it doesn't close g.in
 func (g *GrblSim) Close() error {
-	close(g.in)
+	g.once.Do(func() { close(g.done) })
 	return nil
 }
 
@@ -74,7 +83,14 @@ func (g *GrblSim) Run() {
 
 	buf := make([]byte, 0)
 
-	for data := range g.in {
+	for {
+		var data []byte
+		select {
+		case data = <-g.in:
+		case <-g.done:
+			close(g.out)
+			return
+		}
 		fmt.Printf("[read %s]\n", data)
 		for _, ch := range data {
 			if ch == '\n' {
@@ -93,7 +109,6 @@ func (g *GrblSim) Run() {
 			}
 		}
 	}
-	close(g.out)
 }
 
 func (g *GrblSim) processLine(line string) {
@@ -102,6 +117,19 @@ func (g *GrblSim) processLine(line string) {
 		if line == "$G" {
 			g.reply("[GC:" + g.s.GCodes + "]")
 			g.reply("ok")
+		} else if line == "$#" {
+			for i := 54; i <= 59; i++ {
+				offset := V4d{}
+				if i == 54 {
+					offset = g.s.Wco
+				}
+				g.reply(fmt.Sprintf("[G%d:%.3f,%.3f,%.3f]", i, offset.X, offset.Y, offset.Z))
+			}
+			g.reply("[G28:0.000,0.000,0.000]")
+			g.reply("[G30:0.000,0.000,0.000]")
+			g.reply("[G92:0.000,0.000,0.000]")
+			g.reply("[TLO:0.000]")
+			g.reply("ok")
 		} else if line == "$$" {
 			// TODO: send config
 			g.reply("ok")
@@ -134,6 +162,11 @@ func (g *GrblSim) processLine(line string) {
 		}
 		if G == 0 || G == 1 || G == 2 || G == 3 {
 			g.s.Wpos = pos
+		} else if G == 38 {
+			// pretend the probe touches a slightly tilted surface
+			pos.Z = 0.01*pos.X - 0.005*pos.Y
+			g.s.Wpos = pos
+			g.reply(fmt.Sprintf("[PRB:%.3f,%.3f,%.3f:1]", pos.X, pos.Y, pos.Z))
 		}
 		g.reply("ok")
 	}
@@ -149,11 +182,18 @@ func (g *GrblSim) statusReport() {
 	g.reply(g.s.String())
 }
 
+// moves complete as soon as they're received, so a feed hold is always
+// complete by the time it is asked for
 func (g *GrblSim) feedHold() {
+	g.s.Status = "Hold:0"
 }
 
 func (g *GrblSim) cycleStart() {
+	if strings.HasPrefix(g.s.Status, "Hold") {
+		g.s.Status = "Idle"
+	}
 }
 
 func (g *GrblSim) softReset() {
+	g.s.Status = "Idle"
 }
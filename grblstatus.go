@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -29,11 +30,23 @@ type GrblStatus struct {
 	SpindleSpeed     float64
 	Pn               string
 	Probe            bool
+	ProbePos         V4d  // machine position of the last probe contact, from "[PRB:...]"
+	ProbeOk          bool // whether the last probe cycle touched anything
+	ProbeCount       int  // number of probe results received so far
 	UpdateTime       time.Time
 	GCodes           string
 	GrblConfig       map[int]float64
 	WaitingForGCodes bool
 	Has4thAxis       bool
+
+	// from "$#", in machine coordinates
+	CoordOffsets      [6]V4d // G54 to G59
+	G28Pos            V4d
+	G30Pos            V4d
+	G92Offset         V4d     // in work coordinates, on top of the work offset
+	TLO               float64 // tool length offset, from G43.1
+	HaveOffsets       bool
+	WaitingForOffsets bool
 }
 
 func DefaultGrblStatus() GrblStatus {
@@ -49,6 +62,22 @@ func DefaultGrblStatus() GrblStatus {
 	}
 }
 
+// return the active work coordinate system, from 0 for G54 to 5 for G59
+func (gs GrblStatus) ActiveWCS() int {
+	for _, word := range strings.Fields(gs.GCodes) {
+		if len(word) == 3 && word >= "G54" && word <= "G59" {
+			return int(word[2] - '4')
+		}
+	}
+	return 0
+}
+
+// return the offset of the active work coordinate system, not including the
+// G92 and tool length offsets; this is only the same as Wco when those are zero
+func (gs GrblStatus) WcsOffset() V4d {
+	return gs.CoordOffsets[gs.ActiveWCS()]
+}
+
 // extrapolated Wpos
 func (gs GrblStatus) WposExt() V4d {
 	dt := time.Now().Sub(gs.UpdateTime)
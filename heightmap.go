@@ -0,0 +1,728 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gioui.org/app"
+	"gioui.org/layout"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"gioui.org/x/explorer"
+
+	"github.com/256dpi/gcode"
+)
+
+// a height map of the work surface, probed on a regular grid, used to make a
+// program follow a surface that isn't flat (e.g. a PCB blank)
+//
+// coordinates are in mm, in work coordinates; the heights are the work Z at
+// which the probe touched, so the map is only valid for as long as the work
+// Z offset stays the same
+type HeightMap struct {
+	Min  V4d       // X and Y of the first point
+	Max  V4d       // X and Y of the last point
+	NX   int       // number of points along X
+	NY   int       // number of points along Y
+	Z    []float64 // NX*NY heights, row by row starting from Min.Y; NaN where not probed
+	File string    // the file the map was saved to or loaded from, if any
+}
+
+func NewHeightMap(min, max V4d, nx, ny int) (*HeightMap, error) {
+	if nx < 2 || ny < 2 {
+		return nil, fmt.Errorf("need at least 2x2 points, got %dx%d", nx, ny)
+	}
+	if max.X <= min.X || max.Y <= min.Y {
+		return nil, fmt.Errorf("max X and Y must be greater than min X and Y")
+	}
+	hm := &HeightMap{Min: min, Max: max, NX: nx, NY: ny}
+	hm.Z = make([]float64, nx*ny)
+	for i := range hm.Z {
+		hm.Z[i] = math.NaN()
+	}
+	return hm, nil
+}
+
+func (hm *HeightMap) Copy() *HeightMap {
+	c := *hm
+	c.Z = append([]float64{}, hm.Z...)
+	return &c
+}
+
+// return the X and Y of point (i, j)
+func (hm *HeightMap) Point(i, j int) V4d {
+	return V4d{
+		X: hm.Min.X + (hm.Max.X-hm.Min.X)*float64(i)/float64(hm.NX-1),
+		Y: hm.Min.Y + (hm.Max.Y-hm.Min.Y)*float64(j)/float64(hm.NY-1),
+	}
+}
+
+func (hm *HeightMap) At(i, j int) float64 {
+	return hm.Z[j*hm.NX+i]
+}
+
+func (hm *HeightMap) Set(i, j int, z float64) {
+	hm.Z[j*hm.NX+i] = z
+}
+
+// true if every point has been probed
+func (hm *HeightMap) Complete() bool {
+	for _, z := range hm.Z {
+		if math.IsNaN(z) {
+			return false
+		}
+	}
+	return true
+}
+
+// return the lowest and highest probed heights
+func (hm *HeightMap) Range() (float64, float64) {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, z := range hm.Z {
+		if !math.IsNaN(z) {
+			lo = math.Min(lo, z)
+			hi = math.Max(hi, z)
+		}
+	}
+	return lo, hi
+}
+
+// the distance between points along whichever axis has them closer together
+func (hm *HeightMap) Spacing() float64 {
+	return math.Min((hm.Max.X-hm.Min.X)/float64(hm.NX-1), (hm.Max.Y-hm.Min.Y)/float64(hm.NY-1))
+}
+
+// return the height at (x, y) by bilinear interpolation between the nearest
+// 4 points; outside the map, the height at the nearest edge is used
+func (hm *HeightMap) Height(x, y float64) float64 {
+	fx := (x - hm.Min.X) / (hm.Max.X - hm.Min.X) * float64(hm.NX-1)
+	fy := (y - hm.Min.Y) / (hm.Max.Y - hm.Min.Y) * float64(hm.NY-1)
+	fx = math.Max(0, math.Min(float64(hm.NX-1), fx))
+	fy = math.Max(0, math.Min(float64(hm.NY-1), fy))
+
+	i := int(math.Min(math.Floor(fx), float64(hm.NX-2)))
+	j := int(math.Min(math.Floor(fy), float64(hm.NY-2)))
+	tx := fx - float64(i)
+	ty := fy - float64(j)
+
+	z0 := hm.At(i, j)*(1-tx) + hm.At(i+1, j)*tx
+	z1 := hm.At(i, j+1)*(1-tx) + hm.At(i+1, j+1)*tx
+	return z0*(1-ty) + z1*ty
+}
+
+// write the map in the format read by ReadHeightMap(), e.g.:
+//
+//	min=0.000,0.000
+//	max=50.000,30.000
+//	points=3,2
+//	z=0.000,0.012,0.020
+//	z=-0.010,0.004,0.015
+func (hm *HeightMap) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "min=%.3f,%.3f\n", hm.Min.X, hm.Min.Y)
+	fmt.Fprintf(bw, "max=%.3f,%.3f\n", hm.Max.X, hm.Max.Y)
+	fmt.Fprintf(bw, "points=%d,%d\n", hm.NX, hm.NY)
+	for j := 0; j < hm.NY; j++ {
+		row := make([]string, hm.NX)
+		for i := 0; i < hm.NX; i++ {
+			row[i] = fmt.Sprintf("%.4f", hm.At(i, j))
+		}
+		fmt.Fprintf(bw, "z=%s\n", strings.Join(row, ","))
+	}
+	return bw.Flush()
+}
+
+func (hm *HeightMap) Save(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = hm.Write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		hm.File = filename
+	}
+	return err
+}
+
+// read a map written by HeightMap.Write()
+func ReadHeightMap(r io.Reader) (*HeightMap, error) {
+	var min, max V4d
+	nx, ny := 0, 0
+	rows := make([][]float64, 0)
+
+	lineNum := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 1<<16), 1<<20)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: unrecognised line: [%s]", lineNum, line)
+		}
+		key := parts[0]
+		val := parts[1]
+
+		if key == "min" || key == "max" {
+			v, n, err := ParseV4d(val)
+			if err != nil || n != 2 {
+				return nil, fmt.Errorf("line %d: bad %s: [%s]", lineNum, key, val)
+			}
+			if key == "min" {
+				min = v
+			} else {
+				max = v
+			}
+		} else if key == "points" {
+			_, err := fmt.Sscanf(val, "%d,%d", &nx, &ny)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad points: [%s]", lineNum, val)
+			}
+		} else if key == "z" {
+			row := make([]float64, 0)
+			for _, s := range strings.Split(val, ",") {
+				z, err := strconv.ParseFloat(s, 64)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: bad height: [%s]", lineNum, s)
+				}
+				row = append(row, z)
+			}
+			rows = append(rows, row)
+		} else {
+			return nil, fmt.Errorf("line %d: unrecognised height map key: [%s]", lineNum, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	hm, err := NewHeightMap(min, max, nx, ny)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) != ny {
+		return nil, fmt.Errorf("expected %d rows of heights, got %d", ny, len(rows))
+	}
+	for j, row := range rows {
+		if len(row) != nx {
+			return nil, fmt.Errorf("expected %d heights in row %d, got %d", nx, j+1, len(row))
+		}
+		for i, z := range row {
+			hm.Set(i, j, z)
+		}
+	}
+	return hm, nil
+}
+
+func ReadHeightMapFile(filename string) (*HeightMap, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hm, err := ReadHeightMap(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	hm.File = filename
+	return hm, nil
+}
+
+// return a new program with the height of the surface added to every Z
+// coordinate of src, splitting long moves and arcs into short straight moves
+// so that they follow the surface
+func (hm *HeightMap) Apply(src *Program, progress *Progress) (*Program, error) {
+	if !hm.Complete() {
+		return nil, fmt.Errorf("the height map isn't completely probed")
+	}
+
+	pw, err := NewProgramWriter(src.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// follows the unlevelled program
+	in := NewInterpreter(defaultArcTolerance)
+	var applyErr error
+	src.Each(func(i int, str string) bool {
+		if progress != nil && i%programBlockLines == 0 {
+			progress.Set(int64(i), int64(src.Len()))
+		}
+		out, err := hm.applyLine(i, str, in)
+		if err != nil {
+			applyErr = &ProgramError{Line: i, Msg: err.Error()}
+			return false
+		}
+		for _, line := range out {
+			pw.WriteLine(line)
+		}
+		return true
+	})
+	if progress != nil {
+		progress.Set(int64(src.Len()), int64(src.Len()))
+	}
+	if applyErr != nil {
+		pw.Discard()
+		return nil, applyErr
+	}
+
+	p, err := pw.Program()
+	if err != nil {
+		return nil, err
+	}
+	p.Source = src
+	p.HeightMap = hm
+	return p, nil
+}
+
+// level line i of the program; in follows the unlevelled program
+func (hm *HeightMap) applyLine(i int, str string, in *Interpreter) ([]string, error) {
+	if strings.HasPrefix(strings.TrimSpace(str), "$") {
+		// Grbl system command
+		return []string{str}, nil
+	}
+	line, err := ParseWords(str)
+	if err != nil {
+		return nil, err
+	}
+
+	before := *in
+	segs, err := in.Line(i, str)
+	if err != nil {
+		return nil, err
+	}
+
+	notPosition := false
+	hasAxis := false
+	for _, c := range line.Codes {
+		if c.Letter == "G" {
+			if c.Value == 10 || c.Value == 92 || c.Value == 28.1 || c.Value == 30.1 || c.Value == 53 || c.Value == 28 || c.Value == 30 {
+				// setting offsets, or moves that end somewhere we don't
+				// know in work coordinates
+				notPosition = true
+			}
+		} else if c.Letter == "X" || c.Letter == "Y" || c.Letter == "Z" {
+			hasAxis = true
+		}
+	}
+	if notPosition || !hasAxis || in.motion == 80 {
+		return []string{str}, nil
+	}
+	if in.incremental {
+		return nil, fmt.Errorf("can't level incremental (G91) moves")
+	}
+	if in.motion >= 38 && in.motion < 39 {
+		// probing ends wherever the probe touches
+		return []string{str}, nil
+	}
+	if !in.Known("X") || !in.Known("Y") || !in.Known("Z") {
+		// we don't know where we are yet, so we can't know the height of the
+		// surface; this is normally just the first move(s) of a program
+		return []string{str}, nil
+	}
+	startKnown := in.wcs == before.wcs && before.Known("X") && before.Known("Y") && before.Known("Z")
+
+	// points to move through, before levelling, in mm and work coordinates
+	offset := in.offset()
+	points := make([]V4d, 0)
+	if in.motion == 0 || !startKnown {
+		points = append(points, in.WorkPos())
+	} else {
+		if (in.motion == 2 || in.motion == 3) && in.plane != 17 {
+			return nil, fmt.Errorf("can't level an arc in the G%d plane", in.plane)
+		}
+		// split the line, or the pieces of the arc, so that the points are
+		// no further apart than half the probe spacing
+		step := hm.Spacing() / 2
+		for _, seg := range segs {
+			start, end := seg.Start.Sub(offset), seg.End.Sub(offset)
+			n := int(math.Ceil(math.Hypot(end.X-start.X, end.Y-start.Y) / step))
+			if n < 1 {
+				n = 1
+			}
+			for k := 1; k < n; k++ {
+				points = append(points, start.Add(end.Sub(start).Mul(float64(k)/float64(n))))
+			}
+			points = append(points, end)
+		}
+	}
+
+	// words that aren't part of the move stay on the first line
+	motion := gcode.GCode{Letter: "G", Value: 1}
+	if in.motion == 0 {
+		motion.Value = 0
+	}
+	other := make([]gcode.GCode, 0, len(line.Codes))
+	for _, c := range line.Codes {
+		if c.Comment == "" {
+			if c.Letter == "G" && c.Value <= 3 {
+				continue
+			}
+			if c.Letter == "X" || c.Letter == "Y" || c.Letter == "Z" || c.Letter == "I" || c.Letter == "J" || c.Letter == "K" || c.Letter == "R" {
+				continue
+			}
+		}
+		other = append(other, c)
+	}
+
+	// write the points in the program's units
+	scale := 1.0
+	if in.inches {
+		scale = 25.4
+	}
+	out := make([]string, 0, len(points))
+	for k, pt := range points {
+		z := pt.Z + hm.Height(pt.X, pt.Y)
+		l := gcode.Line{}
+		if k == 0 {
+			l.Codes = append(l.Codes, motion)
+			l.Codes = append(l.Codes, other...)
+			l.Comment = line.Comment
+		}
+		l.Codes = append(l.Codes, gcode.GCode{Letter: "X", Value: pt.X / scale}, gcode.GCode{Letter: "Y", Value: pt.Y / scale}, gcode.GCode{Letter: "Z", Value: z / scale})
+		out = append(out, FormatWords(l))
+	}
+	return out, nil
+}
+
+// the panel for probing height maps, and levelling the loaded program
+type HeightMapPanel struct {
+	app     *App
+	visible bool
+	hm      atomic.Pointer[HeightMap] // the map being probed, or most recently probed or loaded
+
+	// the grid to probe, in work coordinates
+	Min       V4d
+	Max       V4d
+	NX        int
+	NY        int
+	Depth     float64 // Z to probe down to
+	Clearance float64 // Z to move between points at
+	Feed      float64 // probing feed rate
+
+	minXEdit      EditableNum
+	minYEdit      EditableNum
+	maxXEdit      EditableNum
+	maxYEdit      EditableNum
+	nxEdit        EditableNum
+	nyEdit        EditableNum
+	depthEdit     EditableNum
+	clearanceEdit EditableNum
+	feedEdit      EditableNum
+
+	probeBtn widget.Clickable
+	loadBtn  widget.Clickable
+	saveBtn  widget.Clickable
+	levelBtn widget.Clickable
+	clearBtn widget.Clickable
+}
+
+func NewHeightMapPanel(app *App) *HeightMapPanel {
+	hp := &HeightMapPanel{
+		app:       app,
+		Max:       V4d{X: 50, Y: 50},
+		NX:        5,
+		NY:        5,
+		Depth:     -2,
+		Clearance: 2,
+		Feed:      50,
+	}
+
+	edit := func(e *EditableNum, label string, v *float64) {
+		e.app = app
+		e.Label = label
+		e.Callback = func(val float64) { *v = val }
+	}
+	edit(&hp.minXEdit, "  X min", &hp.Min.X)
+	edit(&hp.minYEdit, "  Y min", &hp.Min.Y)
+	edit(&hp.maxXEdit, "  X max", &hp.Max.X)
+	edit(&hp.maxYEdit, "  Y max", &hp.Max.Y)
+	edit(&hp.depthEdit, "  Depth", &hp.Depth)
+	edit(&hp.clearanceEdit, "Clear Z", &hp.Clearance)
+	edit(&hp.feedEdit, "   Feed", &hp.Feed)
+	hp.nxEdit.app = app
+	hp.nxEdit.Label = "X points"
+	hp.nxEdit.Int = true
+	hp.nxEdit.Callback = func(v float64) { hp.NX = int(v) }
+	hp.nyEdit.app = app
+	hp.nyEdit.Label = "Y points"
+	hp.nyEdit.Int = true
+	hp.nyEdit.Callback = func(v float64) { hp.NY = int(v) }
+
+	return hp
+}
+
+// return the current height map, or nil
+func (hp *HeightMapPanel) Map() *HeightMap {
+	return hp.hm.Load()
+}
+
+// use the given map, and make the grid settings match it
+func (hp *HeightMapPanel) SetMap(hm *HeightMap) {
+	hp.hm.Store(hm)
+	if hm != nil {
+		hp.Min = hm.Min
+		hp.Max = hm.Max
+		hp.NX = hm.NX
+		hp.NY = hm.NY
+	}
+	hp.app.w.Invalidate()
+}
+
+// probe the grid in the background, unless a macro or program is already
+// running; the probe is cancelled like a macro, with Escape
+func (hp *HeightMapPanel) Probe() {
+	a := hp.app
+	hm, err := NewHeightMap(hp.Min, hp.Max, hp.NX, hp.NY)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "probe height map: %v\n", err)
+		return
+	}
+	if hp.Clearance <= hp.Depth {
+		fmt.Fprintf(os.Stderr, "probe height map: clearance Z must be above the probe depth\n")
+		return
+	}
+	if a.rs.Running {
+		fmt.Fprintf(os.Stderr, "can't probe while a program is running\n")
+		return
+	}
+	m := &Macro{Name: "probe height map"}
+	if !a.runningMacro.CompareAndSwap(nil, m) {
+		fmt.Fprintf(os.Stderr, "can't probe while %s is running\n", a.runningMacro.Load().Name)
+		return
+	}
+	a.cancelMacro.Store(false)
+	hp.hm.Store(hm.Copy())
+	depth, clearance, feed := hp.Depth, hp.Clearance, hp.Feed
+	a.w.Invalidate()
+
+	go func() {
+		defer func() {
+			a.runningMacro.Store(nil)
+			a.w.Invalidate()
+		}()
+
+		err := hp.probe(hm, depth, clearance, feed)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "probe height map: %v\n", err)
+			return
+		}
+
+		// keep every probed map, so that checkpoints can refer to it
+		filename := filepath.Join(ConfDir(), "heightmap-"+time.Now().Format("20060102-150405")+".map")
+		if err := hm.Save(filename); err != nil {
+			fmt.Fprintf(os.Stderr, "write %s: %v\n", filename, err)
+		}
+		hp.hm.Store(hm)
+	}()
+}
+
+// probe each point of hm, in a zig-zag, from the clearance height
+func (hp *HeightMapPanel) probe(hm *HeightMap, depth, clearance, feed float64) error {
+	a := hp.app
+	send := func(format string, args ...interface{}) error {
+		return a.RunMacroStep(MacroStep{Kind: "send", Value: fmt.Sprintf(format, args...)})
+	}
+
+	if err := send("G21 G90"); err != nil {
+		return err
+	}
+	if err := send("G0 Z%.3f", clearance); err != nil {
+		return err
+	}
+	for j := 0; j < hm.NY; j++ {
+		for n := 0; n < hm.NX; n++ {
+			i := n
+			if j%2 == 1 {
+				i = hm.NX - 1 - n
+			}
+			if a.cancelMacro.Load() {
+				return fmt.Errorf("cancelled")
+			}
+
+			pt := hm.Point(i, j)
+			if err := send("G0 X%.3f Y%.3f", pt.X, pt.Y); err != nil {
+				return err
+			}
+			// the probe result arrives before the "ok", and reaches gsNew with
+			// the next status update
+			count := a.LatestStatus().ProbeCount
+			if err := send("G38.2 Z%.3f F%.1f", depth, feed); err != nil {
+				return err
+			}
+			err := a.waitFor(func(gs GrblStatus) bool { return gs.ProbeCount > count })
+			if err != nil {
+				return err
+			}
+			gs := a.LatestStatus()
+			if !gs.ProbeOk {
+				return fmt.Errorf("probe didn't touch at X%.3f Y%.3f", pt.X, pt.Y)
+			}
+			hm.Set(i, j, gs.ProbePos.Z-gs.Wco.Z)
+			hp.hm.Store(hm.Copy())
+			a.w.Invalidate()
+
+			if err := send("G0 Z%.3f", clearance); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// level the loaded program with the current map, or stop levelling it
+func (hp *HeightMapPanel) ToggleLevel() {
+	prog := hp.app.rs.Program
+	if prog == nil {
+		return
+	}
+	if prog.HeightMap != nil {
+		hp.app.Reprocess(prog.Transform, prog.Array, nil)
+		return
+	}
+	hm := hp.Map()
+	if hm == nil || !hm.Complete() {
+		fmt.Fprintf(os.Stderr, "no complete height map to level with\n")
+		return
+	}
+	hp.app.Reprocess(prog.Transform, prog.Array, hm)
+}
+
+func (hp *HeightMapPanel) LoadFile() {
+	go func() {
+		w := app.NewWindow(app.Title("Open height map"))
+		e := explorer.NewExplorer(w)
+		f, err := e.ChooseFile()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "explorer.ChooseFile(): %v\n", err)
+			return
+		}
+		defer f.Close()
+		hm, err := ReadHeightMap(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "load height map: %v\n", err)
+			return
+		}
+		if named, ok := f.(interface{ Name() string }); ok {
+			hm.File = named.Name()
+		}
+		hp.SetMap(hm)
+	}()
+}
+
+func (hp *HeightMapPanel) SaveFile() {
+	hm := hp.Map()
+	if hm == nil || !hm.Complete() {
+		fmt.Fprintf(os.Stderr, "no complete height map to save\n")
+		return
+	}
+	go func() {
+		w := app.NewWindow(app.Title("Save height map"))
+		e := explorer.NewExplorer(w)
+		f, err := e.CreateFile("heightmap.map")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "explorer.CreateFile(): %v\n", err)
+			return
+		}
+		defer f.Close()
+		if err := hm.Write(f); err != nil {
+			fmt.Fprintf(os.Stderr, "save height map: %v\n", err)
+		}
+	}()
+}
+
+func (hp *HeightMapPanel) Layout(gtx C) D {
+	if !hp.visible {
+		return D{}
+	}
+
+	for hp.probeBtn.Clicked(gtx) {
+		hp.Probe()
+	}
+	for hp.loadBtn.Clicked(gtx) {
+		hp.LoadFile()
+	}
+	for hp.saveBtn.Clicked(gtx) {
+		hp.SaveFile()
+	}
+	for hp.levelBtn.Clicked(gtx) {
+		hp.ToggleLevel()
+	}
+	for hp.clearBtn.Clicked(gtx) {
+		hp.SetMap(nil)
+	}
+
+	levelLbl := "+LEVEL"
+	if prog := hp.app.rs.Program; prog != nil && prog.HeightMap != nil {
+		levelLbl = "-LEVEL"
+	}
+
+	info := "no height map"
+	if hm := hp.Map(); hm != nil {
+		lo, hi := hm.Range()
+		info = fmt.Sprintf("%dx%d points", hm.NX, hm.NY)
+		if !math.IsInf(lo, 0) {
+			info += fmt.Sprintf(", Z %.3f to %.3f", lo, hi)
+		}
+		if !hm.Complete() {
+			info += " (incomplete)"
+		}
+		if hm.File != "" {
+			info += ", " + filepath.Base(hm.File)
+		}
+	}
+
+	return Panel{Width: 1, CornerRadius: 5, Color: grey(128), BackgroundColor: grey(16), Margin: layout.UniformInset(5), Padding: layout.UniformInset(5)}.Layout(gtx, func(gtx C) D {
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+			layout.Rigid(func(gtx C) D {
+				return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx,
+					material.H6(hp.app.th, "Height map ").Layout,
+					material.Button(hp.app.th, &hp.probeBtn, "PROBE").Layout,
+					material.Button(hp.app.th, &hp.loadBtn, "LOAD").Layout,
+					material.Button(hp.app.th, &hp.saveBtn, "SAVE").Layout,
+					material.Button(hp.app.th, &hp.levelBtn, levelLbl).Layout,
+					material.Button(hp.app.th, &hp.clearBtn, "CLEAR").Layout,
+				)
+			}),
+			layout.Rigid(func(gtx C) D {
+				return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx,
+					func(gtx C) D { return hp.minXEdit.Layout(gtx, hp.Min.X) },
+					func(gtx C) D { return hp.minYEdit.Layout(gtx, hp.Min.Y) },
+					func(gtx C) D { return hp.maxXEdit.Layout(gtx, hp.Max.X) },
+					func(gtx C) D { return hp.maxYEdit.Layout(gtx, hp.Max.Y) },
+					func(gtx C) D { return hp.nxEdit.Layout(gtx, float64(hp.NX)) },
+					func(gtx C) D { return hp.nyEdit.Layout(gtx, float64(hp.NY)) },
+				)
+			}),
+			layout.Rigid(func(gtx C) D {
+				return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx,
+					func(gtx C) D { return hp.depthEdit.Layout(gtx, hp.Depth) },
+					func(gtx C) D { return hp.clearanceEdit.Layout(gtx, hp.Clearance) },
+					func(gtx C) D { return hp.feedEdit.Layout(gtx, hp.Feed) },
+				)
+			}),
+			layout.Rigid(material.Body1(hp.app.th, info).Layout),
+		)
+	})
+}
+
+func (hp *HeightMapPanel) SetTextSize(sz unit.Sp) {
+	for _, e := range []*EditableNum{&hp.minXEdit, &hp.minYEdit, &hp.maxXEdit, &hp.maxYEdit, &hp.nxEdit, &hp.nyEdit, &hp.depthEdit, &hp.clearanceEdit, &hp.feedEdit} {
+		e.TextSize = sz
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const defaultArcTolerance = 0.002 // mm, Grbl's default $12
+
+type SegmentKind int
+
+const (
+	SegmentRapid SegmentKind = iota // G0, and the moves of G28/G30
+	SegmentFeed                     // G1
+	SegmentArc                      // a straight piece of a G2/G3 arc
+	SegmentProbe                    // G38.x
+)
+
+func (k SegmentKind) String() string {
+	if k == SegmentRapid {
+		return "rapid"
+	} else if k == SegmentFeed {
+		return "feed"
+	} else if k == SegmentArc {
+		return "arc"
+	} else if k == SegmentProbe {
+		return "probe"
+	} else {
+		return "???"
+	}
+}
+
+// a straight move of the toolpath, in mm, in the coordinates of the work
+// coordinate system that was selected when the program started
+type Segment struct {
+	Kind  SegmentKind
+	Line  int     // index into the program of the line that made this move
+	Feed  float64 // mm/min, or 0 for rapids
+	Start V4d
+	End   V4d
+}
+
+func (s Segment) Length() float64 {
+	return s.End.Sub(s.Start).Length()
+}
+
+// a modal G-code interpreter that turns lines of a program into segments,
+// following Grbl's rules
+//
+// we don't know where the work coordinate systems are on the machine, so we
+// pretend that the one in use at the start is at machine zero and that the
+// others are on top of it until G10 moves them; this means G53, G28, and G30
+// moves are only drawn in the right place if the work offset is zero
+type Interpreter struct {
+	ArcTolerance float64 // mm, like Grbl's $12
+
+	pos         V4d // in mm
+	motion      float64
+	plane       int // 17, 18, or 19
+	inches      bool
+	incremental bool
+	inverseTime bool
+	feed        float64 // in the program's units per minute, or 1/minutes with G93
+	wcs         int     // 0 to 5, for G54 to G59
+	wcsOffsets  [6]V4d
+	g92         V4d
+	g28         V4d
+	g30         V4d
+	known       [4]bool // whether X, Y, Z, and A are where the program put them, in work coordinates
+}
+
+func NewInterpreter(arcTolerance float64) *Interpreter {
+	if arcTolerance <= 0 {
+		arcTolerance = defaultArcTolerance
+	}
+	return &Interpreter{ArcTolerance: arcTolerance, plane: 17}
+}
+
+// the current position, in mm
+func (in *Interpreter) Pos() V4d {
+	return in.pos
+}
+
+// the current position in the coordinates of the program, i.e. relative to
+// the active work coordinate system and G92 offset, in mm
+func (in *Interpreter) WorkPos() V4d {
+	return in.pos.Sub(in.offset())
+}
+
+// true if the program has said where the axis ("X", "Y", "Z", or "A") is in
+// work coordinates; at the start, and after G28, G30, G53, and probing, we
+// can't know
+func (in *Interpreter) Known(axis string) bool {
+	i := strings.Index("XYZA", axis)
+	return i >= 0 && in.known[i]
+}
+
+// set whether each axis named on the line is known
+func (in *Interpreter) setKnown(words map[string]float64, known bool) {
+	for i, axis := range []string{"X", "Y", "Z", "A"} {
+		if _, ok := words[axis]; ok {
+			in.known[i] = known
+		}
+	}
+}
+
+// the offset from the coordinates in the program to ours
+func (in *Interpreter) offset() V4d {
+	return in.wcsOffsets[in.wcs].Add(in.g92)
+}
+
+// interpret line i of the program, updating the modal state, and return
+// the segments it moves along; on error the state is unchanged
+func (in *Interpreter) Line(i int, str string) ([]Segment, error) {
+	line, err := ParseWords(str)
+	if err != nil {
+		return nil, err
+	}
+
+	st := *in
+	motion := -1.0  // motion mode given on this line
+	nonModal := 0.0 // G10, G28, G30, G53, or G92 given on this line
+	words := make(map[string]float64)
+	for _, c := range line.Codes {
+		if c.Comment != "" {
+			continue
+		}
+		if c.Letter == "G" {
+			g := math.Round(c.Value*10) / 10
+			if g == 0 || g == 1 || g == 2 || g == 3 || g == 38.2 || g == 38.3 || g == 38.4 || g == 38.5 || g == 80 {
+				motion = g
+			} else if g == 17 || g == 18 || g == 19 {
+				st.plane = int(g)
+			} else if g == 20 {
+				st.inches = true
+			} else if g == 21 {
+				st.inches = false
+			} else if g == 90 {
+				st.incremental = false
+			} else if g == 91 {
+				st.incremental = true
+			} else if g == 93 {
+				st.inverseTime = true
+			} else if g == 94 {
+				st.inverseTime = false
+			} else if g >= 54 && g <= 59 {
+				st.wcs = int(g) - 54
+			} else if g == 10 || g == 28 || g == 28.1 || g == 30 || g == 30.1 || g == 53 || g == 92 || g == 92.1 {
+				nonModal = g
+			}
+		} else {
+			words[c.Letter] = c.Value
+		}
+	}
+	if motion >= 0 {
+		st.motion = motion
+	}
+	if st.wcs != in.wcs {
+		// we don't know where the new work coordinate system is
+		st.known = [4]bool{}
+	}
+
+	scale := 1.0
+	if st.inches {
+		scale = 25.4
+	}
+	if f, ok := words["F"]; ok {
+		st.feed = f
+	}
+
+	// the position that the axis words on this line ask for
+	hasAxis := false
+	target := st.pos
+	offset := st.offset()
+	for _, axis := range []string{"X", "Y", "Z", "A"} {
+		v, ok := words[axis]
+		if !ok {
+			continue
+		}
+		hasAxis = true
+		if axis != "A" {
+			v *= scale
+		}
+		if nonModal == 53 {
+			// machine coordinates, even in G91
+			*target.Select(axis) = v
+		} else if st.incremental {
+			*target.Select(axis) += v
+		} else {
+			*target.Select(axis) = v + *offset.Select(axis)
+		}
+	}
+
+	segs := make([]Segment, 0)
+	if nonModal == 10 {
+		// G10 L2 Pn sets a work offset, G10 L20 Pn sets it so that the
+		// current position has the given coordinates
+		l, p := int(words["L"]), int(words["P"])-1
+		if p < 0 {
+			p = st.wcs
+		}
+		if p > 5 || (l != 2 && l != 20) {
+			return nil, fmt.Errorf("unsupported G10 L%d P%d", l, p+1)
+		}
+		for _, axis := range []string{"X", "Y", "Z", "A"} {
+			v, ok := words[axis]
+			if !ok {
+				continue
+			}
+			if axis != "A" {
+				v *= scale
+			}
+			if l == 2 {
+				*st.wcsOffsets[p].Select(axis) = v
+			} else {
+				*st.wcsOffsets[p].Select(axis) = *st.pos.Select(axis) - *st.g92.Select(axis) - v
+			}
+		}
+		if p == st.wcs {
+			// L20 says where we are, L2 moves the origin by an unknown amount
+			st.setKnown(words, l == 20)
+		}
+	} else if nonModal == 92 {
+		for _, axis := range []string{"X", "Y", "Z", "A"} {
+			if v, ok := words[axis]; ok {
+				if axis != "A" {
+					v *= scale
+				}
+				*st.g92.Select(axis) = *st.pos.Select(axis) - *st.wcsOffsets[st.wcs].Select(axis) - v
+			}
+		}
+		st.setKnown(words, true)
+	} else if nonModal == 92.1 {
+		st.g92 = V4d{}
+		st.known = [4]bool{}
+	} else if nonModal == 28.1 {
+		st.g28 = st.pos
+	} else if nonModal == 30.1 {
+		st.g30 = st.pos
+	} else if nonModal == 28 || nonModal == 30 {
+		// rapid to the intermediate point, then to the stored position; only
+		// the named axes move, or all of them if none are named
+		home := st.g28
+		if nonModal == 30 {
+			home = st.g30
+		}
+		if hasAxis {
+			segs = append(segs, Segment{Kind: SegmentRapid, Line: i, Start: st.pos, End: target})
+			st.pos = target
+			end := st.pos
+			for _, axis := range []string{"X", "Y", "Z", "A"} {
+				if _, ok := words[axis]; ok {
+					*end.Select(axis) = *home.Select(axis)
+				}
+			}
+			home = end
+			st.setKnown(words, false)
+		} else {
+			st.known = [4]bool{}
+		}
+		segs = append(segs, Segment{Kind: SegmentRapid, Line: i, Start: st.pos, End: home})
+		st.pos = home
+	} else if hasAxis {
+		if st.motion == 80 {
+			return nil, fmt.Errorf("axis words without a motion mode")
+		}
+		feed := st.feed * scale
+		if st.motion == 0 {
+			segs = append(segs, Segment{Kind: SegmentRapid, Line: i, Start: st.pos, End: target})
+		} else if st.motion == 1 {
+			if st.inverseTime {
+				feed = target.Sub(st.pos).Length() * st.feed
+			}
+			segs = append(segs, Segment{Kind: SegmentFeed, Line: i, Feed: feed, Start: st.pos, End: target})
+		} else if st.motion == 2 || st.motion == 3 {
+			pts, length, err := st.arc(target, words, scale)
+			if err != nil {
+				return nil, err
+			}
+			if st.inverseTime {
+				feed = length * st.feed
+			}
+			prev := st.pos
+			for _, pt := range pts {
+				segs = append(segs, Segment{Kind: SegmentArc, Line: i, Feed: feed, Start: prev, End: pt})
+				prev = pt
+			}
+		} else {
+			// we don't know where the probe will stop, so assume it goes all the way
+			segs = append(segs, Segment{Kind: SegmentProbe, Line: i, Feed: feed, Start: st.pos, End: target})
+		}
+		st.pos = target
+		if nonModal == 53 || st.motion >= 38 {
+			st.setKnown(words, false)
+		} else if !st.incremental {
+			st.setKnown(words, true)
+		}
+	}
+
+	*in = st
+	return segs, nil
+}
+
+// return points along the arc from the current position to end (not
+// including the current position), and the length of the arc; splits the
+// arc into pieces the same way as Grbl, so that no piece is further than
+// ArcTolerance from the true arc
+func (in *Interpreter) arc(end V4d, words map[string]float64, scale float64) ([]V4d, float64, error) {
+	// the two axes of the plane, and the linear axis for helical arcs
+	axis0, axis1, linear := "X", "Y", "Z"
+	off0, off1 := "I", "J"
+	if in.plane == 18 {
+		axis0, axis1, linear = "Z", "X", "Y"
+		off0, off1 = "K", "I"
+	} else if in.plane == 19 {
+		axis0, axis1, linear = "Y", "Z", "X"
+		off0, off1 = "J", "K"
+	}
+	start := in.pos
+	x0, y0 := *start.Select(axis0), *start.Select(axis1)
+	x1, y1 := *end.Select(axis0), *end.Select(axis1)
+	clockwise := in.motion == 2
+
+	i, hasI := words[off0]
+	j, hasJ := words[off1]
+	r, hasR := words["R"]
+	var cx, cy float64
+	if hasR {
+		// same as Grbl: the centre is on the perpendicular bisector of the
+		// chord, on the side given by the direction and the sign of R
+		r *= scale
+		dx, dy := x1-x0, y1-y0
+		h := 4*r*r - dx*dx - dy*dy
+		if h < 0 || (dx == 0 && dy == 0) {
+			return nil, 0, fmt.Errorf("arc radius is too small")
+		}
+		h = -math.Sqrt(h) / math.Hypot(dx, dy)
+		if !clockwise {
+			h = -h
+		}
+		if r < 0 {
+			h = -h
+		}
+		cx = x0 + (dx-dy*h)/2
+		cy = y0 + (dy+dx*h)/2
+	} else if hasI || hasJ {
+		cx, cy = x0+i*scale, y0+j*scale
+	} else {
+		return nil, 0, fmt.Errorf("arc has no %s, %s, or R", off0, off1)
+	}
+
+	radius := math.Hypot(x0-cx, y0-cy)
+	a0 := math.Atan2(y0-cy, x0-cx)
+	sweep := math.Atan2(y1-cy, x1-cx) - a0
+	if clockwise && sweep >= -1e-7 {
+		sweep -= 2 * math.Pi
+	} else if !clockwise && sweep <= 1e-7 {
+		sweep += 2 * math.Pi
+	}
+
+	n := 1
+	if 2*radius > in.ArcTolerance {
+		n = int(math.Floor(math.Abs(0.5*sweep*radius) / math.Sqrt(in.ArcTolerance*(2*radius-in.ArcTolerance))))
+	}
+	if n < 1 {
+		n = 1
+	}
+	rise := *end.Select(linear) - *start.Select(linear)
+	points := make([]V4d, 0, n)
+	for k := 1; k < n; k++ {
+		f := float64(k) / float64(n)
+		a := a0 + sweep*f
+		pt := start.Add(end.Sub(start).Mul(f)) // for the linear axis and A
+		*pt.Select(axis0) = cx + radius*math.Cos(a)
+		*pt.Select(axis1) = cy + radius*math.Sin(a)
+		points = append(points, pt)
+	}
+	points = append(points, end)
+	return points, math.Hypot(sweep*radius, rise), nil
+}
@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"os"
 	"time"
-
-	"gioui.org/io/key"
 )
 
 type JogKeyState int
@@ -17,17 +15,6 @@ const (
 	JogKeyHold
 )
 
-const (
-	JogXNeg = key.NameLeftArrow
-	JogXPos = key.NameRightArrow
-	JogYNeg = key.NameDownArrow
-	JogYPos = key.NameUpArrow
-	JogZNeg = key.NamePageDown
-	JogZPos = key.NamePageUp
-	JogANeg = "...no such key..."
-	JogAPos = "...no such key..."
-)
-
 type JogControl struct {
 	app            *App
 	Increment      float64
@@ -66,7 +53,8 @@ func (j *JogControl) Run() {
 	for {
 		<-ticker.C
 
-		j.Axes.Update(j.app.gs.Wpos, j.app.gs.Vel)
+		gs := j.app.LatestStatus()
+		j.Axes.Update(gs.Wpos, gs.Vel)
 		j.Axes.StepContinuous(j.ActiveFeedRate * j.TickerPeriod.Minutes())
 		j.SendJog()
 	}
@@ -90,7 +78,7 @@ func (j *JogControl) SendJogCommand(line string) bool {
 	if len(line) == 0 {
 		return true
 	}
-	if j.app.gs.PlannerFree < 2 {
+	if j.app.LatestStatus().PlannerFree < 2 {
 		return false
 	}
 	fmt.Println(line)
@@ -120,7 +108,7 @@ func (j *JogControl) SetActiveFeedRate(feed float64) {
 func (j *JogControl) Update(newKeyState map[string]JogKeyState) {
 	needCancel := false
 	for k, state := range newKeyState {
-		ok, axisName, dir := JogAction(k)
+		ok, axisName, dir := j.app.keymap.JogAction(k)
 		if !ok {
 			continue
 		}
@@ -164,25 +152,3 @@ func (j *JogControl) Update(newKeyState map[string]JogKeyState) {
 		j.Cancel()
 	}
 }
-
-func JogAction(key string) (bool, string, int) {
-	if key == JogXNeg {
-		return true, "X", -1
-	} else if key == JogXPos {
-		return true, "X", +1
-	} else if key == JogYNeg {
-		return true, "Y", -1
-	} else if key == JogYPos {
-		return true, "Y", +1
-	} else if key == JogZNeg {
-		return true, "Z", -1
-	} else if key == JogZPos {
-		return true, "Z", +1
-	} else if key == JogANeg {
-		return true, "A", -1
-	} else if key == JogAPos {
-		return true, "A", +1
-	} else {
-		return false, "", 0
-	}
-}
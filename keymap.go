@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gioui.org/io/key"
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/op/paint"
+	"gioui.org/widget/material"
+)
+
+// something a key can do; jog actions have no Do, because the jog control
+// looks at which keys are held rather than at presses
+type KeyAction struct {
+	Name    string
+	Help    string
+	Do      func(a *App, e key.Event)
+	JogAxis string
+	JogDir  int
+}
+
+var keyActions = []KeyAction{
+	{Name: "mdi", Help: "type a G-code command", Do: func(a *App, e key.Event) {
+		if a.mdi.editor.Text() == "" && len(e.Name) == 1 {
+			a.mdi.editor.SetText(e.Name)
+			a.mdi.editor.SetCaret(1, 1)
+		}
+		a.mdi.editor.Focus()
+		a.mdi.defocusOnSubmit = true
+		a.PushMode(ModeMDI)
+	}},
+	{Name: "open", Help: "open a G-code file", Do: func(a *App, e key.Event) { a.OpenFile() }},
+	{Name: "queue", Help: "add G-code files to the job queue", Do: func(a *App, e key.Event) { a.queue.AddFiles() }},
+	{Name: "transform", Help: "show/hide the transform panel", Do: func(a *App, e key.Event) { a.xform.visible = !a.xform.visible }},
+	{Name: "array", Help: "show/hide the step-and-repeat panel", Do: func(a *App, e key.Event) { a.array.visible = !a.array.visible }},
+	{Name: "simulate", Help: "show/hide the stock removal simulation", Do: func(a *App, e key.Event) { a.sim.visible = !a.sim.visible }},
+	{Name: "heightmap", Help: "show/hide the height map panel", Do: func(a *App, e key.Event) { a.hmap.visible = !a.hmap.visible }},
+	{Name: "jog-increment", Help: "edit the jog increment", Do: func(a *App, e key.Event) { a.jogIncEdit.ShowEditor() }},
+	{Name: "jog-feed", Help: "edit the jog feed rate", Do: func(a *App, e key.Event) { a.jogFeedEdit.ShowEditor() }},
+	{Name: "jog-rapid", Help: "edit the fast jog feed rate", Do: func(a *App, e key.Event) { a.jogRapidFeedEdit.ShowEditor() }},
+
+	{Name: "view-top", Help: "look at the toolpath from the top", Do: func(a *App, e key.Event) { a.tp.SetView(0) }},
+	{Name: "view-front", Help: "look at the toolpath from the front", Do: func(a *App, e key.Event) { a.tp.SetView(1) }},
+	{Name: "view-right", Help: "look at the toolpath from the right", Do: func(a *App, e key.Event) { a.tp.SetView(2) }},
+	{Name: "view-iso", Help: "look at the toolpath from the iso view", Do: func(a *App, e key.Event) { a.tp.SetView(3) }},
+	{Name: "zramp", Help: "colour the toolpath by Z depth, or by kind of move", Do: func(a *App, e key.Event) { a.tp.ToggleZRamp() }},
+	{Name: "fit-program", Help: "zoom to fit the program", Do: func(a *App, e key.Event) { a.tp.ZoomToProgram() }},
+	{Name: "fit-envelope", Help: "zoom to fit the machine's travel", Do: func(a *App, e key.Event) { a.tp.ZoomToEnvelope() }},
+	{Name: "centre-tool", Help: "centre the view on the tool", Do: func(a *App, e key.Event) { a.tp.CentreOnTool() }},
+	{Name: "follow", Help: "follow the tool while running", Do: func(a *App, e key.Event) { a.tp.ToggleFollow() }},
+	{Name: "measure", Help: "measure on the toolpath view", Do: func(a *App, e key.Event) { a.tp.ToggleMeasure() }},
+	{Name: "reset-view", Help: "reset the toolpath view", Do: func(a *App, e key.Event) { a.tp.ResetView() }},
+
+	{Name: "hold", Help: "feed hold", Do: func(a *App, e key.Event) { a.gcodeRunnerChan <- RunnerCmd{Kind: CmdPause} }},
+	{Name: "reset", Help: "soft reset", Do: func(a *App, e key.Event) { a.gcodeRunnerChan <- RunnerCmd{Kind: CmdStop} }},
+	{Name: "start", Help: "cycle start", Do: func(a *App, e key.Event) { a.gcodeRunnerChan <- RunnerCmd{Kind: CmdStart} }},
+	{Name: "unlock", Help: "alarm unlock", Do: func(a *App, e key.Event) { a.AlarmUnlock() }},
+
+	{Name: "edit-x", Help: "set the X work coordinate", Do: func(a *App, e key.Event) { a.xDro.ShowEditor() }},
+	{Name: "edit-y", Help: "set the Y work coordinate", Do: func(a *App, e key.Event) { a.yDro.ShowEditor() }},
+	{Name: "edit-z", Help: "set the Z work coordinate", Do: func(a *App, e key.Event) { a.zDro.ShowEditor() }},
+	{Name: "edit-a", Help: "set the A work coordinate", Do: func(a *App, e key.Event) {
+		if a.gs.Has4thAxis {
+			a.aDro.ShowEditor()
+		}
+	}},
+	{Name: "undo-wco", Help: "undo the last work coordinate change", Do: func(a *App, e key.Event) {
+		if a.canUndo {
+			a.SetWpos(a.gs.Mpos.Sub(a.undoWco))
+		}
+	}},
+
+	{Name: "jog-x-", Help: "jog X-", JogAxis: "X", JogDir: -1},
+	{Name: "jog-x+", Help: "jog X+", JogAxis: "X", JogDir: +1},
+	{Name: "jog-y-", Help: "jog Y-", JogAxis: "Y", JogDir: -1},
+	{Name: "jog-y+", Help: "jog Y+", JogAxis: "Y", JogDir: +1},
+	{Name: "jog-z-", Help: "jog Z-", JogAxis: "Z", JogDir: -1},
+	{Name: "jog-z+", Help: "jog Z+", JogAxis: "Z", JogDir: +1},
+	{Name: "jog-a-", Help: "jog A-", JogAxis: "A", JogDir: -1},
+	{Name: "jog-a+", Help: "jog A+", JogAxis: "A", JogDir: +1},
+
+	{Name: "skip", Help: "skip the line that failed", Do: func(a *App, e key.Event) { a.gcodeRunnerChan <- RunnerCmd{Kind: CmdSkip} }},
+	{Name: "retry", Help: "send the line that failed again", Do: func(a *App, e key.Event) { a.gcodeRunnerChan <- RunnerCmd{Kind: CmdRetry} }},
+	{Name: "abort", Help: "abort the program", Do: func(a *App, e key.Event) { a.gcodeRunnerChan <- RunnerCmd{Kind: CmdAbort} }},
+
+	{Name: "escape", Help: "cancel the running macro, leave the current mode", Do: func(a *App, e key.Event) {
+		a.cancelMacro.Store(true)
+		if a.mode == ModeMDI {
+			a.mdi.Defocus()
+		}
+		if a.mode != ModeRun {
+			a.PopMode()
+		}
+	}},
+	{Name: "text-bigger", Help: "make the text bigger", Do: func(a *App, e key.Event) { a.SetTextSize(a.th.TextSize * 1.1) }},
+	{Name: "text-smaller", Help: "make the text smaller", Do: func(a *App, e key.Event) { a.SetTextSize(a.th.TextSize / 1.1) }},
+	{Name: "text-reset", Help: "reset the text size", Do: func(a *App, e key.Event) { a.SetTextSize(a.InitialTextSize) }},
+	{Name: "cheatsheet", Help: "show/hide this list of keys", Do: func(a *App, e key.Event) { a.showCheatsheet = !a.showCheatsheet }},
+}
+
+func keyActionByName(name string) (KeyAction, bool) {
+	for _, ka := range keyActions {
+		if ka.Name == name {
+			return ka, true
+		}
+	}
+	return KeyAction{}, false
+}
+
+// binds the keys, in key.Set syntax, to the action in each of the modes; an
+// empty Action unbinds the keys
+type KeyBinding struct {
+	Modes  []Mode
+	Keys   string
+	Action string
+	Line   int // line number in keys.conf, or 0 for the defaults
+}
+
+var (
+	keyModesAll     = []Mode{ModeConnect, ModeJog, ModeRun, ModeMDI, ModeNum}
+	keyModesIdle    = []Mode{ModeJog, ModeConnect}
+	keyModesView    = []Mode{ModeJog, ModeRun}
+	keyModesWindows = []Mode{ModeConnect, ModeJog, ModeRun}
+	keyModesJog     = []Mode{ModeJog}
+	keyModesError   = []Mode{ModeError}
+)
+
+// letters are bound with an optional Shift so that they still work while
+// Shift is held for fast jogging
+var DefaultKeymap = []KeyBinding{
+	{keyModesIdle, "(Shift)-[G,M]", "mdi", 0},
+	{keyModesIdle, "(Shift)-O", "open", 0},
+	{keyModesIdle, "(Shift)-Q", "queue", 0},
+	{keyModesIdle, "(Shift)-T", "transform", 0},
+	{keyModesIdle, "(Shift)-N", "array", 0},
+	{keyModesIdle, "(Shift)-K", "simulate", 0},
+	{keyModesIdle, "(Shift)-L", "heightmap", 0},
+	{keyModesIdle, "(Shift)-I", "jog-increment", 0},
+	{keyModesIdle, "(Shift)-F", "jog-feed", 0},
+	{keyModesIdle, "(Shift)-P", "jog-rapid", 0},
+
+	{keyModesView, "1", "view-top", 0},
+	{keyModesView, "2", "view-front", 0},
+	{keyModesView, "3", "view-right", 0},
+	{keyModesView, "4", "view-iso", 0},
+	{keyModesView, "(Shift)-D", "zramp", 0},
+	{keyModesView, "(Shift)-V", "fit-program", 0},
+	{keyModesView, "(Shift)-E", "fit-envelope", 0},
+	{keyModesView, "(Shift)-C", "centre-tool", 0},
+	{keyModesView, "(Shift)-W", "follow", 0},
+	{keyModesView, "(Shift)-B", "measure", 0},
+	{keyModesView, "0", "reset-view", 0},
+	{keyModesView, "(Shift)-H", "hold", 0},
+	{keyModesView, "(Shift)-R", "reset", 0},
+	{keyModesView, "(Shift)-S", "start", 0},
+	{keyModesView, "(Shift)-U", "unlock", 0},
+
+	{keyModesJog, "(Shift)-X", "edit-x", 0},
+	{keyModesJog, "(Shift)-Y", "edit-y", 0},
+	{keyModesJog, "(Shift)-Z", "edit-z", 0},
+	{keyModesJog, "(Shift)-A", "edit-a", 0},
+	{keyModesJog, "Ctrl-Z", "undo-wco", 0},
+	{keyModesJog, "(Shift)-" + key.NameLeftArrow, "jog-x-", 0},
+	{keyModesJog, "(Shift)-" + key.NameRightArrow, "jog-x+", 0},
+	{keyModesJog, "(Shift)-" + key.NameDownArrow, "jog-y-", 0},
+	{keyModesJog, "(Shift)-" + key.NameUpArrow, "jog-y+", 0},
+	{keyModesJog, "(Shift)-" + key.NamePageDown, "jog-z-", 0},
+	{keyModesJog, "(Shift)-" + key.NamePageUp, "jog-z+", 0},
+
+	{keyModesError, "(Shift)-S", "skip", 0},
+	{keyModesError, "(Shift)-R", "retry", 0},
+	{keyModesError, "(Shift)-A|" + key.NameEscape, "abort", 0},
+
+	{keyModesAll, key.NameEscape, "escape", 0},
+	{keyModesAll, "Ctrl-(Shift)-+", "text-bigger", 0},
+	{keyModesAll, "Ctrl--", "text-smaller", 0},
+	{keyModesAll, "Ctrl-0", "text-reset", 0},
+	{keyModesWindows, "(Shift)-?", "cheatsheet", 0},
+}
+
+// a single key with an exact set of modifiers
+type keyChord struct {
+	Mods key.Modifiers
+	Name string
+}
+
+// friendlier names for the keys that Gio names with symbols, for keys.conf
+// and the cheatsheet
+var keyNameAliases = [][2]string{
+	{"Left", key.NameLeftArrow},
+	{"Right", key.NameRightArrow},
+	{"Up", key.NameUpArrow},
+	{"Down", key.NameDownArrow},
+	{"PageUp", key.NamePageUp},
+	{"PageDown", key.NamePageDown},
+	{"Home", key.NameHome},
+	{"End", key.NameEnd},
+	{"Escape", key.NameEscape},
+	{"Return", key.NameReturn},
+	{"Enter", key.NameEnter},
+	{"Backspace", key.NameDeleteBackward},
+	{"Delete", key.NameDeleteForward},
+}
+
+var keyModNames = []struct {
+	Name string
+	Mod  key.Modifiers
+}{
+	{key.NameCtrl, key.ModCtrl},
+	{key.NameCommand, key.ModCommand},
+	{"Cmd", key.ModCommand},
+	{"Short", key.ModShortcut},
+	{key.NameAlt, key.ModAlt},
+	{key.NameSuper, key.ModSuper},
+	{key.NameShift, key.ModShift},
+}
+
+// return every chord matched by keys, which uses key.Set syntax (e.g.
+// "Ctrl-Z", "(Shift)-[G,M]", or "1|2"), with aliases allowed for key names
+func parseKeys(keys string) ([]keyChord, error) {
+	chords := make([]keyChord, 0)
+	for _, expr := range strings.Split(keys, "|") {
+		if expr == "" {
+			return nil, fmt.Errorf("empty key in [%s]", keys)
+		}
+		// the last "-" separates the modifiers from the key, unless the key
+		// is "-" itself
+		modSet, keySet := "", expr
+		if strings.HasSuffix(expr, "--") {
+			modSet, keySet = expr[:len(expr)-2], "-"
+		} else if sep := strings.LastIndex(expr, "-"); sep > 0 {
+			modSet, keySet = expr[:sep], expr[sep+1:]
+		}
+
+		var mods, optional key.Modifiers
+		for _, mod := range strings.Split(modSet, "-") {
+			if mod == "" {
+				continue
+			}
+			opt := len(mod) >= 2 && mod[0] == '(' && mod[len(mod)-1] == ')'
+			if opt {
+				mod = mod[1 : len(mod)-1]
+			}
+			m := key.Modifiers(0)
+			for _, mn := range keyModNames {
+				if strings.EqualFold(mn.Name, mod) {
+					m = mn.Mod
+				}
+			}
+			if m == 0 {
+				return nil, fmt.Errorf("unknown modifier [%s] in [%s]", mod, keys)
+			}
+			if opt {
+				optional |= m
+			} else {
+				mods |= m
+			}
+		}
+
+		names := []string{keySet}
+		if len(keySet) > 2 && keySet[0] == '[' && keySet[len(keySet)-1] == ']' {
+			names = strings.Split(keySet[1:len(keySet)-1], ",")
+		}
+		for _, name := range names {
+			if name == "" {
+				return nil, fmt.Errorf("empty key in [%s]", keys)
+			}
+			for _, alias := range keyNameAliases {
+				if strings.EqualFold(alias[0], name) {
+					name = alias[1]
+				}
+			}
+			if len(name) == 1 {
+				name = strings.ToUpper(name)
+			}
+			// every combination of the optional modifiers
+			for opt := optional; ; opt = (opt - 1) & optional {
+				chords = append(chords, keyChord{Mods: mods | opt, Name: name})
+				if opt == 0 {
+					break
+				}
+			}
+		}
+	}
+	return chords, nil
+}
+
+// the chord in key.Set syntax
+func (c keyChord) String() string {
+	parts := make([]string, 0, 4)
+	for _, mn := range keyModNames {
+		if mn.Name != "Short" && mn.Name != "Cmd" && c.Mods.Contain(mn.Mod) {
+			parts = append(parts, mn.Name)
+		}
+	}
+	return strings.Join(append(parts, c.Name), "-")
+}
+
+// the keys, for people to read: optional modifiers are left out, and keys
+// that Gio names with symbols are given their aliases
+func keysLabel(keys string) string {
+	labels := make([]string, 0)
+	for _, expr := range strings.Split(keys, "|") {
+		mods := make([]string, 0)
+		keySet := expr
+		if strings.HasSuffix(expr, "--") {
+			mods, keySet = strings.Split(expr[:len(expr)-2], "-"), "-"
+		} else if sep := strings.LastIndex(expr, "-"); sep > 0 {
+			mods, keySet = strings.Split(expr[:sep], "-"), expr[sep+1:]
+		}
+		for _, alias := range keyNameAliases {
+			keySet = strings.ReplaceAll(keySet, alias[1], alias[0])
+		}
+		if len(keySet) > 2 && keySet[0] == '[' && keySet[len(keySet)-1] == ']' {
+			keySet = strings.ReplaceAll(keySet[1:len(keySet)-1], ",", "/")
+		}
+		label := ""
+		for _, mod := range mods {
+			if mod != "" && mod[0] != '(' {
+				label += mod + "-"
+			}
+		}
+		labels = append(labels, label+keySet)
+	}
+	return strings.Join(labels, " ")
+}
+
+// the keymap in use: which chord does what in each mode
+type Keymap struct {
+	bindings []KeyBinding
+	chords   map[Mode]map[keyChord]int // index into bindings
+	jog      map[string]KeyAction      // jog actions by key name, in ModeJog
+}
+
+func KeymapFile() string {
+	return filepath.Join(ConfDir(), "keys.conf")
+}
+
+// read keys.conf from the config directory, on top of the default keymap,
+// e.g.:
+//
+//	# jog A with Home and End
+//	jog.Home=jog-a-
+//	jog.End=jog-a+
+//	# open files with Ctrl-O in any mode, and not with O
+//	all.Ctrl-O=open
+//	jog.(Shift)-O=none
+//
+// the part before the "." is the mode (con, jog, run, mdi, num, err, or all),
+// and the key uses the same syntax as macro keys; a binding in keys.conf
+// replaces any default binding of the same key in the same mode; conflicting
+// bindings are reported, and the last one wins
+func ReadKeymap(macros []*Macro) *Keymap {
+	bindings := append([]KeyBinding(nil), DefaultKeymap...)
+
+	filename := KeymapFile()
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "read %s: %v\n", filename, err)
+		}
+		return NewKeymap(bindings, filename, macros)
+	}
+	defer f.Close()
+
+	lineNum := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// the action never contains "=", but the key might
+		eq := strings.LastIndex(line, "=")
+		dot := strings.Index(line, ".")
+		if eq < 0 || dot < 0 || dot > eq {
+			fmt.Fprintf(os.Stderr, "%s:%d: unrecognised line: [%s]\n", filename, lineNum, line)
+			continue
+		}
+		modeName, keys, action := line[:dot], line[dot+1:eq], strings.TrimSpace(line[eq+1:])
+
+		modes := parseKeyModes(modeName)
+		if modes == nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: unrecognised mode: [%s]\n", filename, lineNum, modeName)
+			continue
+		}
+		if _, err := parseKeys(keys); err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: %v\n", filename, lineNum, err)
+			continue
+		}
+		if action == "none" {
+			action = ""
+		} else if _, ok := keyActionByName(action); !ok {
+			fmt.Fprintf(os.Stderr, "%s:%d: unrecognised action: [%s]\n", filename, lineNum, action)
+			continue
+		}
+		bindings = append(bindings, KeyBinding{Modes: modes, Keys: keys, Action: action, Line: lineNum})
+	}
+
+	return NewKeymap(bindings, filename, macros)
+}
+
+func parseKeyModes(name string) []Mode {
+	if strings.EqualFold(name, "all") {
+		return keyModesAll
+	}
+	for m := ModeConnect; m <= ModeError; m++ {
+		if strings.EqualFold(name, m.String()) {
+			return []Mode{m}
+		}
+	}
+	return nil
+}
+
+// build the keymap from the bindings, later ones replacing earlier ones, and
+// report any key that is bound to two different actions in the same mode by
+// the same file, or that is shadowed by a macro
+func NewKeymap(bindings []KeyBinding, filename string, macros []*Macro) *Keymap {
+	k := &Keymap{
+		bindings: bindings,
+		chords:   make(map[Mode]map[keyChord]int),
+		jog:      make(map[string]KeyAction),
+	}
+
+	for i, b := range bindings {
+		chords, err := parseKeys(b.Keys)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "BUG: default keymap: %v\n", err)
+			continue
+		}
+		for _, m := range b.Modes {
+			if k.chords[m] == nil {
+				k.chords[m] = make(map[keyChord]int)
+			}
+			for _, c := range chords {
+				if j, ok := k.chords[m][c]; ok {
+					prev := bindings[j]
+					if prev.Action != b.Action && (prev.Line == 0) == (b.Line == 0) {
+						where := "default keymap"
+						if b.Line > 0 {
+							where = fmt.Sprintf("%s:%d", filename, b.Line)
+						}
+						fmt.Fprintf(os.Stderr, "%s: %s in %s mode is bound to both %s and %s\n", where, c, m, describeKeyAction(prev.Action), describeKeyAction(b.Action))
+					}
+				}
+				k.chords[m][c] = i
+			}
+		}
+	}
+
+	for c, i := range k.chords[ModeJog] {
+		if ka, ok := keyActionByName(bindings[i].Action); ok && ka.JogAxis != "" {
+			k.jog[c.Name] = ka
+		}
+	}
+
+	// macros take priority over the keymap in ModeJog
+	for _, mac := range macros {
+		if mac.Key == "" {
+			continue
+		}
+		chords, err := parseKeys(string(mac.Key))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: macro %s: %v\n", MacroFile(), mac.Name, err)
+			continue
+		}
+		for _, c := range chords {
+			if i, ok := k.chords[ModeJog][c]; ok && bindings[i].Action != "" {
+				fmt.Fprintf(os.Stderr, "%s: macro %s: %s is also bound to %s in %s mode; the macro wins\n", MacroFile(), mac.Name, c, bindings[i].Action, ModeJog)
+			}
+		}
+	}
+
+	return k
+}
+
+func describeKeyAction(action string) string {
+	if action == "" {
+		return "none"
+	}
+	return action
+}
+
+// return the action bound to the key event in the mode
+func (k *Keymap) Action(mode Mode, e key.Event) (KeyAction, bool) {
+	i, ok := k.chords[mode][keyChord{Mods: e.Modifiers, Name: e.Name}]
+	if !ok {
+		return KeyAction{}, false
+	}
+	return keyActionByName(k.bindings[i].Action)
+}
+
+// return the axis and direction that the named key jogs, if any; jogging
+// ignores modifiers, because Shift selects the rapid feed rate
+func (k *Keymap) JogAction(name string) (bool, string, int) {
+	ka, ok := k.jog[name]
+	if !ok {
+		return false, "", 0
+	}
+	return true, ka.JogAxis, ka.JogDir
+}
+
+// return the keys to ask Gio for: every chord in every mode, and Shift on
+// its own for fast jogging
+func (k *Keymap) KeySet() []string {
+	seen := make(map[string]bool)
+	keys := []string{key.NameShift}
+	for _, chords := range k.chords {
+		for c, i := range chords {
+			s := c.String()
+			if k.bindings[i].Action != "" && !seen[s] {
+				seen[s] = true
+				keys = append(keys, s)
+			}
+		}
+	}
+	sort.Strings(keys[1:])
+	return keys
+}
+
+// return the label for the keys bound to the action in the mode, e.g. "S",
+// or "" if it has no keys
+func (k *Keymap) KeysFor(mode Mode, action string) string {
+	for _, row := range k.Cheatsheet(mode) {
+		if row[1] == action {
+			return row[0]
+		}
+	}
+	return ""
+}
+
+// return the keys and the action for each binding that is still in effect
+// in the mode, in the order of the keymap
+func (k *Keymap) Cheatsheet(mode Mode) [][2]string {
+	rows := make([][2]string, 0)
+	for i, b := range k.bindings {
+		if b.Action == "" {
+			continue
+		}
+		live := false
+		for _, j := range k.chords[mode] {
+			if j == i {
+				live = true
+			}
+		}
+		if !live {
+			continue
+		}
+		// merge with an earlier binding of the same action
+		merged := false
+		for r := range rows {
+			if rows[r][1] == b.Action {
+				rows[r][0] += " " + keysLabel(b.Keys)
+				merged = true
+			}
+		}
+		if !merged {
+			rows = append(rows, [2]string{keysLabel(b.Keys), b.Action})
+		}
+	}
+	return rows
+}
+
+// draw the keys for the current mode on top of everything else, if the
+// cheatsheet is open
+func (a *App) LayoutCheatsheet(gtx C) D {
+	if !a.showCheatsheet {
+		return D{}
+	}
+	rows := a.keymap.Cheatsheet(a.mode)
+
+	macro := op.Record(gtx.Ops)
+
+	// dim the rest of the screen
+	paint.Fill(gtx.Ops, rgba(0, 0, 0, 200))
+
+	gtx.Constraints.Min = gtx.Constraints.Max
+	layout.Center.Layout(gtx, func(gtx C) D {
+		gtx.Constraints.Min.X = 0
+		gtx.Constraints.Min.Y = 0
+		gtx.Constraints.Max.Y = gtx.Constraints.Max.Y * 9 / 10
+		return Panel{Width: 1, CornerRadius: 5, Color: grey(128), BackgroundColor: grey(32), Padding: layout.UniformInset(10)}.Layout(gtx, func(gtx C) D {
+			return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+				layout.Rigid(material.H5(a.th, fmt.Sprintf("Keys in %s mode", a.mode)).Layout),
+				layout.Rigid(layout.Spacer{Height: 5}.Layout),
+				layout.Flexed(1, func(gtx C) D {
+					keyWidth := gtx.Dp(160)
+					return material.List(a.th, &a.cheatList).Layout(gtx, len(rows), func(gtx C, i int) D {
+						ka, _ := keyActionByName(rows[i][1])
+						return layout.Flex{}.Layout(gtx,
+							layout.Rigid(func(gtx C) D {
+								gtx.Constraints.Min.X = keyWidth
+								gtx.Constraints.Max.X = keyWidth
+								lbl := material.Body1(a.th, rows[i][0])
+								lbl.Color = rgb(255, 255, 0)
+								return lbl.Layout(gtx)
+							}),
+							layout.Rigid(material.Body1(a.th, ka.Help).Layout),
+						)
+					})
+				}),
+			)
+		})
+	})
+
+	op.Defer(gtx.Ops, macro.Stop())
+
+	return D{}
+}
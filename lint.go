@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"math"
+	"strings"
+	"sync/atomic"
+
+	"gioui.org/layout"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+)
+
+const (
+	grblLineLength = 79   // longest line Grbl accepts, not counting spaces and comments
+	grblMaxTool    = 255  // highest tool number Grbl accepts
+	maxLintIssues  = 1000 // stop linting after this many issues
+)
+
+// a problem found in a program before running it
+type LintIssue struct {
+	Line  int  // index into the program
+	Error bool // true if Grbl will reject the line, false if it's just suspicious
+	Msg   string
+}
+
+func (i LintIssue) String() string {
+	kind := "warning"
+	if i.Error {
+		kind = "error"
+	}
+	return fmt.Sprintf("line %d: %s: %s", i.Line+1, kind, i.Msg)
+}
+
+// the issues found in a program
+type LintResult struct {
+	Program *Program
+	Issues  []LintIssue
+	Lines   map[int]bool // lines with issues, true if any of them is an error
+	More    bool         // true if there were more than maxLintIssues
+}
+
+// modal groups of the G and M codes that Grbl supports, see
+// https://github.com/gnea/grbl/wiki/Grbl-v1.1-Commands
+var grblModalGroups = map[string][]float64{
+	"motion":           {0, 1, 2, 3, 38.2, 38.3, 38.4, 38.5, 80},
+	"plane":            {17, 18, 19},
+	"distance":         {90, 91},
+	"arc distance":     {91.1},
+	"feed rate mode":   {93, 94},
+	"units":            {20, 21},
+	"cutter radius":    {40},
+	"tool length":      {43.1, 49},
+	"coordinate":       {54, 55, 56, 57, 58, 59},
+	"control":          {61},
+	"non-modal":        {4, 10, 28, 28.1, 30, 30.1, 53, 92, 92.1},
+	"stopping":         {0, 1, 2, 30},
+	"spindle":          {3, 4, 5},
+	"coolant":          {7, 8, 9},
+	"parking override": {56},
+}
+
+// G codes with more specific explanations than "unsupported"
+var grblUnsupportedG = map[float64]string{
+	41:   "cutter radius compensation (G41) isn't supported by Grbl",
+	42:   "cutter radius compensation (G42) isn't supported by Grbl",
+	43:   "tool length offset G43 isn't supported by Grbl, only G43.1",
+	64:   "path blending (G64) isn't supported by Grbl",
+	81:   "canned cycles (G81) aren't supported by Grbl",
+	82:   "canned cycles (G82) aren't supported by Grbl",
+	83:   "canned cycles (G83) aren't supported by Grbl",
+	98:   "G98 isn't supported by Grbl",
+	99:   "G99 isn't supported by Grbl",
+	40.1: "G40.1 isn't supported by Grbl",
+}
+
+// return the modal group of a G ("G") or M ("M") code, or "" if Grbl doesn't
+// support it
+func grblModalGroup(letter string, value float64) string {
+	for group, values := range grblModalGroups {
+		isM := group == "stopping" || group == "spindle" || group == "coolant" || group == "parking override"
+		if isM != (letter == "M") {
+			continue
+		}
+		for _, v := range values {
+			if math.Abs(v-value) < 0.0001 {
+				return group
+			}
+		}
+	}
+	return ""
+}
+
+// modal state tracked while linting a program
+type lintState struct {
+	motion       float64
+	feedSet      bool
+	inverseTime  bool
+	incremental  bool
+	units        float64 // 20 or 21, or 0 if not given yet
+	warnedFeed   bool
+	warnedG91    bool
+	warnedUnits  bool
+	warnedInches bool
+	warnedAxis   bool
+}
+
+// check the program for things Grbl will reject, or that look like mistakes;
+// gives up early (returning nil) if cancelled() returns true
+func LintProgram(p *Program, cancelled func() bool) *LintResult {
+	res := &LintResult{Program: p, Lines: make(map[int]bool)}
+	var perr *ProgramError
+	if errors.As(p.ExpandErr, &perr) {
+		// the program couldn't be expanded, so this is the one that matters
+		res.Issues = append(res.Issues, LintIssue{Line: perr.Line, Error: true, Msg: perr.Msg})
+		res.Lines[perr.Line] = true
+	}
+	st := lintState{}
+	p.Each(func(i int, str string) bool {
+		if i%programBlockLines == 0 && cancelled() {
+			res = nil
+			return false
+		}
+		for _, issue := range st.lintLine(i, str) {
+			if len(res.Issues) >= maxLintIssues {
+				res.More = true
+				return false
+			}
+			res.Issues = append(res.Issues, issue)
+			res.Lines[i] = res.Lines[i] || issue.Error
+		}
+		return true
+	})
+	return res
+}
+
+func (st *lintState) lintLine(i int, str string) []LintIssue {
+	issues := make([]LintIssue, 0)
+	add := func(isError bool, format string, args ...interface{}) {
+		issues = append(issues, LintIssue{Line: i, Error: isError, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(str), "$") {
+		// Grbl system command
+		return issues
+	}
+	line, err := ParseWords(str)
+	if err != nil {
+		add(true, "%v", err)
+		return issues
+	}
+
+	// Grbl throws away spaces and comments before it checks the length
+	length := len(strings.Join(strings.Fields(stripComments(str)), ""))
+	if length > grblLineLength {
+		add(true, "line is %d characters long without spaces and comments; Grbl's limit is %d", length, grblLineLength)
+	}
+
+	groups := make(map[string]string) // modal group -> word
+	letters := make(map[string]bool)
+	hasAxis := false
+	usesAxes := "" // non-modal G code that uses the axis words, if any
+	motion := ""   // motion G code given on this line, if any
+	for _, c := range line.Codes {
+		if c.Comment != "" {
+			continue
+		}
+		word := c.String()
+		if c.Letter == "G" || c.Letter == "M" {
+			group := grblModalGroup(c.Letter, c.Value)
+			if group == "" {
+				if msg, ok := grblUnsupportedG[c.Value]; ok && c.Letter == "G" {
+					add(true, "%s", msg)
+				} else if c.Letter == "M" && c.Value == 6 {
+					add(true, "tool change (M6) isn't supported by Grbl; change the tool by hand, e.g. after M0")
+				} else {
+					add(true, "%s isn't supported by Grbl", word)
+				}
+				continue
+			}
+			if other, ok := groups[group]; ok {
+				add(true, "%s and %s are both in the %s modal group", other, word, group)
+			}
+			groups[group] = word
+
+			if c.Letter == "G" {
+				if group == "motion" {
+					motion = word
+					st.motion = c.Value
+				} else if c.Value == 10 || c.Value == 28 || c.Value == 30 || c.Value == 92 {
+					usesAxes = word
+				} else if c.Value == 93 {
+					st.inverseTime = true
+				} else if c.Value == 94 {
+					st.inverseTime = false
+				} else if c.Value == 90 {
+					st.incremental = false
+				} else if c.Value == 91 {
+					st.incremental = true
+				} else if c.Value == 20 || c.Value == 21 {
+					if st.units != 0 && st.units != c.Value && !st.warnedUnits {
+						add(false, "units change from G%.0f to G%.0f part way through the program", st.units, c.Value)
+						st.warnedUnits = true
+					}
+					st.units = c.Value
+				}
+			}
+			continue
+		}
+
+		if letters[c.Letter] {
+			add(true, "%s word is given more than once", c.Letter)
+		}
+		letters[c.Letter] = true
+
+		if c.Letter == "X" || c.Letter == "Y" || c.Letter == "Z" {
+			hasAxis = true
+		} else if c.Letter == "A" || c.Letter == "B" || c.Letter == "C" {
+			hasAxis = true
+			if !st.warnedAxis {
+				add(false, "%s axis is only supported by some builds of Grbl", c.Letter)
+				st.warnedAxis = true
+			}
+		} else if c.Letter == "T" {
+			if c.Value > grblMaxTool || c.Value < 0 || c.Value != math.Floor(c.Value) {
+				add(true, "tool number %s is out of range; Grbl accepts 0 to %d", formatNumber(c.Value), grblMaxTool)
+			}
+		} else if c.Letter == "F" {
+			st.feedSet = true
+		} else if c.Letter == "H" || c.Letter == "D" {
+			add(true, "%s words (tool offsets) aren't supported by Grbl", c.Letter)
+		} else if !strings.Contains("IJKLNPRS", c.Letter) {
+			add(true, "%s words aren't supported by Grbl", c.Letter)
+		}
+	}
+
+	if motion != "" && usesAxes != "" && hasAxis {
+		add(true, "%s and %s both use the axis words", motion, usesAxes)
+	}
+
+	if hasAxis && usesAxes == "" && groups["non-modal"] != "G53" {
+		feedMove := st.motion == 1 || st.motion == 2 || st.motion == 3
+		if feedMove && (!st.feedSet || st.inverseTime) && !letters["F"] && !st.warnedFeed {
+			add(true, "feed move without a feed rate (F word)")
+			st.warnedFeed = true
+		}
+		if st.incremental && !st.warnedG91 {
+			add(false, "incremental (G91) moves; check that this is intended, and that G90 is restored")
+			st.warnedG91 = true
+		}
+		if st.units == 20 && !st.warnedInches {
+			add(false, "program is in inches (G20)")
+			st.warnedInches = true
+		}
+	}
+
+	return issues
+}
+
+// lints programs in the background when they're loaded, and shows the
+// issues in a list that jumps to the line in the G-code view when clicked
+type LintPanel struct {
+	app         *App
+	wantProgram atomic.Pointer[Program]
+	result      atomic.Pointer[LintResult]
+	hidden      *Program // the program whose issues the user has hidden
+	scrolled    *Program // the program whose expansion error we've scrolled to
+
+	list    widget.List
+	btns    []widget.Clickable
+	hideBtn widget.Clickable
+}
+
+func NewLintPanel(app *App) *LintPanel {
+	lp := &LintPanel{app: app}
+	lp.list.Axis = layout.Vertical
+	return lp
+}
+
+// lint p in the background; called by the runner whenever a program is loaded
+func (lp *LintPanel) Start(p *Program) {
+	if p == nil || lp.wantProgram.Swap(p) == p {
+		return
+	}
+	go func() {
+		res := LintProgram(p, func() bool {
+			return lp.wantProgram.Load() != p
+		})
+		if res == nil {
+			return
+		}
+		lp.result.Store(res)
+		lp.app.w.Invalidate()
+	}()
+}
+
+// return the issues for the given program, or nil if it hasn't been linted
+func (lp *LintPanel) Result(p *Program) *LintResult {
+	res := lp.result.Load()
+	if res == nil || res.Program != p {
+		return nil
+	}
+	return res
+}
+
+func (lp *LintPanel) Layout(gtx C) D {
+	prog := lp.app.rs.Program
+	res := lp.Result(prog)
+	if res == nil || len(res.Issues) == 0 || lp.hidden == prog {
+		return D{}
+	}
+	if prog.ExpandErr != nil && lp.scrolled != prog {
+		// show where the expansion failed, which is always the first issue
+		lp.scrolled = prog
+		lp.app.ScrollGCodeTo(res.Issues[0].Line)
+	}
+
+	for lp.hideBtn.Clicked(gtx) {
+		lp.hidden = prog
+	}
+	if len(lp.btns) < len(res.Issues) {
+		lp.btns = make([]widget.Clickable, len(res.Issues))
+	}
+	for i := range res.Issues {
+		for lp.btns[i].Clicked(gtx) {
+			lp.app.ScrollGCodeTo(res.Issues[i].Line)
+		}
+	}
+
+	nErrors := 0
+	for _, issue := range res.Issues {
+		if issue.Error {
+			nErrors++
+		}
+	}
+	title := fmt.Sprintf("%d errors, %d warnings", nErrors, len(res.Issues)-nErrors)
+	if res.More {
+		title += " (stopped checking)"
+	}
+
+	return Panel{Width: 1, CornerRadius: 5, Color: grey(128), BackgroundColor: grey(16), Margin: layout.UniformInset(5), Padding: layout.UniformInset(5)}.Layout(gtx, func(gtx C) D {
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+			layout.Rigid(func(gtx C) D {
+				return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx,
+					material.H6(lp.app.th, "Lint ").Layout,
+					material.Body1(lp.app.th, title).Layout,
+					material.Button(lp.app.th, &lp.hideBtn, "HIDE").Layout,
+				)
+			}),
+			layout.Rigid(func(gtx C) D {
+				// show a handful of issues at a time
+				maxY := gtx.Dp(120)
+				if gtx.Constraints.Max.Y > maxY {
+					gtx.Constraints.Max.Y = maxY
+				}
+				return material.List(lp.app.th, &lp.list).Layout(gtx, len(res.Issues), func(gtx C, i int) D {
+					issue := res.Issues[i]
+					return material.Clickable(gtx, &lp.btns[i], func(gtx C) D {
+						label := material.Body1(lp.app.th, issue.String())
+						label.Color = lintColour(issue.Error)
+						return label.Layout(gtx)
+					})
+				})
+			}),
+		)
+	})
+}
+
+func lintColour(isError bool) color.NRGBA {
+	if isError {
+		return rgb(255, 128, 128)
+	}
+	return rgb(255, 200, 100)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gioui.org/io/key"
+	"gioui.org/layout"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+)
+
+// a macro is a named list of steps, read from macros.conf in the config
+// directory, e.g.:
+//
+//	macro=Probe Z
+//	key=Shift-F1
+//	button=PROBE Z
+//	send=G38.2 Z-20 F100
+//	wait=idle
+//	send=G10 L20 P1 Z{15.0}
+//	send=G0 Z{wpos.z + 5}
+//
+// "send" lines can be G-code or "$" commands, and go through the normal Grbl
+// command queue; the macro stops if Grbl responds with anything other than
+// "ok"; "realtime" sends a realtime byte, either a single character ("!") or
+// a number ("0x85"); "wait" waits for "idle", for "probe" (the probe input
+// to trigger), or for a number of seconds
+//
+// expressions in {braces} are evaluated when the step runs, and can use
+// wpos.x, mpos.x, wco.x (and .y, .z, .a), inc, feed, and rapid
+type Macro struct {
+	Name   string
+	Key    key.Set // e.g. "F1" or "Ctrl-M", or "" if not bound to a key
+	Button string  // toolbar button label, or "" for no button
+	Steps  []MacroStep
+
+	btn widget.Clickable
+}
+
+type MacroStep struct {
+	Kind  string // "send", "realtime", or "wait"
+	Value string
+}
+
+var macroExprRe = regexp.MustCompile(`\{([^}]*)\}`)
+var macroVarRe = regexp.MustCompile(`[a-z][a-z.]*`)
+
+func MacroFile() string {
+	return filepath.Join(ConfDir(), "macros.conf")
+}
+
+// read the macros from the config directory
+func ReadMacros() []*Macro {
+	macros := make([]*Macro, 0)
+
+	filename := MacroFile()
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "read %s: %v\n", filename, err)
+		}
+		return macros
+	}
+	defer f.Close()
+
+	var m *Macro
+	lineNum := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			fmt.Fprintf(os.Stderr, "%s:%d: unrecognised line: [%s]\n", filename, lineNum, line)
+			continue
+		}
+		name := parts[0]
+		val := parts[1]
+
+		if name == "macro" {
+			m = &Macro{Name: val}
+			macros = append(macros, m)
+			continue
+		}
+		if m == nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: [%s] before first macro=\n", filename, lineNum, line)
+			continue
+		}
+
+		if name == "key" {
+			m.Key = key.Set(val)
+		} else if name == "button" {
+			m.Button = val
+		} else if name == "send" {
+			m.Steps = append(m.Steps, MacroStep{Kind: name, Value: val})
+		} else if name == "realtime" {
+			if _, ok := parseRealtime(val); !ok {
+				fmt.Fprintf(os.Stderr, "%s:%d: bad realtime byte: [%s]\n", filename, lineNum, val)
+				continue
+			}
+			m.Steps = append(m.Steps, MacroStep{Kind: name, Value: val})
+		} else if name == "wait" {
+			if _, err := strconv.ParseFloat(val, 64); err != nil && val != "idle" && val != "probe" {
+				fmt.Fprintf(os.Stderr, "%s:%d: bad wait: [%s]\n", filename, lineNum, val)
+				continue
+			}
+			m.Steps = append(m.Steps, MacroStep{Kind: name, Value: val})
+		} else {
+			fmt.Fprintf(os.Stderr, "%s:%d: unrecognised macro key: [%s]\n", filename, lineNum, name)
+		}
+	}
+
+	return macros
+}
+
+// parse a realtime byte, given either as a single character or a number
+func parseRealtime(val string) (byte, bool) {
+	if len(val) == 1 {
+		return val[0], true
+	}
+	n, err := strconv.ParseUint(val, 0, 8)
+	if err != nil {
+		return 0, false
+	}
+	return byte(n), true
+}
+
+// return the macro bound to the given key, if any
+func (a *App) MacroForKey(e key.Event) *Macro {
+	for _, m := range a.macros {
+		if m.Key != "" && m.Key.Contains(e.Name, e.Modifiers) {
+			return m
+		}
+	}
+	return nil
+}
+
+// start running the macro in the background, unless a macro or program is
+// already running
+func (a *App) RunMacro(m *Macro) {
+	if a.rs.Running {
+		fmt.Fprintf(os.Stderr, "can't run macro %s while a program is running\n", m.Name)
+		return
+	}
+	if !a.runningMacro.CompareAndSwap(nil, m) {
+		fmt.Fprintf(os.Stderr, "can't run macro %s while %s is running\n", m.Name, a.runningMacro.Load().Name)
+		return
+	}
+	a.cancelMacro.Store(false)
+	a.w.Invalidate()
+
+	go func() {
+		defer func() {
+			a.runningMacro.Store(nil)
+			a.w.Invalidate()
+		}()
+
+		for i, step := range m.Steps {
+			if a.cancelMacro.Load() {
+				fmt.Fprintf(os.Stderr, "macro %s: cancelled\n", m.Name)
+				return
+			}
+			err := a.RunMacroStep(step)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "macro %s: step %d (%s=%s): %v\n", m.Name, i+1, step.Kind, step.Value, err)
+				return
+			}
+		}
+	}()
+}
+
+func (a *App) RunMacroStep(step MacroStep) error {
+	if step.Kind == "send" {
+		line, err := a.ExpandMacroLine(step.Value)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("macro> [%s]\n", line)
+		ok, resp := a.g.CommandWait(line)
+		if !ok {
+			return fmt.Errorf("can't send [%s]", line)
+		}
+		if resp != "ok" {
+			return fmt.Errorf("[%s]: %s", line, resp)
+		}
+	} else if step.Kind == "realtime" {
+		b, _ := parseRealtime(step.Value)
+		if !a.g.CommandRealtime(b) {
+			return fmt.Errorf("can't send realtime byte 0x%02x", b)
+		}
+	} else if step.Kind == "wait" {
+		if step.Value == "idle" {
+			// G4 P0 isn't acknowledged until all motion before it is complete
+			ok, resp := a.g.CommandWait("G4 P0")
+			if !ok || resp != "ok" {
+				return fmt.Errorf("can't wait for idle: %s", resp)
+			}
+			return a.waitFor(func(gs GrblStatus) bool { return gs.Status == "Idle" })
+		} else if step.Value == "probe" {
+			return a.waitFor(func(gs GrblStatus) bool { return gs.Probe })
+		} else {
+			secs, _ := strconv.ParseFloat(step.Value, 64)
+			deadline := time.Now().Add(time.Duration(secs * float64(time.Second)))
+			return a.waitFor(func(gs GrblStatus) bool { return time.Now().After(deadline) })
+		}
+	}
+	return nil
+}
+
+// poll the Grbl status until cond returns true, or the macro is cancelled
+func (a *App) waitFor(cond func(GrblStatus) bool) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		gs := a.LatestStatus()
+		if cond(gs) {
+			return nil
+		}
+		if gs.Status == "Alarm" || gs.Closed {
+			return fmt.Errorf("status is %s", gs.Status)
+		}
+		if a.cancelMacro.Load() {
+			return fmt.Errorf("cancelled")
+		}
+		<-ticker.C
+	}
+}
+
+// return the line with each {expression} replaced by its value
+func (a *App) ExpandMacroLine(line string) (string, error) {
+	gs := a.LatestStatus()
+	vars := make(map[string]float64)
+	for _, v := range []struct {
+		name string
+		pos  V4d
+	}{{"wpos", gs.Wpos}, {"mpos", gs.Mpos}, {"wco", gs.Wco}} {
+		vars[v.name+".x"] = v.pos.X
+		vars[v.name+".y"] = v.pos.Y
+		vars[v.name+".z"] = v.pos.Z
+		vars[v.name+".a"] = v.pos.A
+	}
+	vars["inc"] = a.jog.Increment
+	vars["feed"] = a.jog.FeedRate
+	vars["rapid"] = a.jog.RapidFeedRate
+
+	var exprErr error
+	expanded := macroExprRe.ReplaceAllStringFunc(line, func(s string) string {
+		expr := strings.ToLower(s[1 : len(s)-1])
+		expr = macroVarRe.ReplaceAllStringFunc(expr, func(name string) string {
+			val, ok := vars[name]
+			if !ok {
+				if isEvalFunction(name, macroFunctions) {
+					return name
+				}
+				exprErr = fmt.Errorf("unknown variable: %s", name)
+				return name
+			}
+			return fmt.Sprintf("(%f)", val)
+		})
+		val, ok := eval(expr)
+		if !ok {
+			exprErr = fmt.Errorf("can't evaluate %s", s)
+		}
+		return fmt.Sprintf("%.3f", val)
+	})
+	if exprErr != nil {
+		return "", exprErr
+	}
+	return expanded, nil
+}
+
+// functions understood by evaler, which look like variable names
+var macroFunctions = []string{"sin", "cos", "tan", "ln", "arcsin", "arccos", "arctan", "sqrt"}
+
+// true if name is one of funcs, which is macroFunctions for macro
+// expressions or exprFunctions for G-code expressions
+func isEvalFunction(name string, funcs []string) bool {
+	for _, f := range funcs {
+		if name == f {
+			return true
+		}
+	}
+	return false
+}
+
+// toolbar buttons for macros that have them
+func (a *App) LayoutMacroButtons(gtx C) D {
+	btns := make([]layout.Widget, 0)
+	for _, m := range a.macros {
+		if m.Button == "" {
+			continue
+		}
+		for m.btn.Clicked(gtx) {
+			a.RunMacro(m)
+		}
+		btns = append(btns, material.Button(a.th, &m.btn, m.Button).Layout)
+	}
+	if len(btns) == 0 {
+		return D{}
+	}
+	return Toolbar{Inset: layout.UniformInset(5)}.Layout(gtx, btns...)
+}
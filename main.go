@@ -15,6 +15,7 @@ type (
 
 func usage(rc int) {
 	fmt.Fprintf(os.Stderr, `usage: pugsender [option]
+       pugsender render <in.nc> <out.png|out.svg> [--size WxH] [--view top|front|right|iso]
 
 options:
         <device>  Connect to Grbl at <device> (e.g. "/dev/ttyUSB0").
@@ -29,6 +30,11 @@ https://github.com/jes/pugsender
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		// draw a preview image and exit, without opening a window
+		os.Exit(RenderCommand(os.Args[2:]))
+	}
+
 	a := NewApp()
 	go a.ReadConf()
 
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"image"
+	"math"
+
+	"gioui.org/op"
+	"gioui.org/widget/material"
+	"github.com/llgcode/draw2d/draw2dimg"
+)
+
+const markerRadiusPx = 6
+
+// a labelled point in machine coordinates: a work origin, or a stored
+// G28/G30 position
+type Marker struct {
+	Label  string
+	Pos    V4d
+	Origin bool // a work origin rather than a stored position
+	Active bool // the work coordinate system in use
+}
+
+// return the markers to draw for the offsets in the view options, with any
+// that are in the same place merged into one
+func (p PathOpts) Markers() []Marker {
+	if !p.haveOffsets {
+		return nil
+	}
+	all := make([]Marker, 0, 8)
+	for i, offset := range p.offsets {
+		all = append(all, Marker{Label: "G5" + string(rune('4'+i)), Pos: offset, Origin: true, Active: i == p.activeWCS})
+	}
+	all = append(all, Marker{Label: "G28", Pos: p.g28}, Marker{Label: "G30", Pos: p.g30})
+
+	markers := make([]Marker, 0, len(all))
+	for _, m := range all {
+		merged := false
+		for k := range markers {
+			if markers[k].Pos.Sub(m.Pos).Length() < 0.001 && markers[k].Origin == m.Origin {
+				markers[k].Label += " " + m.Label
+				markers[k].Active = markers[k].Active || m.Active
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			markers = append(markers, m)
+		}
+	}
+	return markers
+}
+
+// draw a circle with a cross for each work origin, brighter and with a
+// second ring for the active one, and a diamond for each stored position
+func (p *Path) DrawMarkers(gc *draw2dimg.GraphicContext) {
+	for _, m := range p.Markers() {
+		x, y := p.Project(m.Pos)
+		r := float64(markerRadiusPx)
+		if !m.Origin {
+			gc.SetStrokeColor(rgb(160, 0, 160))
+			gc.MoveTo(x, y-r)
+			gc.LineTo(x+r, y)
+			gc.LineTo(x, y+r)
+			gc.LineTo(x-r, y)
+			gc.Close()
+			gc.Stroke()
+			continue
+		}
+		col := grey(128)
+		if m.Active {
+			col = rgb(255, 255, 0)
+		}
+		gc.SetStrokeColor(col)
+		p.DrawCrossHair(gc, x, y, r)
+		gc.MoveTo(x-r*1.5, y)
+		gc.LineTo(x+r*1.5, y)
+		gc.MoveTo(x, y-r*1.5)
+		gc.LineTo(x, y+r*1.5)
+		gc.Stroke()
+		if m.Active {
+			p.DrawCrossHair(gc, x, y, r*1.6)
+		}
+	}
+}
+
+// label the markers drawn by DrawMarkers(); labels are drawn with Gio rather
+// than draw2d so that we don't need to load fonts into draw2d
+func (tp *ToolpathView) LayoutMarkerLabels(gtx C) {
+	if !tp.opts.showOffsets {
+		return
+	}
+	gtx.Constraints.Min = image.Point{}
+	for _, m := range tp.opts.Markers() {
+		x, y := tp.opts.Project(m.Pos)
+		if x < 0 || y < 0 || x >= float64(tp.opts.widthPx) || y >= float64(tp.opts.heightPx) {
+			continue
+		}
+		col := grey(160)
+		if m.Active {
+			col = rgb(255, 255, 0)
+		} else if !m.Origin {
+			col = rgb(192, 64, 192)
+		}
+		lbl := material.Caption(tp.app.th, m.Label)
+		lbl.Color = col
+		off := image.Pt(int(math.Round(x))+markerRadiusPx*2, int(math.Round(y))+markerRadiusPx)
+		stack := op.Offset(off).Push(gtx.Ops)
+		lbl.Layout(gtx)
+		stack.Pop()
+	}
+}
+
+// show or hide the machine travel
+func (tp *ToolpathView) ToggleEnvelope() {
+	tp.opts.showEnvelope = !tp.opts.showEnvelope
+}
+
+// show or hide the work origins and the G28/G30 positions
+func (tp *ToolpathView) ToggleOffsets() {
+	tp.opts.showOffsets = !tp.opts.showOffsets
+}
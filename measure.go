@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+
+	"gioui.org/f32"
+	"gioui.org/op/clip"
+	"gioui.org/op/paint"
+)
+
+const snapRadiusPx = 10 // how close the mouse has to be to a vertex to snap to it
+
+// the state of the measuring tool; points are in work coordinates
+type Measure struct {
+	Active  bool
+	Points  []V4d // the first and second points clicked, if any
+	Hover   V4d   // the point a click would add
+	Snapped bool  // Hover is a vertex or midpoint of the toolpath
+	HasHov  bool  // there's a point under the mouse to measure to
+	Segment string
+}
+
+// return the vertex or segment midpoint nearest to the view space point,
+// if there is one within r, in the coordinates of the segments
+func (idx *SegmentIndex) Snap(p V4d, r float64, opts PathOpts) (V4d, bool) {
+	if idx.cells == nil {
+		return V4d{}, false
+	}
+	x0, y0 := idx.cell(p.X-r, p.Y-r)
+	x1, y1 := idx.cell(p.X+r, p.Y+r)
+	best, bestDist := V4d{}, math.Inf(1)
+	for y := y0; y <= y1; y++ {
+		for x := x0; x <= x1; x++ {
+			for _, i := range idx.cells[y*idx.nx+x] {
+				seg := idx.segments[i]
+				for _, pt := range []V4d{seg.Start, seg.End, seg.Start.Add(seg.End).Mul(0.5)} {
+					v := opts.ViewPos(pt)
+					if d := math.Hypot(v.X-p.X, v.Y-p.Y); d < bestDist {
+						best, bestDist = pt, d
+					}
+				}
+			}
+		}
+	}
+	return best, bestDist <= r
+}
+
+// turn measuring on or off, forgetting any points
+func (tp *ToolpathView) ToggleMeasure() {
+	tp.measure = Measure{Active: !tp.measure.Active}
+}
+
+// update the point that a click at the pixel would measure to: a vertex or
+// midpoint of the toolpath if one is close, otherwise the point under the
+// mouse in the top view
+func (tp *ToolpathView) MeasureHover(px, py float64) {
+	m := &tp.measure
+	m.HasHov, m.Snapped = false, false
+	if len(tp.segments) > 0 {
+		if pt, ok := tp.segmentIndex().Snap(tp.viewPoint(px, py), snapRadiusPx/tp.opts.pxPerMm, tp.opts); ok {
+			m.Hover, m.Snapped, m.HasHov = pt, true, true
+			return
+		}
+	}
+	if tp.opts.IsTop() {
+		x, y := tp.opts.PxToMm(px, py)
+		m.Hover = V4d{X: x - tp.app.gs.Wco.X, Y: y - tp.app.gs.Wco.Y}
+		m.HasHov = true
+	}
+}
+
+// add the hovered point to the measurement, starting again after two points
+func (tp *ToolpathView) MeasureClick(px, py float64) {
+	m := &tp.measure
+	tp.MeasureHover(px, py)
+	if !m.HasHov {
+		return
+	}
+	if len(m.Points) >= 2 {
+		m.Points = m.Points[:0]
+	}
+	m.Points = append(m.Points, m.Hover)
+	m.Segment = ""
+}
+
+// measure the move of the line drawn at the pixel: its length, and the
+// radius if it's an arc
+func (tp *ToolpathView) MeasureSegment(px, py float64) {
+	m := &tp.measure
+	line, ok := tp.PickLine(px, py)
+	if !ok {
+		m.Segment = ""
+		return
+	}
+	start, end := segmentsForLine(tp.segments, line)
+	segs := tp.segments[start:end]
+	length := 0.0
+	for _, seg := range segs {
+		length += seg.Length()
+	}
+	m.Segment = fmt.Sprintf("line %d: %s, length %.03f", line+1, segs[0].Kind, length)
+	if r, ok := arcRadius(segs); ok {
+		m.Segment += fmt.Sprintf(", radius %.03f", r)
+	}
+	m.Points = m.Points[:0]
+}
+
+// return the radius of the arc that segs are the pieces of, or false if
+// they aren't an arc
+func arcRadius(segs []Segment) (float64, bool) {
+	n := len(segs)
+	if n < 2 || segs[0].Kind != SegmentArc {
+		return 0, false
+	}
+	// use points a third and two thirds of the way round rather than the
+	// end, which is the same as the start on a full circle
+	vertex := func(k int) V4d {
+		if k == n {
+			return segs[n-1].End
+		}
+		return segs[k].Start
+	}
+	k1 := max(n/3, 1)
+	k2 := max(2*n/3, k1+1)
+	return circumradius(vertex(0), vertex(k1), vertex(k2))
+}
+
+// return the radius of the circle through the three points, or false if
+// they're in a line
+func circumradius(a, b, c V4d) (float64, bool) {
+	u, v := b.Sub(a), c.Sub(a)
+	u.A, v.A = 0, 0
+	cross := V4d{X: u.Y*v.Z - u.Z*v.Y, Y: u.Z*v.X - u.X*v.Z, Z: u.X*v.Y - u.Y*v.X}
+	if cross.Length() < 1e-9 {
+		return 0, false
+	}
+	return u.Length() * v.Length() * u.Sub(v).Length() / (2 * cross.Length()), true
+}
+
+// describe the measurement for the readout, or "" if there's nothing to show
+func (tp *ToolpathView) MeasureText() string {
+	m := tp.measure
+	if !m.Active {
+		return ""
+	}
+	if m.Segment != "" {
+		return m.Segment
+	}
+	var a, b V4d
+	if len(m.Points) == 2 {
+		a, b = m.Points[0], m.Points[1]
+	} else if len(m.Points) == 1 && m.HasHov {
+		a, b = m.Points[0], m.Hover
+	} else {
+		return "measure: click two points, ctrl-click a move"
+	}
+	d := b.Sub(a)
+	d.A = 0
+	angle := math.Atan2(d.Y, d.X) * 180 / math.Pi
+	return fmt.Sprintf("dX%.03f dY%.03f dZ%.03f  dist %.03f  angle %.01f°", d.X, d.Y, d.Z, d.Length(), angle)
+}
+
+// draw the points and the line between them, and the point a click would add
+func (tp *ToolpathView) LayoutMeasure(gtx C) {
+	m := tp.measure
+	if !m.Active {
+		return
+	}
+	col := rgb(0, 255, 128)
+	pts := m.Points
+	if len(pts) == 1 && m.HasHov {
+		pts = append(pts, m.Hover)
+	}
+	if len(pts) == 2 {
+		var path clip.Path
+		path.Begin(gtx.Ops)
+		path.MoveTo(tp.point(pts[0]))
+		path.LineTo(tp.point(pts[1]))
+		paint.FillShape(gtx.Ops, col, clip.Stroke{Path: path.End(), Width: 2}.Op())
+	}
+	for _, pt := range m.Points {
+		tp.ring(gtx, tp.point(pt), 4, col)
+	}
+	if m.HasHov && m.Snapped {
+		tp.ring(gtx, tp.point(m.Hover), 7, rgb(255, 255, 255))
+	}
+}
+
+// draw a circle of radius r pixels around the point
+func (tp *ToolpathView) ring(gtx C, c f32.Point, r float32, col color.NRGBA) {
+	var path clip.Path
+	path.Begin(gtx.Ops)
+	path.MoveTo(c.Add(f32.Pt(r, 0)))
+	path.ArcTo(c, c, 2*math.Pi)
+	paint.FillShape(gtx.Ops, col, clip.Stroke{Path: path.End(), Width: 2}.Op())
+}
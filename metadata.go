@@ -0,0 +1,460 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gioui.org/layout"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+)
+
+const defaultRapidRate = 1000 // mm/min, for estimating time if we don't know Grbl's max rates
+
+// a tool used by a job
+type JobTool struct {
+	Number int    // 0 if the CAM program didn't say
+	Desc   string // e.g. "D=6 CR=0 - flat end mill", or "" if we only saw a T word
+}
+
+func (t JobTool) String() string {
+	s := "tool"
+	if t.Number > 0 {
+		s = fmt.Sprintf("T%d", t.Number)
+	}
+	if t.Desc != "" {
+		s += ": " + t.Desc
+	}
+	return s
+}
+
+// a named operation (toolpath) in a job
+type JobOperation struct {
+	Name string
+	Line int // index into the program of the start of the operation, or -1 if unknown
+}
+
+// what we can tell about a job from the comments that CAM programs leave in
+// the G-code, and from the G-code itself
+type JobInfo struct {
+	Program     *Program
+	Generator   string // the CAM program, if recognised
+	Tools       []JobTool
+	Operations  []JobOperation
+	Stock       Bounds // in inches if StockInches, else mm
+	HasStock    bool
+	StockInches bool          // the stock is in inches, as the comment said, or else as the program is (G20)
+	StatedTime  time.Duration // machining time claimed by the CAM program, or 0
+	Estimate    time.Duration // from the feed rates and distances, ignoring acceleration
+}
+
+// add the tool, or fill in its description if we already have it
+func (info *JobInfo) addTool(tool JobTool) {
+	for i, t := range info.Tools {
+		if (tool.Number > 0 && t.Number == tool.Number) || (tool.Number == 0 && t.Desc == tool.Desc) {
+			if info.Tools[i].Desc == "" {
+				info.Tools[i].Desc = tool.Desc
+			}
+			return
+		}
+	}
+	info.Tools = append(info.Tools, tool)
+}
+
+// return the name of the operation that line i belongs to, or ""
+func (info *JobInfo) Operation(i int) string {
+	name := ""
+	for _, op := range info.Operations {
+		if op.Line >= 0 && op.Line <= i {
+			name = op.Name
+		}
+	}
+	return name
+}
+
+var (
+	fusionToolRe    = regexp.MustCompile(`^T(\d+)\s+(D=.*)$`)
+	hmsRe           = regexp.MustCompile(`(\d+):(\d\d):(\d\d)`)
+	carbideListRe   = regexp.MustCompile(`^(\d+)\s*=\s*(.*)$`)
+	machiningTimeRe = regexp.MustCompile(`(?i)machining time`)
+)
+
+// state kept while reading a program's comments and moves
+type jobParser struct {
+	info *JobInfo
+
+	list     string // "tools" or "operations" while reading a list in a Carbide Create header
+	sawCode  bool   // whether any line so far had G-code on it
+	afterM6  bool   // whether the previous line was a tool change
+	fromList bool   // whether the operations came from a header list, without line numbers
+
+	stockUnits   string // "mm" or "in" if the stock comment said, else ""
+	programUnits string // "mm" or "in" from the first G21 or G20, else ""
+
+	// for the time estimate
+	interp  *Interpreter
+	rapid   V4d // max rate of each axis, mm/min
+	minutes float64
+}
+
+// read a comment on line i; alone is true if the line has nothing but comments
+func (jp *jobParser) comment(i int, c string, alone bool) {
+	c = strings.TrimSpace(c)
+	info := jp.info
+	lower := strings.ToLower(c)
+
+	if jp.list != "" && alone && !jp.sawCode {
+		if strings.HasSuffix(c, ":") {
+			// the next list
+			jp.list = ""
+		} else if jp.list == "operations" {
+			info.Operations = append(info.Operations, JobOperation{Name: c, Line: -1})
+			jp.fromList = true
+			return
+		} else if m := carbideListRe.FindStringSubmatch(c); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			info.addTool(JobTool{Number: n, Desc: m[2]})
+			return
+		}
+	}
+
+	if strings.Contains(lower, "estlcam") {
+		info.Generator = "Estlcam"
+	} else if strings.Contains(lower, "exported by freecad") {
+		info.Generator = "FreeCAD"
+	} else if strings.HasPrefix(lower, "design file:") || strings.HasPrefix(lower, "stockmin:") {
+		info.Generator = "Carbide Create"
+	}
+
+	if m := fusionToolRe.FindStringSubmatch(c); m != nil {
+		// Fusion 360 lists the tools as "T1 D=6 CR=0 - ZMIN=-5 - flat end mill"
+		if info.Generator == "" {
+			info.Generator = "Fusion 360"
+		}
+		n, _ := strconv.Atoi(m[1])
+		info.addTool(JobTool{Number: n, Desc: m[2]})
+	} else if machiningTimeRe.MatchString(c) && hmsRe.MatchString(c) {
+		m := hmsRe.FindStringSubmatch(c)
+		h, _ := strconv.Atoi(m[1])
+		mins, _ := strconv.Atoi(m[2])
+		s, _ := strconv.Atoi(m[3])
+		info.StatedTime = time.Duration(h)*time.Hour + time.Duration(mins)*time.Minute + time.Duration(s)*time.Second
+	} else if strings.HasPrefix(lower, "stockmin:") || strings.HasPrefix(lower, "stockmax:") {
+		// Carbide Create: "stockMin:0.00mm, 0.00mm, -12.70mm"
+		v, units, ok := parseJobCoords(c[len("stockmin:"):])
+		if ok {
+			if units != "" {
+				jp.stockUnits = units
+			}
+			if info.HasStock {
+				info.Stock = info.Stock.Add(v)
+			} else {
+				info.Stock = EmptyBounds().Add(v)
+			}
+			info.HasStock = true
+		}
+	} else if strings.HasPrefix(lower, "stock/block,") && !info.HasStock {
+		// Carbide Create: "STOCK/BLOCK,width,height,thickness,x0,y0,z0"
+		parts := strings.Split(c[len("stock/block,"):], ",")
+		vals := make([]float64, 0, 6)
+		for _, p := range parts {
+			v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				break
+			}
+			vals = append(vals, v)
+		}
+		if len(vals) == 6 {
+			origin := V4d{X: -vals[3], Y: -vals[4], Z: -vals[5]}
+			info.Stock = Bounds{Min: origin, Max: origin.Add(V4d{X: vals[0], Y: vals[1], Z: vals[2]})}
+			info.HasStock = true
+		}
+	} else if lower == "toolpaths used in this file:" {
+		jp.list = "operations"
+	} else if lower == "tools used in this file:" {
+		jp.list = "tools"
+	} else if strings.HasPrefix(lower, "begin operation:") || strings.HasPrefix(lower, "toolpath:") {
+		// FreeCAD: "Begin operation: Profile"
+		jp.addOperation(i, strings.TrimSpace(c[strings.Index(c, ":")+1:]))
+	} else if strings.HasPrefix(lower, "tool:") || strings.HasPrefix(lower, "tc:") {
+		// Estlcam and FreeCAD tool changes
+		info.addTool(JobTool{Desc: strings.TrimSpace(c[strings.Index(c, ":")+1:])})
+	} else if info.Generator == "Fusion 360" && alone && jp.sawCode && !jp.afterM6 {
+		// Fusion 360 puts the name of each operation in a comment on its own
+		// at the start of the section
+		jp.addOperation(i, c)
+	}
+}
+
+func (jp *jobParser) addOperation(i int, name string) {
+	if jp.fromList {
+		// we have line numbers now, so forget the list from the header
+		jp.info.Operations = nil
+		jp.fromList = false
+	}
+	jp.info.Operations = append(jp.info.Operations, JobOperation{Name: name, Line: i})
+}
+
+// parse "1.00mm, 2.00mm, -3.00mm" or "1, 2, 3", and return the units
+// ("mm", "in", or "" if not given)
+func parseJobCoords(s string) (V4d, string, bool) {
+	units := ""
+	if strings.Contains(s, "mm") {
+		units = "mm"
+	} else if strings.Contains(s, "in") {
+		units = "in"
+	}
+	s = strings.ReplaceAll(strings.ReplaceAll(s, "mm", ""), "in", "")
+	v, n, err := ParseV4d(strings.ReplaceAll(s, " ", ""))
+	return v, units, err == nil && n == 3
+}
+
+func (jp *jobParser) line(i int, str string) {
+	line, err := ParseWords(str)
+	if err != nil {
+		return
+	}
+	alone := true
+	for _, c := range line.Codes {
+		if c.Comment == "" {
+			alone = false
+		}
+	}
+	for _, c := range line.Codes {
+		if c.Comment != "" {
+			jp.comment(i, c.Comment, alone)
+		}
+	}
+	if line.Comment != "" {
+		jp.comment(i, line.Comment, alone)
+	}
+	if alone {
+		return
+	}
+	jp.list = ""
+	jp.sawCode = true
+	jp.afterM6 = false
+
+	for _, c := range line.Codes {
+		if c.Letter == "M" && c.Value == 6 {
+			jp.afterM6 = true
+		} else if c.Letter == "T" {
+			jp.info.addTool(JobTool{Number: int(c.Value)})
+		} else if c.Letter == "G" && (c.Value == 20 || c.Value == 21) && jp.programUnits == "" {
+			jp.programUnits = "mm"
+			if c.Value == 20 {
+				jp.programUnits = "in"
+			}
+		}
+	}
+
+	segs, err := jp.interp.Line(i, str)
+	if err != nil {
+		return
+	}
+	for _, seg := range segs {
+		if seg.Kind == SegmentRapid {
+			jp.minutes += rapidMinutes(seg, jp.rapid)
+		} else if seg.Feed > 0 {
+			jp.minutes += seg.Length() / seg.Feed
+		}
+	}
+}
+
+// read the job info out of the program, estimating the time with rapid
+// moves at the given max rate of each axis (mm/min); gives up early
+// (returning nil) if cancelled() returns true
+func ReadJobInfo(p *Program, rapid V4d, cancelled func() bool) *JobInfo {
+	info := &JobInfo{Program: p}
+	jp := jobParser{info: info, interp: NewInterpreter(defaultArcTolerance), rapid: rapid}
+	cancel := false
+	p.Each(func(i int, str string) bool {
+		if i%programBlockLines == 0 && cancelled() {
+			cancel = true
+			return false
+		}
+		jp.line(i, str)
+		return true
+	})
+	if cancel {
+		return nil
+	}
+	info.Estimate = time.Duration(jp.minutes * float64(time.Minute))
+	if jp.stockUnits != "" {
+		info.StockInches = jp.stockUnits == "in"
+	} else {
+		info.StockInches = jp.programUnits == "in"
+	}
+	return info
+}
+
+// return the stock in mm, like the toolpath
+func (info *JobInfo) StockMM() Bounds {
+	if info.StockInches {
+		return Bounds{Min: info.Stock.Min.Mul(25.4), Max: info.Stock.Max.Mul(25.4)}
+	}
+	return info.Stock
+}
+
+// return the max rate of each axis ($110 to $113), with a guess for any we
+// don't know
+func (gs GrblStatus) RapidRates() V4d {
+	rate := func(key int) float64 {
+		if v, ok := gs.GrblConfig[key]; ok && v > 0 {
+			return v
+		}
+		return defaultRapidRate
+	}
+	return V4d{X: rate(110), Y: rate(111), Z: rate(112), A: rate(113)}
+}
+
+// return how long a rapid move takes, in minutes; like Grbl, the move goes
+// as fast as it can without any axis going faster than its max rate, so the
+// slowest axis sets the time
+func rapidMinutes(seg Segment, rates V4d) float64 {
+	d := seg.End.Sub(seg.Start)
+	return math.Max(math.Max(math.Abs(d.X)/rates.X, math.Abs(d.Y)/rates.Y), math.Max(math.Abs(d.Z)/rates.Z, math.Abs(d.A)/rates.A))
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
+
+// reads the job info in the background when a program is loaded, and shows
+// a summary of it
+type JobPanel struct {
+	app         *App
+	wantProgram atomic.Pointer[Program]
+	info        atomic.Pointer[JobInfo]
+	hidden      *Program // the program whose summary the user has hidden
+
+	list    widget.List
+	opBtns  []widget.Clickable
+	hideBtn widget.Clickable
+}
+
+func NewJobPanel(app *App) *JobPanel {
+	jp := &JobPanel{app: app}
+	jp.list.Axis = layout.Vertical
+	return jp
+}
+
+// read the job info of p in the background; called by the runner whenever
+// a program is loaded
+func (jp *JobPanel) Start(p *Program, rapid V4d) {
+	if p == nil || jp.wantProgram.Swap(p) == p {
+		return
+	}
+	go func() {
+		info := ReadJobInfo(p, rapid, func() bool {
+			return jp.wantProgram.Load() != p
+		})
+		if info == nil {
+			return
+		}
+		jp.info.Store(info)
+		jp.app.w.Invalidate()
+	}()
+}
+
+// return the job info for the given program, or nil if it hasn't been read
+func (jp *JobPanel) Info(p *Program) *JobInfo {
+	info := jp.info.Load()
+	if info == nil || info.Program != p {
+		return nil
+	}
+	return info
+}
+
+// return the name of the operation being run, or "" if we don't know
+func (jp *JobPanel) CurrentOperation() string {
+	rs := jp.app.rs
+	info := jp.Info(rs.Program)
+	if info == nil || !rs.Running {
+		return ""
+	}
+	return info.Operation(rs.NextLine - 1)
+}
+
+func (jp *JobPanel) Layout(gtx C) D {
+	prog := jp.app.rs.Program
+	info := jp.Info(prog)
+	if info == nil || jp.hidden == prog {
+		return D{}
+	}
+
+	for jp.hideBtn.Clicked(gtx) {
+		jp.hidden = prog
+	}
+	if len(jp.opBtns) < len(info.Operations) {
+		jp.opBtns = make([]widget.Clickable, len(info.Operations))
+	}
+	for i, op := range info.Operations {
+		for jp.opBtns[i].Clicked(gtx) {
+			if op.Line >= 0 {
+				jp.app.ScrollGCodeTo(op.Line)
+			}
+		}
+	}
+
+	title := "Job "
+	if info.Generator != "" {
+		title = "Job (" + info.Generator + ") "
+	}
+	summary := "est. " + formatDuration(info.Estimate)
+	if info.StatedTime > 0 {
+		summary += ", CAM says " + formatDuration(info.StatedTime)
+	}
+
+	// one row per line of the summary, then the operations
+	rows := make([]layout.Widget, 0)
+	if info.HasStock {
+		size := info.Stock.Max.Sub(info.Stock.Min)
+		units := "mm"
+		if info.StockInches {
+			units = "in"
+		}
+		rows = append(rows, material.Body1(jp.app.th, fmt.Sprintf("stock: %s x %s x %s %s", formatNumber(size.X), formatNumber(size.Y), formatNumber(size.Z), units)).Layout)
+	}
+	for _, t := range info.Tools {
+		rows = append(rows, material.Body1(jp.app.th, t.String()).Layout)
+	}
+	nRows := len(rows)
+
+	return Panel{Width: 1, CornerRadius: 5, Color: grey(128), BackgroundColor: grey(16), Margin: layout.UniformInset(5), Padding: layout.UniformInset(5)}.Layout(gtx, func(gtx C) D {
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+			layout.Rigid(func(gtx C) D {
+				return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx,
+					material.H6(jp.app.th, title).Layout,
+					material.Body1(jp.app.th, summary).Layout,
+					material.Button(jp.app.th, &jp.hideBtn, "HIDE").Layout,
+				)
+			}),
+			layout.Rigid(func(gtx C) D {
+				maxY := gtx.Dp(120)
+				if gtx.Constraints.Max.Y > maxY {
+					gtx.Constraints.Max.Y = maxY
+				}
+				return material.List(jp.app.th, &jp.list).Layout(gtx, nRows+len(info.Operations), func(gtx C, i int) D {
+					if i < nRows {
+						return rows[i](gtx)
+					}
+					op := info.Operations[i-nRows]
+					return material.Clickable(gtx, &jp.opBtns[i-nRows], func(gtx C) D {
+						label := material.Body1(jp.app.th, "op: "+op.Name)
+						if op.Name == jp.CurrentOperation() {
+							label.Color = rgb(128, 255, 128)
+						}
+						return label.Layout(gtx)
+					})
+				})
+			}),
+		)
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gioui.org/layout"
+	"gioui.org/op/clip"
+	"gioui.org/op/paint"
+	"gioui.org/unit"
+	"gioui.org/widget/material"
+)
+
+const zRampLevels = 8 // colours between ZLow and ZHigh
+
+// the colours of the toolpath preview, read from palette.conf
+type Palette struct {
+	Rapid   color.NRGBA // G0 not yet sent
+	Feed    color.NRGBA // G1 not yet sent
+	Arc     color.NRGBA // G2/G3 not yet sent
+	Probe   color.NRGBA // G38.x not yet sent
+	Done    color.NRGBA // moves that Grbl has accepted
+	Machine color.NRGBA // where the machine has actually been
+	ZLow    color.NRGBA // deepest feed moves, with ZRamp
+	ZHigh   color.NRGBA // shallowest feed moves, with ZRamp
+	ZRamp   bool        // colour feed moves by Z instead of by kind
+	Legend  bool        // show the legend on the toolpath view
+}
+
+func DefaultPalette() Palette {
+	return Palette{
+		Rapid:   rgb(255, 128, 0),
+		Feed:    rgb(255, 255, 255),
+		Arc:     rgb(192, 224, 255),
+		Probe:   rgb(255, 0, 255),
+		Done:    rgb(0, 160, 0),
+		Machine: grey(128),
+		ZLow:    rgb(0, 64, 255),
+		ZHigh:   rgb(255, 255, 0),
+		Legend:  true,
+	}
+}
+
+// the colour of a segment that hasn't been sent yet; zlo and zhi are the
+// range of Z for the ramp
+func (pal Palette) SegmentColour(seg Segment, zlo, zhi float64) color.NRGBA {
+	if seg.Kind == SegmentRapid {
+		return pal.Rapid
+	} else if seg.Kind == SegmentProbe {
+		return pal.Probe
+	} else if pal.ZRamp {
+		t := 1.0
+		if zhi > zlo {
+			// use a few steps instead of a smooth ramp, so that we stroke
+			// a few long paths instead of lots of short ones
+			z := (seg.Start.Z + seg.End.Z) / 2
+			t = float64(int((z-zlo)/(zhi-zlo)*zRampLevels)) / zRampLevels
+			t = clamp1(t)
+		}
+		return mixColour(pal.ZLow, pal.ZHigh, t)
+	} else if seg.Kind == SegmentArc {
+		return pal.Arc
+	} else {
+		return pal.Feed
+	}
+}
+
+// return a + (b-a)*t
+func mixColour(a, b color.NRGBA, t float64) color.NRGBA {
+	mix := func(x, y uint8) uint8 {
+		return uint8(float64(x) + (float64(y)-float64(x))*t)
+	}
+	return color.NRGBA{R: mix(a.R, b.R), G: mix(a.G, b.G), B: mix(a.B, b.B), A: mix(a.A, b.A)}
+}
+
+func parseColour(s string) (color.NRGBA, error) {
+	var r, g, b uint8
+	if _, err := fmt.Sscanf(s, "#%02x%02x%02x", &r, &g, &b); err != nil {
+		return color.NRGBA{}, fmt.Errorf("bad colour: [%s], want #rrggbb", s)
+	}
+	return rgb(r, g, b), nil
+}
+
+func formatColour(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func PaletteFile() string {
+	return filepath.Join(ConfDir(), "palette.conf")
+}
+
+// the colours in the palette, by their names in palette.conf
+func (pal *Palette) colours() map[string]*color.NRGBA {
+	return map[string]*color.NRGBA{
+		"rapid":   &pal.Rapid,
+		"feed":    &pal.Feed,
+		"arc":     &pal.Arc,
+		"probe":   &pal.Probe,
+		"done":    &pal.Done,
+		"machine": &pal.Machine,
+		"zlow":    &pal.ZLow,
+		"zhigh":   &pal.ZHigh,
+	}
+}
+
+// read palette.conf, starting from the default palette; the file doesn't
+// have to exist, or to mention every colour
+func ReadPalette() Palette {
+	pal := DefaultPalette()
+	filename := PaletteFile()
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "read %s: %v\n", filename, err)
+		}
+		return pal
+	}
+	defer f.Close()
+
+	colours := pal.colours()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			fmt.Fprintf(os.Stderr, "%s: bad line: [%s]\n", filename, line)
+			continue
+		}
+		key, val := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if c, ok := colours[key]; ok {
+			col, err := parseColour(val)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s: %v\n", filename, key, err)
+				continue
+			}
+			*c = col
+		} else if key == "zramp" {
+			pal.ZRamp = val == "true"
+		} else if key == "legend" {
+			pal.Legend = val == "true"
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: unrecognised palette key: [%s]\n", filename, key)
+		}
+	}
+	return pal
+}
+
+func (pal Palette) Write() {
+	filename := PaletteFile()
+	f, err := os.Create(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "write %s: %v\n", filename, err)
+		return
+	}
+	defer f.Close()
+
+	for _, key := range []string{"rapid", "feed", "arc", "probe", "done", "machine", "zlow", "zhigh"} {
+		fmt.Fprintf(f, "%s=%s\n", key, formatColour(*pal.colours()[key]))
+	}
+	fmt.Fprintf(f, "zramp=%v\n", pal.ZRamp)
+	fmt.Fprintf(f, "legend=%v\n", pal.Legend)
+}
+
+// switch between colouring feed moves by kind and by Z, and remember the choice
+func (tp *ToolpathView) ToggleZRamp() {
+	tp.opts.palette.ZRamp = !tp.opts.palette.ZRamp
+	go tp.opts.palette.Write()
+}
+
+// draw a key to the colours in the corner of the toolpath view
+func (tp *ToolpathView) LayoutLegend(gtx C) D {
+	pal := tp.opts.palette
+	if !pal.Legend {
+		return D{}
+	}
+
+	type entry struct {
+		col   color.NRGBA
+		label string
+	}
+	entries := []entry{{pal.Rapid, "rapid"}}
+	if pal.ZRamp {
+		entries = append(entries, entry{pal.ZHigh, "top"}, entry{mixColour(pal.ZLow, pal.ZHigh, 0.5), "feed by Z"}, entry{pal.ZLow, "bottom"})
+	} else {
+		entries = append(entries, entry{pal.Feed, "feed"}, entry{pal.Arc, "arc"})
+	}
+	entries = append(entries, entry{pal.Probe, "probe"}, entry{pal.Done, "done"}, entry{pal.Machine, "machine"})
+
+	children := make([]layout.FlexChild, len(entries))
+	for i, e := range entries {
+		e := e
+		children[i] = layout.Rigid(func(gtx C) D {
+			return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx,
+				layout.Rigid(func(gtx C) D {
+					sz := gtx.Sp(tp.app.th.TextSize)
+					paint.FillShape(gtx.Ops, e.col, clip.Rect(image.Rect(0, sz/4, sz, sz*3/4)).Op())
+					return D{Size: image.Pt(sz, sz)}
+				}),
+				layout.Rigid(layout.Spacer{Width: unit.Dp(4)}.Layout),
+				layout.Rigid(material.Body2(tp.app.th, e.label).Layout),
+			)
+		})
+	}
+	return layout.UniformInset(5).Layout(gtx, func(gtx C) D {
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx, children...)
+	})
+}
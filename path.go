@@ -5,41 +5,70 @@ import (
 	"image/color"
 	"image/draw"
 	"math"
+	"sort"
+	"sync/atomic"
 
 	"github.com/llgcode/draw2d/draw2dimg"
 )
 
 const (
-	MinPxPerMm = 0.1
-	MaxPxPerMm = 10000.0
+	MinPxPerMm  = 0.1
+	MaxPxPerMm  = 10000.0
+	renderChunk = 4096 // points to stroke at a time, between checks for cancellation
 )
 
 type PathOpts struct {
 	showAxes      bool
 	showCrossHair bool
 	showGridLines bool
+	showEnvelope  bool // the machine travel
+	showOffsets   bool // work origins and the G28/G30 positions
 	crossHair     V4d
 	pxPerMm       float64
 	centre        V4d // what coordinate is in the centre?
 	widthPx       int
 	heightPx      int
 	axes          V4d
+	envelope      Bounds // machine travel, in machine coordinates
+	haveEnvelope  bool
+	offsets       [6]V4d // G54 to G59, in machine coordinates
+	g28           V4d
+	g30           V4d
+	haveOffsets   bool
+	activeWCS     int     // index into offsets
+	yaw           float64 // direction to look from, see ViewPreset
+	pitch         float64
+	palette       Palette
+	doneLine      int // the last line of the program that Grbl has accepted
 }
 
 type Path struct {
 	PathOpts
 	last PathOpts
 
-	positions      []V4d
-	drawnPositions int
+	positions          []V4d
+	drawnPositions     int
+	needToolpathRedraw bool
 
-	gcodePositions  []V4d
+	gcodeSegments   []Segment
 	needGCodeRedraw bool
+	drawnDone       int     // segments before this have been drawn in the "done" colour
+	depthNear       float64 // depth range of the toolpath, for depth cueing
+	depthFar        float64
+
+	copies              []Bounds // the box around each copy of a step-and-repeat program
+	copySkipped         []bool
+	heightMap           *HeightMap
+	needHeightMapRedraw bool
+	stock               *StockMap // simulated stock, drawn under the toolpath
+	needStockRedraw     bool
 
 	ForceRedraw bool
+	Cancel      *atomic.Bool // if set, Render() gives up as soon as it can
 
 	Image           image.Image
 	backgroundLayer *image.RGBA
+	stockLayer      *image.RGBA
 	toolpathLayer   *image.RGBA
 	gcodeLayer      *image.RGBA
 	foregroundLayer *image.RGBA
@@ -63,12 +92,46 @@ func (p *Path) Update(pos V4d) {
 	p.positions = append(p.positions, pos)
 }
 
-func (p *Path) SetGCode(positions []V4d) {
-	p.gcodePositions = positions
+// forget the machine positions, e.g. because the trace was cleared
+func (p *Path) ClearPositions() {
+	p.positions = nil
+	p.drawnPositions = 0
+	p.needToolpathRedraw = true
+}
+
+func (p *Path) SetGCode(segments []Segment) {
+	p.gcodeSegments = segments
+	p.drawnDone = 0
 	p.needGCodeRedraw = true
 }
 
-// return true if redrawn, false if no changes to draw
+func (p *Path) SetCopies(copies []Bounds, skipped []bool) {
+	p.copies = copies
+	p.copySkipped = skipped
+	p.needGCodeRedraw = true
+}
+
+func (p *Path) SetHeightMap(hm *HeightMap) {
+	p.heightMap = hm
+	p.needHeightMapRedraw = true
+}
+
+func (p *Path) SetStock(m *StockMap) {
+	p.stock = m
+	p.needStockRedraw = true
+}
+
+// return true if the options draw everything in the same place as o
+func (p PathOpts) SameView(o PathOpts) bool {
+	eps := 0.000001
+	return p.widthPx == o.widthPx && p.heightPx == o.heightPx && math.Abs(p.pxPerMm-o.pxPerMm) <= eps && p.centre.Sub(o.centre).Length() <= eps && p.yaw == o.yaw && p.pitch == o.pitch && p.palette == o.palette
+}
+
+func (p *Path) cancelled() bool {
+	return p.Cancel != nil && p.Cancel.Load()
+}
+
+// return true if redrawn, false if no changes to draw, or if cancelled
 func (p *Path) Render() bool {
 	if p.pxPerMm > MaxPxPerMm {
 		p.pxPerMm = MaxPxPerMm
@@ -76,8 +139,7 @@ func (p *Path) Render() bool {
 	if p.pxPerMm < MinPxPerMm {
 		p.pxPerMm = MinPxPerMm
 	}
-	eps := 0.000001
-	if p.widthPx != p.last.widthPx || p.heightPx != p.last.heightPx || math.Abs(p.pxPerMm-p.last.pxPerMm) > eps || p.centre.Sub(p.last.centre).Length() > eps {
+	if !p.SameView(p.last) {
 		p.ForceRedraw = true
 	}
 
@@ -87,6 +149,9 @@ func (p *Path) Render() bool {
 	if p.RenderBackground() {
 		changed = true
 	}
+	if p.RenderStock() {
+		changed = true
+	}
 	if p.RenderGCode() {
 		changed = true
 	}
@@ -97,6 +162,12 @@ func (p *Path) Render() bool {
 		changed = true
 	}
 
+	if p.cancelled() {
+		// the layers may be half drawn, so start again next time
+		p.ForceRedraw = true
+		return false
+	}
+
 	p.ForceRedraw = false
 	p.last = opts
 
@@ -107,6 +178,9 @@ func (p *Path) Render() bool {
 	bounds := image.Rect(0, 0, p.widthPx, p.heightPx)
 	composite := image.NewRGBA(bounds)
 	draw.Draw(composite, bounds, p.backgroundLayer, image.Point{}, draw.Src)
+	if p.stock != nil {
+		draw.Draw(composite, bounds, p.stockLayer, image.Point{}, draw.Over)
+	}
 	draw.Draw(composite, bounds, p.gcodeLayer, image.Point{}, draw.Over)
 	draw.Draw(composite, bounds, p.toolpathLayer, image.Point{}, draw.Over)
 	draw.Draw(composite, bounds, p.foregroundLayer, image.Point{}, draw.Over)
@@ -119,8 +193,18 @@ func (p *Path) Render() bool {
 func (p *Path) RenderBackground() bool {
 	eps := 0.000001
 	if !p.ForceRedraw &&
+		!p.needHeightMapRedraw &&
 		p.showAxes == p.last.showAxes &&
 		p.showGridLines == p.last.showGridLines &&
+		p.showEnvelope == p.last.showEnvelope &&
+		p.haveEnvelope == p.last.haveEnvelope &&
+		p.envelope == p.last.envelope &&
+		p.showOffsets == p.last.showOffsets &&
+		p.haveOffsets == p.last.haveOffsets &&
+		p.offsets == p.last.offsets &&
+		p.g28 == p.last.g28 &&
+		p.g30 == p.last.g30 &&
+		p.activeWCS == p.last.activeWCS &&
 		p.axes.Sub(p.last.axes).Length() < eps {
 		// no need to re-render
 		return false
@@ -131,7 +215,12 @@ func (p *Path) RenderBackground() bool {
 
 	centrex, centrey := p.MmToPx(p.axes.X, p.axes.Y)
 
-	if p.showGridLines {
+	if p.heightMap != nil {
+		p.DrawHeightMap(gc, p.heightMap, p.axes)
+	}
+	p.needHeightMapRedraw = false
+
+	if p.showGridLines && p.IsTop() {
 		// we want to draw a "solid" grid line every 10-100 pixels
 		// at the current zoom level, at multiples of 10,
 		// and a "fading in" grid line at 1/10 of that
@@ -146,37 +235,145 @@ func (p *Path) RenderBackground() bool {
 		p.DrawGridLines(gc, spacingPx*0.1, secondaryCol)
 	}
 
-	if p.showAxes {
+	if p.showAxes && !p.IsTop() {
+		p.DrawAxes3D(gc)
+	} else if p.showAxes {
 		p.DrawVLine(gc, math.Floor(centrex), rgb(64, 0, 0))
 		p.DrawHLine(gc, math.Floor(centrey), rgb(0, 64, 0))
 	}
 
+	if p.showEnvelope && p.haveEnvelope {
+		p.DrawBox(gc, p.envelope, rgb(128, 96, 0))
+	}
+
+	if p.showOffsets {
+		p.DrawMarkers(gc)
+	}
+
 	return true
 }
 
-func (p *Path) RenderGCode() bool {
+func (p *Path) RenderStock() bool {
 	eps := 0.000001
 	if !p.ForceRedraw &&
-		!p.needGCodeRedraw &&
+		!p.needStockRedraw &&
 		p.axes.Sub(p.last.axes).Length() < eps {
 		// no need to re-render
 		return false
 	}
+	p.needStockRedraw = false
+	if p.stock == nil {
+		p.stockLayer = nil
+		return true
+	}
+
+	p.stockLayer = image.NewRGBA(image.Rect(0, 0, p.widthPx, p.heightPx))
+	p.DrawStock(p.stockLayer, p.stock, p.axes)
+	return true
+}
+
+func (p *Path) RenderGCode() bool {
+	eps := 0.000001
+	full := p.ForceRedraw ||
+		p.needGCodeRedraw ||
+		p.axes.Sub(p.last.axes).Length() > eps ||
+		p.doneLine < p.drawnDoneLine()
+	if !full {
+		// just draw the moves that have been done since last time
+		return p.RenderDone()
+	}
 
 	p.gcodeLayer = image.NewRGBA(image.Rect(0, 0, p.widthPx, p.heightPx))
 	gc := draw2dimg.NewGraphicContext(p.gcodeLayer)
 
-	gc.SetStrokeColor(color.White)
-	p.RenderPath(gc, p.gcodePositions, p.axes)
+	zlo, zhi := 0.0, 0.0
+	if b, ok := p.segmentBounds(); ok {
+		p.DrawBox(gc, b.Offset(p.axes), rgb(0, 96, 128))
+		zlo, zhi = b.Min.Z, b.Max.Z
+	}
+
+	for i, b := range p.copies {
+		b = b.Offset(p.axes)
+		if p.copySkipped[i] {
+			// cross out the copies that won't be cut
+			col := rgb(128, 32, 32)
+			p.DrawBox(gc, b, col)
+			gc.MoveTo(p.Project(b.Min))
+			gc.LineTo(p.Project(V4d{X: b.Max.X, Y: b.Max.Y, Z: b.Min.Z}))
+			gc.MoveTo(p.Project(V4d{X: b.Min.X, Y: b.Max.Y, Z: b.Min.Z}))
+			gc.LineTo(p.Project(V4d{X: b.Max.X, Y: b.Min.Y, Z: b.Min.Z}))
+			gc.Stroke()
+		} else {
+			p.DrawBox(gc, b, grey(96))
+		}
+	}
+
+	p.depthNear, p.depthFar = p.depthRange(p.gcodeSegments, p.axes)
+
+	// draw the moves that haven't been done, a colour at a time, and then
+	// the ones that have
+	pending := p.gcodeSegments[p.doneIndex():]
+	groups := make(map[color.NRGBA][]Segment)
+	order := make([]color.NRGBA, 0)
+	for _, seg := range pending {
+		col := p.palette.SegmentColour(seg, zlo, zhi)
+		if _, ok := groups[col]; !ok {
+			order = append(order, col)
+		}
+		groups[col] = append(groups[col], seg)
+	}
+	for _, col := range order {
+		p.RenderSegmentsDepthCued(gc, groups[col], p.axes, col, p.depthNear, p.depthFar)
+	}
+	p.drawnDone = 0
+	p.RenderDone()
 
 	p.needGCodeRedraw = false
 	return true
 
 }
 
+// return the index of the first segment that hasn't been done
+func (p *Path) doneIndex() int {
+	return sort.Search(len(p.gcodeSegments), func(i int) bool {
+		return p.gcodeSegments[i].Line > p.doneLine
+	})
+}
+
+// return the last line that has been drawn as done
+func (p *Path) drawnDoneLine() int {
+	if p.drawnDone == 0 {
+		return -1
+	}
+	return p.gcodeSegments[p.drawnDone-1].Line
+}
+
+// return the box around the toolpath, in work coordinates
+func (p *Path) segmentBounds() (Bounds, bool) {
+	b := EmptyBounds()
+	for _, seg := range p.gcodeSegments {
+		b = b.Add(seg.End)
+	}
+	return b, !b.Empty()
+}
+
+// draw the moves done since the last call over the top of the gcode layer;
+// return false if there were none
+func (p *Path) RenderDone() bool {
+	end := p.doneIndex()
+	if end <= p.drawnDone {
+		return false
+	}
+	gc := draw2dimg.NewGraphicContext(p.gcodeLayer)
+	p.RenderSegmentsDepthCued(gc, p.gcodeSegments[p.drawnDone:end], p.axes, p.palette.Done, p.depthNear, p.depthFar)
+	p.drawnDone = end
+	return true
+}
+
 func (p *Path) RenderToolpath() bool {
 	l := len(p.positions)
 	if !p.ForceRedraw &&
+		!p.needToolpathRedraw &&
 		p.drawnPositions == l {
 		// no need to re-render
 		return false
@@ -186,13 +383,14 @@ func (p *Path) RenderToolpath() bool {
 	if startIdx < 0 {
 		startIdx = 0
 	}
-	if p.ForceRedraw {
+	if p.ForceRedraw || p.needToolpathRedraw {
 		p.toolpathLayer = image.NewRGBA(image.Rect(0, 0, p.widthPx, p.heightPx))
 		startIdx = 0
+		p.needToolpathRedraw = false
 	}
 	gc := draw2dimg.NewGraphicContext(p.toolpathLayer)
 
-	gc.SetStrokeColor(grey(128))
+	gc.SetStrokeColor(p.palette.Machine)
 	p.RenderPath(gc, p.positions[startIdx:], V4d{})
 	p.drawnPositions = l
 
@@ -204,14 +402,46 @@ func (p *Path) RenderPath(gc *draw2dimg.GraphicContext, path []V4d, offset V4d)
 		return
 	}
 
-	gc.MoveTo(p.MmToPx(path[0].X+offset.X, path[0].Y+offset.Y))
-	for _, pos := range path[1:] {
-		gc.LineTo(p.MmToPx(pos.X+offset.X, pos.Y+offset.Y))
+	gc.MoveTo(p.Project(path[0].Add(offset)))
+	for i, pos := range path[1:] {
+		gc.LineTo(p.Project(pos.Add(offset)))
+		if i%renderChunk == renderChunk-1 {
+			gc.Stroke()
+			if p.cancelled() {
+				return
+			}
+			gc.MoveTo(p.Project(pos.Add(offset)))
+		}
 	}
 	gc.Stroke()
 
 }
 
+// draw the segments as one path, only lifting the pen where they don't join up
+func (p *Path) RenderSegments(gc *draw2dimg.GraphicContext, segments []Segment, offset V4d) {
+	if len(segments) == 0 {
+		return
+	}
+
+	last := segments[0].Start
+	gc.MoveTo(p.Project(last.Add(offset)))
+	for i, seg := range segments {
+		if seg.Start != last {
+			gc.MoveTo(p.Project(seg.Start.Add(offset)))
+		}
+		gc.LineTo(p.Project(seg.End.Add(offset)))
+		last = seg.End
+		if i%renderChunk == renderChunk-1 {
+			gc.Stroke()
+			if p.cancelled() {
+				return
+			}
+			gc.MoveTo(p.Project(last.Add(offset)))
+		}
+	}
+	gc.Stroke()
+}
+
 func (p *Path) RenderForeground() bool {
 	eps := 0.000001
 	if !p.ForceRedraw &&
@@ -225,13 +455,42 @@ func (p *Path) RenderForeground() bool {
 
 	if p.showCrossHair {
 		gc.SetStrokeColor(grey(128))
-		x, y := p.MmToPx(p.crossHair.X, p.crossHair.Y)
+		x, y := p.Project(p.crossHair)
 		p.DrawCrossHair(gc, x, y, 12)
 	}
 
 	return true
 }
 
+// draw a square around each probed point of the height map, from blue at the
+// lowest to red at the highest
+func (p *Path) DrawHeightMap(gc *draw2dimg.GraphicContext, hm *HeightMap, offset V4d) {
+	lo, hi := hm.Range()
+	hw := (hm.Max.X - hm.Min.X) / float64(hm.NX-1) / 2
+	hh := (hm.Max.Y - hm.Min.Y) / float64(hm.NY-1) / 2
+	for j := 0; j < hm.NY; j++ {
+		for i := 0; i < hm.NX; i++ {
+			z := hm.At(i, j)
+			if math.IsNaN(z) {
+				continue
+			}
+			t := 0.5
+			if hi > lo {
+				t = (z - lo) / (hi - lo)
+			}
+			gc.SetFillColor(rgb(uint8(96*t), 0, uint8(96*(1-t))))
+			pt := hm.Point(i, j).Add(offset)
+			pt.Z = z + offset.Z
+			gc.MoveTo(p.Project(pt.Add(V4d{X: -hw, Y: -hh})))
+			gc.LineTo(p.Project(pt.Add(V4d{X: hw, Y: -hh})))
+			gc.LineTo(p.Project(pt.Add(V4d{X: hw, Y: hh})))
+			gc.LineTo(p.Project(pt.Add(V4d{X: -hw, Y: hh})))
+			gc.Close()
+			gc.Fill()
+		}
+	}
+}
+
 func (p *Path) DrawGridLines(gc *draw2dimg.GraphicContext, step float64, col color.NRGBA) {
 	centrex, centrey := p.MmToPx(p.axes.X, p.axes.Y)
 	x0 := f64mod(centrex, step)
@@ -262,13 +521,13 @@ func (p *Path) DrawCrossHair(gc *draw2dimg.GraphicContext, x, y, r float64) {
 	gc.Stroke()
 }
 
-func (p *Path) MmToPx(x, y float64) (float64, float64) {
+func (p PathOpts) MmToPx(x, y float64) (float64, float64) {
 	halfWidth := float64(p.widthPx / 2)
 	halfHeight := float64(p.heightPx / 2)
 	return p.pxPerMm*(x-p.centre.X) + halfWidth, p.pxPerMm*(-y-p.centre.Y) + halfHeight
 }
 
-func (p *Path) PxToMm(x, y float64) (float64, float64) {
+func (p PathOpts) PxToMm(x, y float64) (float64, float64) {
 	halfWidth := float64(p.widthPx / 2)
 	halfHeight := float64(p.heightPx / 2)
 	return (x-halfWidth)/p.pxPerMm + p.centre.X, -((y-halfHeight)/p.pxPerMm + p.centre.Y)
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"sort"
+
+	"gioui.org/f32"
+	"gioui.org/op/clip"
+	"gioui.org/op/paint"
+)
+
+const (
+	pickRadiusPx   = 6   // how close a click has to be to a segment to pick it
+	pickGridCells  = 256 // cells along each side of the spatial index
+	pickHighlightW = 3   // width of the line drawn over the highlighted segments
+)
+
+// a grid over the toolpath in view space, for finding the segments near a
+// point quickly; the view space only depends on the direction we're looking
+// from, so the index stays valid when zooming and panning
+type SegmentIndex struct {
+	segments []Segment
+	yaw      float64
+	pitch    float64
+	min      V4d // corner of the grid, in view space
+	cellSize float64
+	nx, ny   int
+	cells    [][]int32 // indices into segments, by cell
+}
+
+func NewSegmentIndex(segments []Segment, opts PathOpts) *SegmentIndex {
+	idx := &SegmentIndex{segments: segments, yaw: opts.yaw, pitch: opts.pitch}
+	b := EmptyBounds()
+	for _, seg := range segments {
+		b = b.Add(opts.ViewPos(seg.Start)).Add(opts.ViewPos(seg.End))
+	}
+	if b.Empty() {
+		return idx
+	}
+	idx.min = b.Min
+	idx.cellSize = math.Max(b.Max.X-b.Min.X, b.Max.Y-b.Min.Y) / pickGridCells
+	if idx.cellSize <= 0 {
+		idx.cellSize = 1
+	}
+	idx.nx = int((b.Max.X-b.Min.X)/idx.cellSize) + 1
+	idx.ny = int((b.Max.Y-b.Min.Y)/idx.cellSize) + 1
+	idx.cells = make([][]int32, idx.nx*idx.ny)
+	for i, seg := range segments {
+		a, b := opts.ViewPos(seg.Start), opts.ViewPos(seg.End)
+		x0, y0 := idx.cell(math.Min(a.X, b.X), math.Min(a.Y, b.Y))
+		x1, y1 := idx.cell(math.Max(a.X, b.X), math.Max(a.Y, b.Y))
+		for y := y0; y <= y1; y++ {
+			for x := x0; x <= x1; x++ {
+				idx.cells[y*idx.nx+x] = append(idx.cells[y*idx.nx+x], int32(i))
+			}
+		}
+	}
+	return idx
+}
+
+// return the cell containing the view space point, clamped to the grid
+func (idx *SegmentIndex) cell(x, y float64) (int, int) {
+	cx := int(math.Floor((x - idx.min.X) / idx.cellSize))
+	cy := int(math.Floor((y - idx.min.Y) / idx.cellSize))
+	return max(0, min(idx.nx-1, cx)), max(0, min(idx.ny-1, cy))
+}
+
+// return whether the index was built for the direction opts look from
+func (idx *SegmentIndex) Matches(segments []Segment, opts PathOpts) bool {
+	return len(idx.segments) == len(segments) && (len(segments) == 0 || &idx.segments[0] == &segments[0]) &&
+		idx.yaw == opts.yaw && idx.pitch == opts.pitch
+}
+
+// return the index of the segment nearest to the view space point, if there
+// is one within r
+func (idx *SegmentIndex) Nearest(p V4d, r float64, opts PathOpts) (int, bool) {
+	if idx.cells == nil {
+		return 0, false
+	}
+	x0, y0 := idx.cell(p.X-r, p.Y-r)
+	x1, y1 := idx.cell(p.X+r, p.Y+r)
+	best, bestDist := 0, math.Inf(1)
+	p.Z, p.A = 0, 0
+	for y := y0; y <= y1; y++ {
+		for x := x0; x <= x1; x++ {
+			for _, i := range idx.cells[y*idx.nx+x] {
+				seg := idx.segments[i]
+				a, b := opts.ViewPos(seg.Start), opts.ViewPos(seg.End)
+				a.Z, a.A, b.Z, b.A = 0, 0, 0, 0
+				d := distanceToLine(p, a, b)
+				if d < bestDist || (d == bestDist && int(i) < best) {
+					best, bestDist = int(i), d
+				}
+			}
+		}
+	}
+	return best, bestDist <= r
+}
+
+// return the range of segments made by line i of the program
+func segmentsForLine(segments []Segment, i int) (int, int) {
+	start := sort.Search(len(segments), func(k int) bool { return segments[k].Line >= i })
+	end := sort.Search(len(segments), func(k int) bool { return segments[k].Line > i })
+	return start, end
+}
+
+// return the point in the view space of the segments (which are in work
+// coordinates) drawn at the pixel
+func (tp *ToolpathView) viewPoint(px, py float64) V4d {
+	// undo the work offset and then the pan and zoom
+	offset := tp.opts.ViewPos(tp.opts.axes)
+	halfWidth := float64(tp.opts.widthPx / 2)
+	halfHeight := float64(tp.opts.heightPx / 2)
+	return V4d{
+		X: (px-halfWidth)/tp.opts.pxPerMm + tp.opts.centre.X - offset.X,
+		Y: -((py-halfHeight)/tp.opts.pxPerMm + tp.opts.centre.Y) - offset.Y,
+	}
+}
+
+// return the index for the current view direction, building it if necessary
+func (tp *ToolpathView) segmentIndex() *SegmentIndex {
+	if tp.index == nil || !tp.index.Matches(tp.segments, tp.opts) {
+		tp.index = NewSegmentIndex(tp.segments, tp.opts)
+	}
+	return tp.index
+}
+
+// return the line of the program drawn at the pixel, if any
+func (tp *ToolpathView) PickLine(px, py float64) (int, bool) {
+	if len(tp.segments) == 0 {
+		return 0, false
+	}
+	i, ok := tp.segmentIndex().Nearest(tp.viewPoint(px, py), pickRadiusPx/tp.opts.pxPerMm, tp.opts)
+	if !ok {
+		return 0, false
+	}
+	return tp.segments[i].Line, true
+}
+
+// return where line i of the program starts and ends, in work coordinates
+func (tp *ToolpathView) LineMoves(i int) (V4d, V4d, bool) {
+	start, end := segmentsForLine(tp.segments, i)
+	if start >= end {
+		return V4d{}, V4d{}, false
+	}
+	return tp.segments[start].Start, tp.segments[end-1].End, true
+}
+
+// describe the selected line's move for the readout, or "" if it doesn't move
+func (tp *ToolpathView) SelectedMove() string {
+	if highlightProgram != tp.program || highlightLine < 0 {
+		return ""
+	}
+	start, end, ok := tp.LineMoves(highlightLine)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("line %d: X%.03f Y%.03f Z%.03f -> X%.03f Y%.03f Z%.03f", highlightLine+1, start.X, start.Y, start.Z, end.X, end.Y, end.Z)
+}
+
+// draw over the segments of the line hovered in the G-code view, and of
+// the selected line
+func (tp *ToolpathView) LayoutHighlight(gtx C) {
+	if tp.program != tp.app.rs.Program {
+		return
+	}
+	if tp.hoverLine >= 0 {
+		tp.strokeLine(gtx, tp.hoverLine, rgb(0, 255, 255))
+	}
+	if highlightProgram == tp.program && highlightLine >= 0 {
+		tp.strokeLine(gtx, highlightLine, rgb(255, 255, 0))
+	}
+}
+
+func (tp *ToolpathView) strokeLine(gtx C, i int, col color.NRGBA) {
+	start, end := segmentsForLine(tp.segments, i)
+	if start >= end {
+		return
+	}
+	var path clip.Path
+	path.Begin(gtx.Ops)
+	last := V4d{X: math.NaN()}
+	for _, seg := range tp.segments[start:end] {
+		if seg.Start != last {
+			path.MoveTo(tp.point(seg.Start))
+		}
+		path.LineTo(tp.point(seg.End))
+		last = seg.End
+	}
+	paint.FillShape(gtx.Ops, col, clip.Stroke{Path: path.End(), Width: pickHighlightW}.Op())
+}
+
+// return the pixel that the work position is drawn at, as an absolute position
+func (tp *ToolpathView) point(pos V4d) f32.Point {
+	x, y := tp.opts.Project(pos.Add(tp.opts.axes))
+	return f32.Pt(float32(x), float32(y))
+}
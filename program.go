@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	programBlockLines = 256     // lines per block of the line-offset index
+	programCacheSize  = 64      // blocks of lines to keep in memory
+	maxPathPoints     = 1 << 20 // simplify the toolpath preview when it has more points than this
+	maxPathTolerance  = 0.05    // mm, the most the toolpath preview is simplified
+)
+
+// a loaded G-code program
+//
+// the text of the program is spooled to a temporary file, and we only keep
+// the file offset of every programBlockLines'th line in memory, so that
+// huge programs don't use huge amounts of memory
+//
+// a Program is never modified after it is created, so it can be shared
+// between the runner, the UI, and the renderer without locking (the block
+// cache has its own lock)
+type Program struct {
+	Name      string
+	Source    *Program   // the unprocessed program, if Transform, Array, or HeightMap was applied
+	Transform Transform  // the transform that was applied to Source to make this program
+	Array     Array      // the step-and-repeat that was applied after Transform
+	HeightMap *HeightMap // the height map that was applied last, if any
+	ExpandErr error      // why the program couldn't be expanded; if set, it is only for showing where
+
+	file    *os.File
+	size    int64
+	nLines  int
+	offsets []int64 // file offset of the start of each block
+
+	cacheMu    sync.Mutex
+	cache      map[int][]string
+	cacheOrder []int
+
+	boundsMu    sync.Mutex
+	bounds      Bounds // of the toolpath, in work coordinates
+	knowsBounds bool
+}
+
+// progress of a background task, safe to share between goroutines
+type Progress struct {
+	done  atomic.Int64
+	total atomic.Int64
+}
+
+func (p *Progress) Set(done, total int64) {
+	p.done.Store(done)
+	p.total.Store(total)
+}
+
+// return the fraction complete, and whether the task is still in progress
+func (p *Progress) Fraction() (float64, bool) {
+	done := p.done.Load()
+	total := p.total.Load()
+	if total <= 0 || done >= total {
+		return 1, false
+	}
+	return float64(done) / float64(total), true
+}
+
+// builds a Program one line at a time
+type ProgramWriter struct {
+	p   *Program
+	w   *bufio.Writer
+	err error
+}
+
+func NewProgramWriter(name string) (*ProgramWriter, error) {
+	f, err := os.CreateTemp("", "pugsender-*.gcode")
+	if err != nil {
+		return nil, err
+	}
+	// we keep the file open for as long as the Program is in use, so we can
+	// remove it straight away (the *os.File finalizer closes it once the Program is
+	// garbage); this fails harmlessly on Windows, which leaves the temporary file behind
+	os.Remove(f.Name())
+
+	return &ProgramWriter{
+		p: &Program{
+			Name:  name,
+			file:  f,
+			cache: make(map[int][]string),
+		},
+		w: bufio.NewWriterSize(f, 1<<16),
+	}, nil
+}
+
+func (pw *ProgramWriter) WriteLine(line string) {
+	if pw.err != nil {
+		return
+	}
+	p := pw.p
+	if p.nLines%programBlockLines == 0 {
+		p.offsets = append(p.offsets, p.size)
+	}
+	p.nLines++
+	n, err := pw.w.WriteString(line + "\n")
+	p.size += int64(n)
+	pw.err = err
+}
+
+func (pw *ProgramWriter) Program() (*Program, error) {
+	if pw.err == nil {
+		pw.err = pw.w.Flush()
+	}
+	if pw.err != nil {
+		pw.Discard()
+		return nil, pw.err
+	}
+	return pw.p, nil
+}
+
+// give up on the program, closing its file; use this instead of Program()
+// when returning early on an error
+func (pw *ProgramWriter) Discard() {
+	pw.p.file.Close()
+}
+
+// read a program from reader, reporting progress in bytes if the size is known
+func LoadProgram(reader io.Reader, progress *Progress) (*Program, error) {
+	name := "<unknown>"
+	if f, ok := reader.(interface{ Name() string }); ok {
+		name = f.Name()
+	}
+	total := int64(0)
+	if f, ok := reader.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if fi, err := f.Stat(); err == nil {
+			total = fi.Size()
+		}
+	}
+
+	pw, err := NewProgramWriter(name)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 1<<16), 1<<20)
+
+	read := int64(0)
+	expand := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		pw.WriteLine(strings.TrimRight(line, "\r"))
+		if !expand && needsExpansion(line) {
+			expand = true
+		}
+
+		read += int64(len(line)) + 1
+		if progress != nil && pw.p.nLines%programBlockLines == 0 {
+			progress.Set(read, total)
+		}
+	}
+	if progress != nil {
+		progress.Set(total, total)
+	}
+	if err := scanner.Err(); err != nil {
+		pw.Discard()
+		return nil, err
+	}
+
+	p, err := pw.Program()
+	if err != nil || !expand {
+		return p, err
+	}
+	// the program uses parameters, expressions or O-words, which Grbl doesn't understand
+	expanded, err := ExpandProgram(p, progress)
+	var perr *ProgramError
+	if errors.As(err, &perr) {
+		// hand the unexpanded program back with the error, so that the
+		// error can be shown in place
+		p.ExpandErr = perr
+		perr.Program = p
+	}
+	return expanded, err
+}
+
+// apply a transform, then a step-and-repeat array, and then (if hm isn't
+// nil) a height map to the unprocessed program src
+func ProcessProgram(src *Program, t Transform, arr Array, hm *HeightMap, progress *Progress) (*Program, error) {
+	p := src
+	var err error
+	if !t.IsIdentity() {
+		p, err = t.Apply(p, progress)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !arr.IsIdentity() {
+		p, err = arr.Apply(p, progress)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if hm != nil {
+		p, err = hm.Apply(p, progress)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p != src {
+		p.Source = src
+		p.Transform = t
+		p.Array = arr
+		p.HeightMap = hm
+	}
+	return p, nil
+}
+
+// load the named file
+func LoadProgramFile(filename string, progress *Progress) (*Program, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadProgram(f, progress)
+}
+
+// return the number of lines in the program; a nil Program has no lines
+func (p *Program) Len() int {
+	if p == nil {
+		return 0
+	}
+	return p.nLines
+}
+
+func (p *Program) Line(i int) string {
+	lines := p.block(i / programBlockLines)
+	j := i % programBlockLines
+	if j >= len(lines) {
+		return ""
+	}
+	return lines[j]
+}
+
+// return the lines of block b, from the cache if possible
+func (p *Program) block(b int) []string {
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+
+	if lines, ok := p.cache[b]; ok {
+		return lines
+	}
+
+	start := p.offsets[b]
+	end := p.size
+	if b+1 < len(p.offsets) {
+		end = p.offsets[b+1]
+	}
+	buf := make([]byte, end-start)
+	_, err := p.file.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		fmt.Fprintf(os.Stderr, "read %s: %v\n", p.Name, err)
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+
+	// evict the oldest block if the cache is full
+	if len(p.cacheOrder) >= programCacheSize {
+		delete(p.cache, p.cacheOrder[0])
+		p.cacheOrder = p.cacheOrder[1:]
+	}
+	p.cache[b] = lines
+	p.cacheOrder = append(p.cacheOrder, b)
+
+	return lines
+}
+
+// call fn for each line in order, without going through the block cache,
+// until fn returns false
+func (p *Program) Each(fn func(i int, line string) bool) {
+	if p == nil {
+		return
+	}
+	scanner := bufio.NewScanner(io.NewSectionReader(p.file, 0, p.size))
+	scanner.Buffer(make([]byte, 0, 1<<16), 1<<20)
+	i := 0
+	for scanner.Scan() {
+		if !fn(i, scanner.Text()) {
+			return
+		}
+		i++
+	}
+}
+
+// interpret the toolpath, splitting arcs into pieces no further than
+// arcTolerance from the true arc, and reporting progress in lines; stop early
+// and return nil if cancelled() returns true
+//
+// collinear moves of the same kind and feed from the same line are merged;
+// if there are more than maxPathPoints segments, the tolerance grows (up to
+// maxPathTolerance) until there are half that many; moves from different
+// lines are never merged, so that every segment belongs to one line
+func (p *Program) ParseSegments(arcTolerance float64, progress *Progress, cancelled func() bool) []Segment {
+	in := NewInterpreter(arcTolerance)
+	bounds := EmptyBounds()
+
+	path := make([]Segment, 0)
+	tolerance := 0.001 // mm
+	nextSimplify := maxPathPoints
+
+	cancel := false
+	p.Each(func(i int, str string) bool {
+		if i%programBlockLines == 0 {
+			if cancelled != nil && cancelled() {
+				cancel = true
+				return false
+			}
+			if progress != nil {
+				progress.Set(int64(i), int64(p.nLines))
+			}
+		}
+
+		segs, err := in.Line(i, str)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error interpreting gcode line %d: [%s]: %s, ignoring\n", i+1, str, err)
+			return true
+		}
+		for _, seg := range segs {
+			bounds = bounds.AddKnown(seg.End, in)
+			path = appendSegment(path, seg, tolerance)
+		}
+		if len(path) >= nextSimplify && tolerance < maxPathTolerance {
+			for len(path) > maxPathPoints/2 && tolerance < maxPathTolerance {
+				tolerance = math.Min(tolerance*2, maxPathTolerance)
+				path = simplifySegments(path, tolerance)
+			}
+			// if that wasn't enough, don't try again until the path has
+			// doubled, so that this isn't done for every line
+			nextSimplify = max(maxPathPoints, 2*len(path))
+		}
+		return true
+	})
+	if progress != nil {
+		progress.Set(int64(p.nLines), int64(p.nLines))
+	}
+	if cancel {
+		return nil
+	}
+
+	p.boundsMu.Lock()
+	p.bounds = bounds.FillEmptyAxes()
+	p.knowsBounds = true
+	p.boundsMu.Unlock()
+
+	return path
+}
+
+// return the bounding box of the toolpath in work coordinates, and whether
+// it is known yet; it is known once ParseSegments has run to the end, which
+// the toolpath view does for every loaded program, so this doesn't block
+//
+// only positions that are known in work coordinates are included, so moves
+// after G53, G28, G30, or probing are left out until the program says where
+// the axis is again; the bounds are empty if the program doesn't move
+func (p *Program) Bounds() (Bounds, bool) {
+	p.boundsMu.Lock()
+	defer p.boundsMu.Unlock()
+	return p.bounds, p.knowsBounds
+}
+
+// append seg to path, extending the last segment instead if it is of the
+// same kind, at the same feed rate, and from the same line, and seg either
+// carries on in the same direction (within tolerance) or is shorter than
+// tolerance
+func appendSegment(path []Segment, seg Segment, tolerance float64) []Segment {
+	if l := len(path); l > 0 {
+		last := &path[l-1]
+		if last.Kind == seg.Kind && last.Feed == seg.Feed && last.Line == seg.Line && last.End == seg.Start &&
+			(seg.Length() < tolerance || distanceToLine(seg.Start, last.Start, seg.End) < tolerance) {
+			last.End = seg.End
+			return path
+		}
+	}
+	return append(path, seg)
+}
+
+func simplifySegments(path []Segment, tolerance float64) []Segment {
+	out := make([]Segment, 0, len(path)/2)
+	for _, seg := range path {
+		out = appendSegment(out, seg, tolerance)
+	}
+	return out
+}
+
+// return the distance from p to the line segment from a to b
+func distanceToLine(p, a, b V4d) float64 {
+	ab := b.Sub(a)
+	l2 := ab.Dot(ab)
+	if l2 == 0 {
+		return p.Sub(a).Length()
+	}
+	t := math.Max(0, math.Min(1, p.Sub(a).Dot(ab)/l2))
+	return p.Sub(a.Add(ab.Mul(t))).Length()
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gioui.org/app"
+	"gioui.org/layout"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"gioui.org/x/explorer"
+)
+
+type JobStatus int
+
+const (
+	JobPending JobStatus = iota
+	JobRunning
+	JobDone
+	JobFailed
+)
+
+func (s JobStatus) String() string {
+	if s == JobPending {
+		return "pending"
+	} else if s == JobRunning {
+		return "running"
+	} else if s == JobDone {
+		return "done"
+	} else if s == JobFailed {
+		return "failed"
+	} else {
+		return "???"
+	}
+}
+
+func ParseJobStatus(s string) (JobStatus, bool) {
+	for _, st := range []JobStatus{JobPending, JobRunning, JobDone, JobFailed} {
+		if s == st.String() {
+			return st, true
+		}
+	}
+	return JobPending, false
+}
+
+var wcsNames = []string{"G54", "G55", "G56", "G57", "G58", "G59"}
+
+type Job struct {
+	Path      string
+	Wcs       string // selected before the job starts, e.g. "G54"
+	Pause     bool   // wait for the user to press RUN before starting this job
+	Skip      bool
+	Status    JobStatus
+	Transform Transform // applied to the file when it is loaded
+
+	upBtn     widget.Clickable
+	downBtn   widget.Clickable
+	wcsBtn    widget.Clickable
+	pauseBtn  widget.Clickable
+	skipBtn   widget.Clickable
+	retryBtn  widget.Clickable
+	removeBtn widget.Clickable
+	xformBtn  widget.Clickable
+}
+
+// the queue is changed both by the UI and by goroutines started by the
+// runner, so everything below mu, including the fields of each Job, is
+// guarded by it
+type JobQueue struct {
+	app *App
+
+	mu      sync.Mutex
+	jobs    []*Job
+	current *Job     // the job that is loaded into the runner, if any
+	program *Program // the program loaded for current
+	running bool     // automatically start the next job when one completes
+	waiting bool     // the current job is loaded, waiting for the user to press RUN
+	err     string   // why the last job couldn't be started, if it couldn't
+
+	addBtn widget.Clickable
+	runBtn widget.Clickable
+}
+
+func NewJobQueue(app *App) *JobQueue {
+	return &JobQueue{app: app}
+}
+
+func (q *JobQueue) QueueFile() string {
+	return filepath.Join(ConfDir(), "queue.conf")
+}
+
+// write the queue to queue.conf; call with q.mu held
+func (q *JobQueue) Save() {
+	filename := q.QueueFile()
+	f, err := os.Create(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "write %s: %v\n", filename, err)
+		return
+	}
+	defer f.Close()
+
+	for _, job := range q.jobs {
+		fmt.Fprintf(f, "job=%s,%d,%d,%s,%s\n", job.Wcs, btoi(job.Pause), btoi(job.Skip), job.Status, job.Path)
+		if !job.Transform.IsIdentity() {
+			fmt.Fprintf(f, "transform=%s\n", job.Transform)
+		}
+	}
+}
+
+func (q *JobQueue) Load() {
+	filename := q.QueueFile()
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "read %s: %v\n", filename, err)
+		}
+		return
+	}
+	defer f.Close()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && parts[0] == "transform" && len(q.jobs) > 0 {
+			// applies to the job on the previous line
+			t, err := ParseTransform(parts[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+				continue
+			}
+			q.jobs[len(q.jobs)-1].Transform = t
+			continue
+		}
+		if len(parts) != 2 || parts[0] != "job" {
+			fmt.Fprintf(os.Stderr, "%s: unrecognised line: [%s]\n", filename, line)
+			continue
+		}
+		fields := strings.SplitN(parts[1], ",", 5)
+		if len(fields) != 5 {
+			fmt.Fprintf(os.Stderr, "%s: bad job: [%s]\n", filename, line)
+			continue
+		}
+		status, ok := ParseJobStatus(fields[3])
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s: unrecognised job status: [%s]\n", filename, fields[3])
+		}
+		if status == JobRunning {
+			// we must have been interrupted
+			status = JobFailed
+		}
+		q.jobs = append(q.jobs, &Job{
+			Wcs:    fields[0],
+			Pause:  fields[1] == "1",
+			Skip:   fields[2] == "1",
+			Status: status,
+			Path:   fields[4],
+		})
+	}
+}
+
+func (q *JobQueue) Add(path string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = append(q.jobs, &Job{Path: path, Wcs: "G54"})
+	q.Save()
+	q.app.w.Invalidate()
+}
+
+// choose some files and add them to the end of the queue
+func (q *JobQueue) AddFiles() {
+	go func() {
+		w := app.NewWindow(app.Title("Add G-code files to queue"))
+		e := explorer.NewExplorer(w)
+		files, err := e.ChooseFiles()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "explorer.ChooseFiles(): %v\n", err)
+			return
+		}
+		for _, f := range files {
+			if named, ok := f.(interface{ Name() string }); ok {
+				q.Add(named.Name())
+			} else {
+				fmt.Fprintf(os.Stderr, "can't queue a file with no name\n")
+			}
+			f.Close()
+		}
+	}()
+}
+
+// start running the queue from the first pending job
+func (q *JobQueue) Start() {
+	q.mu.Lock()
+	if q.current != nil {
+		q.mu.Unlock()
+		return
+	}
+	if m := q.app.runningMacro.Load(); m != nil {
+		q.err = fmt.Sprintf("can't start the queue while macro %s is running", m.Name)
+		q.mu.Unlock()
+		q.app.w.Invalidate()
+		return
+	}
+	q.running = true
+	q.mu.Unlock()
+	q.StartNext()
+}
+
+// load the next pending job, and start it unless it wants to pause first;
+// the file is loaded without q.mu held, so that the UI doesn't wait for it
+func (q *JobQueue) StartNext() {
+	for {
+		q.mu.Lock()
+		if q.current != nil {
+			// another goroutine got here first
+			q.mu.Unlock()
+			return
+		}
+		job := q.nextPending()
+		if job == nil {
+			// nothing left to run
+			q.running = false
+			q.mu.Unlock()
+			q.app.w.Invalidate()
+			return
+		}
+		job.Status = JobRunning
+		q.current = job
+		q.program = nil
+		q.err = ""
+		path, xform, wcs := job.Path, job.Transform, job.Wcs
+		q.Save()
+		q.mu.Unlock()
+		q.app.w.Invalidate()
+
+		p, err := LoadProgramFile(path, &q.app.loadProgress)
+		if err == nil && !xform.IsIdentity() {
+			p, err = xform.Apply(p, &q.app.loadProgress)
+		}
+		if err != nil {
+			// try the next one
+			fmt.Fprintf(os.Stderr, "load %s: %v\n", path, err)
+			q.mu.Lock()
+			job.Status = JobFailed
+			q.current = nil
+			q.Save()
+			q.mu.Unlock()
+			continue
+		}
+
+		// set before loading, so that ProgramLoaded() recognises it
+		q.mu.Lock()
+		q.program = p
+		q.mu.Unlock()
+		if err := q.app.gcode.Load(p); err != nil {
+			// the runner is busy with something else, so leave the job for later
+			fmt.Fprintf(os.Stderr, "queue: %v\n", err)
+			q.mu.Lock()
+			job.Status = JobPending
+			q.current = nil
+			q.program = nil
+			q.running = false
+			q.err = err.Error()
+			q.Save()
+			q.mu.Unlock()
+			q.app.w.Invalidate()
+			return
+		}
+
+		if wcs != "" {
+			q.app.g.CommandWait(wcs)
+		}
+
+		q.mu.Lock()
+		pause := job.Pause
+		q.waiting = pause
+		q.mu.Unlock()
+		q.app.w.Invalidate()
+
+		if !pause {
+			q.app.gcodeRunnerChan <- RunnerCmd{Kind: CmdStart}
+		}
+		return
+	}
+}
+
+// return the first job that is waiting to run, or nil; call with q.mu held
+func (q *JobQueue) nextPending() *Job {
+	for _, job := range q.jobs {
+		if job.Status == JobPending && !job.Skip {
+			return job
+		}
+	}
+	return nil
+}
+
+// true if p is the program loaded for the current job, or that program
+// reprocessed (e.g. by the transform panel); call with q.mu held
+func (q *JobQueue) isCurrent(p *Program) bool {
+	if q.current == nil || q.program == nil || p == nil {
+		return false
+	}
+	return p == q.program || unprocessed(p) == unprocessed(q.program)
+}
+
+func unprocessed(p *Program) *Program {
+	for p.Source != nil {
+		p = p.Source
+	}
+	return p
+}
+
+// called by the runner whenever a program is loaded; if it isn't the
+// current job's, the job goes back to pending, because it's no longer loaded
+func (q *JobQueue) ProgramLoaded(p *Program) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.current == nil || q.program == nil {
+		// no job, or its program is still being read, and will replace p
+		return
+	}
+	if q.isCurrent(p) {
+		q.program = p
+		return
+	}
+	q.current.Status = JobPending
+	q.current = nil
+	q.program = nil
+	q.running = false
+	q.waiting = false
+	q.Save()
+	q.app.w.Invalidate()
+}
+
+// called by the runner when the program p has been sent to completion
+func (q *JobQueue) JobComplete(p *Program) {
+	q.mu.Lock()
+	if !q.isCurrent(p) {
+		// not a queued job
+		q.mu.Unlock()
+		return
+	}
+	q.current.Status = JobDone
+	q.current = nil
+	q.program = nil
+	q.Save()
+	running := q.running
+	q.mu.Unlock()
+	if running {
+		q.StartNext()
+	}
+}
+
+// called by the runner when the program p is stopped
+func (q *JobQueue) JobStopped(p *Program) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.isCurrent(p) {
+		return
+	}
+	q.current.Status = JobFailed
+	q.current = nil
+	q.program = nil
+	q.running = false
+	q.waiting = false
+	q.Save()
+	q.app.w.Invalidate()
+}
+
+// call with q.mu held
+func (q *JobQueue) Move(i, delta int) {
+	j := i + delta
+	if j < 0 || j >= len(q.jobs) {
+		return
+	}
+	q.jobs[i], q.jobs[j] = q.jobs[j], q.jobs[i]
+	q.Save()
+}
+
+// call with q.mu held
+func (q *JobQueue) Remove(i int) {
+	if q.jobs[i] == q.current {
+		return
+	}
+	q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+	q.Save()
+}
+
+func (q *JobQueue) Layout(gtx C) D {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.jobs) == 0 {
+		return D{}
+	}
+
+	if q.waiting && q.app.rs.Running {
+		// the user pressed RUN
+		q.waiting = false
+	}
+
+	for q.addBtn.Clicked(gtx) {
+		q.AddFiles()
+	}
+	for q.runBtn.Clicked(gtx) {
+		go q.Start()
+	}
+
+	// handle the buttons on each job before laying any out, because
+	// they can reorder the list
+	for i := 0; i < len(q.jobs); i++ {
+		job := q.jobs[i]
+		for job.upBtn.Clicked(gtx) {
+			q.Move(i, -1)
+		}
+		for job.downBtn.Clicked(gtx) {
+			q.Move(i, +1)
+		}
+		for job.wcsBtn.Clicked(gtx) {
+			job.Wcs = nextWcs(job.Wcs)
+			q.Save()
+		}
+		for job.pauseBtn.Clicked(gtx) {
+			job.Pause = !job.Pause
+			q.Save()
+		}
+		for job.skipBtn.Clicked(gtx) {
+			job.Skip = !job.Skip
+			q.Save()
+		}
+		for job.retryBtn.Clicked(gtx) {
+			if job != q.current {
+				job.Status = JobPending
+				q.Save()
+			}
+		}
+		for job.xformBtn.Clicked(gtx) {
+			// use the transform of the loaded program, or clear it
+			if job.Transform.IsIdentity() {
+				job.Transform = q.app.xform.Current()
+			} else {
+				job.Transform = Transform{}
+			}
+			q.Save()
+		}
+		for job.removeBtn.Clicked(gtx) {
+			q.Remove(i)
+			i--
+		}
+	}
+
+	children := []layout.FlexChild{
+		layout.Rigid(func(gtx C) D {
+			runLbl := "RUN QUEUE"
+			if q.running {
+				runLbl = "QUEUE RUNNING"
+			}
+			return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx,
+				material.H6(q.app.th, "Queue ").Layout,
+				material.Button(q.app.th, &q.addBtn, "ADD").Layout,
+				material.Button(q.app.th, &q.runBtn, runLbl).Layout,
+			)
+		}),
+	}
+	if q.waiting && q.current != nil {
+		children = append(children, layout.Rigid(material.Body1(q.app.th, fmt.Sprintf("%s loaded in %s: press RUN to start", filepath.Base(q.current.Path), q.current.Wcs)).Layout))
+	}
+	if q.err != "" {
+		errLbl := material.Body1(q.app.th, q.err)
+		errLbl.Color = rgb(255, 128, 128)
+		children = append(children, layout.Rigid(errLbl.Layout))
+	}
+	for _, job := range q.jobs {
+		job := job
+		children = append(children, layout.Rigid(func(gtx C) D {
+			return q.LayoutJob(gtx, job)
+		}))
+	}
+
+	return Panel{Width: 1, CornerRadius: 5, Color: grey(128), BackgroundColor: grey(16), Margin: layout.UniformInset(5), Padding: layout.UniformInset(5)}.Layout(gtx, func(gtx C) D {
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx, children...)
+	})
+}
+
+func (q *JobQueue) LayoutJob(gtx C, job *Job) D {
+	pauseLbl := "+PAUSE"
+	if job.Pause {
+		pauseLbl = "-PAUSE"
+	}
+	skipLbl := "SKIP"
+	if job.Skip {
+		skipLbl = "UNSKIP"
+	}
+	status := job.Status.String()
+	if job.Skip {
+		status = "skip"
+	}
+
+	xformLbl := "+XFORM"
+	name := filepath.Base(job.Path)
+	if !job.Transform.IsIdentity() {
+		xformLbl = "-XFORM"
+		name += " [" + job.Transform.String() + "]"
+	}
+
+	label := material.Body1(q.app.th, fmt.Sprintf("%-7s %s", status, name))
+	if job == q.current {
+		label.Color = rgb(128, 255, 128)
+	} else if job.Status == JobDone || job.Skip {
+		label.Color = grey(128)
+	} else if job.Status == JobFailed {
+		label.Color = rgb(255, 128, 128)
+	}
+
+	return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx,
+		label.Layout,
+		material.Button(q.app.th, &job.wcsBtn, job.Wcs).Layout,
+		material.Button(q.app.th, &job.pauseBtn, pauseLbl).Layout,
+		material.Button(q.app.th, &job.skipBtn, skipLbl).Layout,
+		material.Button(q.app.th, &job.xformBtn, xformLbl).Layout,
+		material.Button(q.app.th, &job.retryBtn, "RETRY").Layout,
+		material.Button(q.app.th, &job.upBtn, "UP").Layout,
+		material.Button(q.app.th, &job.downBtn, "DOWN").Layout,
+		material.Button(q.app.th, &job.removeBtn, "DEL").Layout,
+	)
+}
+
+func nextWcs(wcs string) string {
+	for i, name := range wcsNames {
+		if name == wcs {
+			return wcsNames[(i+1)%len(wcsNames)]
+		}
+	}
+	return wcsNames[0]
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
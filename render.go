@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// options for "pugsender render"
+type RenderOpts struct {
+	In     string
+	Out    string
+	Width  int
+	Height int
+	View   int // index into viewPresets
+}
+
+func renderUsage() {
+	fmt.Fprintf(os.Stderr, `usage: pugsender render <in.nc> <out.png|out.svg> [options]
+
+options:
+	--size WxH    Image size in pixels (default 800x600).
+	--view NAME   One of: %s (default top).
+`, strings.Join(viewPresetNames(), ", "))
+}
+
+func viewPresetNames() []string {
+	names := make([]string, len(viewPresets))
+	for i, v := range viewPresets {
+		names[i] = v.Name
+	}
+	return names
+}
+
+// parse the arguments after "render"
+func ParseRenderOpts(args []string) (RenderOpts, error) {
+	opts := RenderOpts{Width: 800, Height: 600}
+	files := make([]string, 0, 2)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--size" || arg == "--view" {
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("%s needs a value", arg)
+			}
+			i++
+			val := args[i]
+			if arg == "--size" {
+				w, h, ok := strings.Cut(strings.ToLower(val), "x")
+				width, werr := strconv.Atoi(w)
+				height, herr := strconv.Atoi(h)
+				if !ok || werr != nil || herr != nil || width <= 0 || height <= 0 {
+					return opts, fmt.Errorf("bad size: [%s], want WxH", val)
+				}
+				opts.Width, opts.Height = width, height
+			} else {
+				opts.View = -1
+				for j, v := range viewPresets {
+					if v.Name == val {
+						opts.View = j
+					}
+				}
+				if opts.View < 0 {
+					return opts, fmt.Errorf("unknown view: [%s]", val)
+				}
+			}
+		} else if strings.HasPrefix(arg, "--") {
+			return opts, fmt.Errorf("unrecognised option: [%s]", arg)
+		} else {
+			files = append(files, arg)
+		}
+	}
+	if len(files) != 2 {
+		return opts, fmt.Errorf("need an input file and an output file")
+	}
+	opts.In, opts.Out = files[0], files[1]
+	return opts, nil
+}
+
+// render a preview of a G-code file to a PNG or SVG file without opening a
+// window; returns the exit status
+func RenderCommand(args []string) int {
+	opts, err := ParseRenderOpts(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "render: %v\n", err)
+		renderUsage()
+		return 1
+	}
+
+	prog, err := LoadProgramFile(opts.In, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "render: load %s: %v\n", opts.In, err)
+		return 1
+	}
+	segments := prog.ParseSegments(defaultArcTolerance, nil, nil)
+
+	p := NewRenderPath(segments, opts.Width, opts.Height, opts.View)
+
+	f, err := os.Create(opts.Out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "render: %v\n", err)
+		return 1
+	}
+	if strings.ToLower(filepath.Ext(opts.Out)) == ".svg" {
+		err = p.WriteSVG(f)
+	} else {
+		err = p.WritePNG(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "render: write %s: %v\n", opts.Out, err)
+		return 1
+	}
+	return 0
+}
+
+// return a Path showing the whole toolpath from the given view preset, with
+// the work origin at machine zero
+func NewRenderPath(segments []Segment, width, height, view int) *Path {
+	p := NewPath()
+	p.showAxes = true
+	p.showGridLines = true
+	p.palette = ReadPalette()
+	p.doneLine = -1
+	p.widthPx, p.heightPx = width, height
+	v := viewPresets[view]
+	p.yaw, p.pitch = v.Yaw, v.Pitch
+	p.SetGCode(segments)
+	if b, ok := p.segmentBounds(); ok {
+		p.centre, p.pxPerMm = p.Fit(b)
+	}
+	return p
+}
+
+// render the layers onto the background colour and write them as a PNG
+func (p *Path) WritePNG(w io.Writer) error {
+	p.Render()
+	bounds := image.Rect(0, 0, p.widthPx, p.heightPx)
+	im := image.NewRGBA(bounds)
+	draw.Draw(im, bounds, image.NewUniform(grey(0)), image.Point{}, draw.Src)
+	draw.Draw(im, bounds, p.Image, image.Point{}, draw.Over)
+	return png.Encode(w, im)
+}
+
+// write the toolpath as SVG, one polyline per run of joined-up segments of
+// the same colour
+func (p *Path) WriteSVG(w io.Writer) error {
+	zlo, zhi := 0.0, 0.0
+	if b, ok := p.segmentBounds(); ok {
+		zlo, zhi = b.Min.Z, b.Max.Z
+	}
+
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n", p.widthPx, p.heightPx, p.widthPx, p.heightPx)
+	fmt.Fprintf(w, "<rect width=\"100%%\" height=\"100%%\" fill=\"%s\"/>\n", formatColour(grey(0)))
+
+	var points []string
+	var col color.NRGBA
+	last := V4d{}
+	flush := func() {
+		if len(points) > 1 {
+			fmt.Fprintf(w, "<polyline fill=\"none\" stroke=\"%s\" points=\"%s\"/>\n", formatColour(col), strings.Join(points, " "))
+		}
+		points = points[:0]
+	}
+	point := func(pos V4d) string {
+		x, y := p.Project(pos.Add(p.axes))
+		return fmt.Sprintf("%.2f,%.2f", x, y)
+	}
+	for _, seg := range p.gcodeSegments {
+		c := p.palette.SegmentColour(seg, zlo, zhi)
+		if len(points) == 0 || c != col || seg.Start != last {
+			flush()
+			col = c
+			points = append(points, point(seg.Start))
+		}
+		points = append(points, point(seg.End))
+		last = seg.End
+	}
+	flush()
+
+	_, err := fmt.Fprintf(w, "</svg>\n")
+	return err
+}
@@ -27,7 +27,7 @@ func (a *App) AutoConnect() {
 		for {
 			<-ticker.C
 			// if we already have a connection, or we don't want to auto-connect, do nothing
-			if !a.gs.Closed || !a.autoConnect {
+			if !a.LatestStatus().Closed || !a.autoConnect {
 				continue
 			}
 
@@ -58,7 +58,7 @@ func (a *App) TryToConnect(port string) {
 	select {
 	case gs := <-ch:
 		// if this port gave us a successful grbl status update, and we still want auto-connection, use this one
-		if !gs.Closed && a.gs.Closed && a.autoConnect {
+		if !gs.Closed && a.LatestStatus().Closed && a.autoConnect {
 			a.Connect(g, ch)
 		}
 	case <-time.After(time.Second):
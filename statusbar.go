@@ -22,6 +22,22 @@ func (a *App) LayoutStatusBar(gtx C) D {
 			layout.Rigid(a.LayoutBufferState),
 			layout.Rigid(layout.Spacer{Width: 4}.Layout),
 			layout.Rigid(a.Label(fmt.Sprintf("Pn:%s", a.gs.Pn)).Layout),
+			layout.Rigid(layout.Spacer{Width: 4}.Layout),
+			layout.Rigid(a.LayoutLoadState),
+			layout.Rigid(layout.Spacer{Width: 4}.Layout),
+			layout.Rigid(func(gtx C) D {
+				if m := a.runningMacro.Load(); m != nil {
+					return a.Label("MACRO:" + m.Name).Layout(gtx)
+				}
+				return D{}
+			}),
+			layout.Rigid(layout.Spacer{Width: 4}.Layout),
+			layout.Rigid(func(gtx C) D {
+				if op := a.job.CurrentOperation(); op != "" {
+					return a.Label("OP:" + op).Layout(gtx)
+				}
+				return D{}
+			}),
 		)
 	})
 }
@@ -41,6 +57,30 @@ func (a *App) LayoutBufferState(gtx C) D {
 	)
 }
 
+// show progress of loading and parsing programs, if either is happening
+func (a *App) LayoutLoadState(gtx C) D {
+	th := material.NewTheme()
+	th.TextSize = a.th.TextSize
+	children := make([]layout.FlexChild, 0)
+	if f, active := a.loadProgress.Fraction(); active {
+		children = append(children, layout.Rigid(func(gtx C) D {
+			return LayoutProgressBar(gtx, f, th, "LOAD")
+		}))
+	}
+	if f, active := a.tp.parseProgress.Fraction(); active {
+		children = append(children, layout.Rigid(func(gtx C) D {
+			return LayoutProgressBar(gtx, f, th, "PARSE")
+		}))
+	}
+	if len(children) == 0 {
+		return D{}
+	}
+	// nothing else invalidates the frame while a program loads, so keep
+	// redrawing to update the progress bars
+	a.w.Invalidate()
+	return layout.Flex{Axis: layout.Vertical}.Layout(gtx, children...)
+}
+
 // clamp1 limits v to range [0..1].
 func clamp1(v float64) float64 {
 	if v >= 1 {
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"gioui.org/layout"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+)
+
+const (
+	stockCells     = 400 // cells along the longest side of the stock
+	stockSnapshots = 32  // copies of the stock kept along the program, for scrubbing
+	stockCheckSegs = 256 // segments to simulate between checks for a newer request
+)
+
+type CutterShape int
+
+const (
+	CutterFlat CutterShape = iota
+	CutterBall
+	CutterVBit
+)
+
+func (s CutterShape) String() string {
+	if s == CutterFlat {
+		return "FLAT"
+	} else if s == CutterBall {
+		return "BALL"
+	} else if s == CutterVBit {
+		return "V-BIT"
+	} else {
+		return "???"
+	}
+}
+
+// the tool used for the stock removal simulation
+type Cutter struct {
+	Shape    CutterShape
+	Diameter float64 // mm
+	Angle    float64 // included angle of a V-bit, in degrees
+}
+
+// return how far above the tip the cutter's surface is at distance d from
+// its axis, or false if d is outside the cutter
+func (c Cutter) Profile(d float64) (float64, bool) {
+	r := c.Diameter / 2
+	if d > r {
+		return 0, false
+	}
+	if c.Shape == CutterBall {
+		return r - math.Sqrt(r*r-d*d), true
+	} else if c.Shape == CutterVBit {
+		half := c.Angle / 2 * math.Pi / 180
+		if half <= 0 {
+			return 0, d == 0
+		}
+		return d / math.Tan(half), true
+	}
+	return 0, true
+}
+
+// the top surface of the stock, as a grid of heights, in work coordinates
+type StockMap struct {
+	Stock  Bounds
+	Cell   float64 // mm between grid points
+	NX, NY int
+	Z      []float32 // NX*NY heights, row by row starting from Stock.Min.Y
+}
+
+func NewStockMap(stock Bounds) *StockMap {
+	w, h := stock.Max.X-stock.Min.X, stock.Max.Y-stock.Min.Y
+	m := &StockMap{Stock: stock, Cell: math.Max(w, h) / stockCells}
+	if m.Cell <= 0 {
+		m.Cell = 1
+	}
+	m.NX = int(math.Ceil(w/m.Cell)) + 1
+	m.NY = int(math.Ceil(h/m.Cell)) + 1
+	m.Z = make([]float32, m.NX*m.NY)
+	for i := range m.Z {
+		m.Z[i] = float32(stock.Max.Z)
+	}
+	return m
+}
+
+func (m *StockMap) Copy() *StockMap {
+	c := *m
+	c.Z = append([]float32(nil), m.Z...)
+	return &c
+}
+
+func (m *StockMap) At(i, j int) float64 {
+	return float64(m.Z[j*m.NX+i])
+}
+
+// the position of grid point (i,j), at its current height
+func (m *StockMap) Point(i, j int) V4d {
+	return V4d{X: m.Stock.Min.X + float64(i)*m.Cell, Y: m.Stock.Min.Y + float64(j)*m.Cell, Z: m.At(i, j)}
+}
+
+// the heights of a cutter around its tip, in grid cells
+type cutterKernel []struct {
+	di, dj int
+	dz     float32
+}
+
+func newCutterKernel(c Cutter, cell float64) cutterKernel {
+	n := int(math.Ceil(c.Diameter / 2 / cell))
+	k := make(cutterKernel, 0, (2*n+1)*(2*n+1))
+	for dj := -n; dj <= n; dj++ {
+		for di := -n; di <= n; di++ {
+			dz, ok := c.Profile(math.Hypot(float64(di), float64(dj)) * cell)
+			if ok {
+				k = append(k, struct {
+					di, dj int
+					dz     float32
+				}{di, dj, float32(dz)})
+			}
+		}
+	}
+	return k
+}
+
+// lower the stock wherever the cutter goes along the segment; r is the
+// cutter's radius
+func (m *StockMap) Cut(seg Segment, k cutterKernel, r float64) {
+	top := m.Stock.Max.Z
+	if seg.Start.Z >= top && seg.End.Z >= top {
+		return
+	}
+	if math.Max(seg.Start.X, seg.End.X)+r < m.Stock.Min.X || math.Min(seg.Start.X, seg.End.X)-r > m.Stock.Max.X ||
+		math.Max(seg.Start.Y, seg.End.Y)+r < m.Stock.Min.Y || math.Min(seg.Start.Y, seg.End.Y)-r > m.Stock.Max.Y {
+		return
+	}
+
+	// put the cutter down every half cell along the segment
+	n := int(math.Ceil(seg.Length()/(m.Cell/2))) + 1
+	for s := 0; s <= n; s++ {
+		pos := seg.Start.Add(seg.End.Sub(seg.Start).Mul(float64(s) / float64(n)))
+		if pos.Z >= top {
+			continue
+		}
+		ci := int(math.Round((pos.X - m.Stock.Min.X) / m.Cell))
+		cj := int(math.Round((pos.Y - m.Stock.Min.Y) / m.Cell))
+		z := float32(pos.Z)
+		for _, kk := range k {
+			i, j := ci+kk.di, cj+kk.dj
+			if i < 0 || j < 0 || i >= m.NX || j >= m.NY {
+				continue
+			}
+			if h := z + kk.dz; h < m.Z[j*m.NX+i] {
+				m.Z[j*m.NX+i] = h
+			}
+		}
+	}
+}
+
+// the colour of the stock at grid point (i,j), shaded by the slope of the
+// surface; cuts below the bottom of the stock are red
+func (m *StockMap) Colour(i, j int) color.NRGBA {
+	z := m.At(i, j)
+	dzdx := (m.At(min(i+1, m.NX-1), j) - m.At(max(i-1, 0), j)) / (2 * m.Cell)
+	dzdy := (m.At(i, min(j+1, m.NY-1)) - m.At(i, max(j-1, 0))) / (2 * m.Cell)
+	normal := V4d{X: -dzdx, Y: -dzdy, Z: 1}
+	normal = normal.Div(normal.Length())
+	light := V4d{X: -1, Y: 1, Z: 2}
+	light = light.Div(light.Length())
+	shade := 0.35 + 0.65*math.Max(0, normal.Dot(light))
+
+	col := rgb(255, 32, 32)
+	if z >= m.Stock.Min.Z-0.001 {
+		t := 1.0
+		if m.Stock.Max.Z > m.Stock.Min.Z {
+			t = clamp1((z - m.Stock.Min.Z) / (m.Stock.Max.Z - m.Stock.Min.Z))
+		}
+		col = mixColour(rgb(96, 72, 48), rgb(220, 190, 140), t)
+	}
+	return color.NRGBA{R: uint8(float64(col.R) * shade), G: uint8(float64(col.G) * shade), B: uint8(float64(col.B) * shade), A: 255}
+}
+
+// draw the stock's surface onto im, as a square per grid point, keeping the
+// nearest where they overlap
+func (p *Path) DrawStock(im *image.RGBA, m *StockMap, offset V4d) {
+	w, h := p.widthPx, p.heightPx
+	depth := make([]float64, w*h)
+	for i := range depth {
+		depth[i] = math.Inf(-1)
+	}
+	size := int(math.Ceil(m.Cell*p.pxPerMm)) + 1
+	for j := 0; j < m.NY; j++ {
+		if p.cancelled() {
+			return
+		}
+		for i := 0; i < m.NX; i++ {
+			pos := m.Point(i, j).Add(offset)
+			x, y := p.Project(pos)
+			x0, y0 := int(x)-size/2, int(y)-size/2
+			if x0+size < 0 || y0+size < 0 || x0 >= w || y0 >= h {
+				continue
+			}
+			d := p.ViewPos(pos).Z
+			col := m.Colour(i, j) // opaque, so the same as RGBA
+			rgba := color.RGBA{R: col.R, G: col.G, B: col.B, A: 255}
+			for py := max(y0, 0); py < min(y0+size, h); py++ {
+				for px := max(x0, 0); px < min(x0+size, w); px++ {
+					if d > depth[py*w+px] {
+						depth[py*w+px] = d
+						im.SetRGBA(px, py, rgba)
+					}
+				}
+			}
+		}
+	}
+}
+
+// a request to simulate the first upTo segments
+type stockRequest struct {
+	segments []Segment
+	stock    Bounds
+	cutter   Cutter
+	upTo     int
+}
+
+// whether the stock would be the same at the start of both requests
+func (r *stockRequest) sameJob(o *stockRequest) bool {
+	return o != nil && len(r.segments) == len(o.segments) && (len(r.segments) == 0 || &r.segments[0] == &o.segments[0]) &&
+		r.stock == o.stock && r.cutter == o.cutter
+}
+
+// simulates stock removal in the background; only the latest request is
+// worked on, and earlier ones are abandoned
+type StockSim struct {
+	app     *App
+	want    atomic.Pointer[stockRequest]
+	running atomic.Bool
+
+	resultMu  sync.Mutex
+	result    *StockMap
+	resultReq *stockRequest
+
+	// owned by the simulation goroutine
+	job       *stockRequest
+	snapshots map[int]*StockMap // by number of segments simulated
+}
+
+func (s *StockSim) Request(req *stockRequest) {
+	s.want.Store(req)
+	if s.running.CompareAndSwap(false, true) {
+		go s.run()
+	}
+}
+
+func (s *StockSim) run() {
+	for {
+		req := s.want.Load()
+		if m := s.simulate(req); m != nil {
+			s.resultMu.Lock()
+			s.result, s.resultReq = m, req
+			s.resultMu.Unlock()
+			s.app.w.Invalidate()
+		}
+		s.running.Store(false)
+		// a request that came in after we finished won't have started a goroutine
+		if s.want.Load() == req || !s.running.CompareAndSwap(false, true) {
+			return
+		}
+	}
+}
+
+// return the stock after req.upTo segments, or nil if a newer request
+// came in first
+func (s *StockSim) simulate(req *stockRequest) *StockMap {
+	if !req.sameJob(s.job) {
+		s.job = req
+		s.snapshots = map[int]*StockMap{0: NewStockMap(req.stock)}
+	}
+
+	// start from the latest snapshot before the point we want
+	start := 0
+	for n := range s.snapshots {
+		if n <= req.upTo && n > start {
+			start = n
+		}
+	}
+	m := s.snapshots[start].Copy()
+	every := max(1, len(req.segments)/stockSnapshots)
+	k := newCutterKernel(req.cutter, m.Cell)
+	for i := start; i < req.upTo; i++ {
+		m.Cut(req.segments[i], k, req.cutter.Diameter/2)
+		if (i+1)%every == 0 && s.snapshots[i+1] == nil {
+			s.snapshots[i+1] = m.Copy()
+		}
+		if (i+1)%stockCheckSegs == 0 && s.want.Load() != req {
+			return nil
+		}
+	}
+	return m
+}
+
+// return the latest simulated stock
+func (s *StockSim) Result() (*StockMap, *stockRequest) {
+	s.resultMu.Lock()
+	defer s.resultMu.Unlock()
+	return s.result, s.resultReq
+}
+
+type SimPanel struct {
+	app     *App
+	visible bool
+	sim     StockSim
+
+	cutter       Cutter
+	stock        Bounds // in work coordinates
+	stockProgram *Program
+	last         *stockRequest
+
+	minXEdit  EditableNum
+	minYEdit  EditableNum
+	sizeXEdit EditableNum
+	sizeYEdit EditableNum
+	thickEdit EditableNum
+	diaEdit   EditableNum
+	angleEdit EditableNum
+	shapeBtn  widget.Clickable
+	fitBtn    widget.Clickable
+	hideBtn   widget.Clickable
+	scrub     widget.Float // how far through the program to simulate
+}
+
+func NewSimPanel(app *App) *SimPanel {
+	sp := &SimPanel{app: app}
+	sp.sim.app = app
+	sp.cutter = Cutter{Shape: CutterFlat, Diameter: 6, Angle: 90}
+
+	edit := func(e *EditableNum, label string, set func(v float64)) {
+		e.app = app
+		e.Label = label
+		e.Callback = set
+	}
+	edit(&sp.minXEdit, "Stock X", func(v float64) {
+		sp.stock.Max.X += v - sp.stock.Min.X
+		sp.stock.Min.X = v
+	})
+	edit(&sp.minYEdit, " Y", func(v float64) {
+		sp.stock.Max.Y += v - sp.stock.Min.Y
+		sp.stock.Min.Y = v
+	})
+	edit(&sp.sizeXEdit, "  Width", func(v float64) { sp.stock.Max.X = sp.stock.Min.X + math.Max(v, 0.001) })
+	edit(&sp.sizeYEdit, " Length", func(v float64) { sp.stock.Max.Y = sp.stock.Min.Y + math.Max(v, 0.001) })
+	edit(&sp.thickEdit, " Thick", func(v float64) { sp.stock.Min.Z = sp.stock.Max.Z - math.Max(v, 0.001) })
+	edit(&sp.diaEdit, "Tool dia", func(v float64) { sp.cutter.Diameter = math.Max(v, 0.01) })
+	edit(&sp.angleEdit, " Angle", func(v float64) { sp.cutter.Angle = math.Max(1, math.Min(179, v)) })
+	return sp
+}
+
+// set the stock to the size given in the program's comments, or else to
+// the box around the toolpath, from Z0 down to its deepest cut
+func (sp *SimPanel) FitStock() {
+	tp := sp.app.tp
+	if info := sp.app.job.Info(tp.program); info != nil && info.HasStock {
+		sp.stock = info.StockMM()
+		return
+	}
+	b := tp.programBounds
+	if b.Empty() {
+		sp.stock = Bounds{Max: V4d{X: 100, Y: 100}, Min: V4d{Z: -10}}
+		return
+	}
+	r := sp.cutter.Diameter / 2
+	sp.stock = Bounds{
+		Min: V4d{X: b.Min.X - r, Y: b.Min.Y - r, Z: math.Min(b.Min.Z, -1)},
+		Max: V4d{X: b.Max.X + r, Y: b.Max.Y + r, Z: 0},
+	}
+}
+
+// return the simulated stock to draw on the toolpath view, or nil
+func (sp *SimPanel) Stock() *StockMap {
+	if !sp.visible {
+		return nil
+	}
+	m, req := sp.sim.Result()
+	if req == nil || !req.sameJob(sp.last) {
+		return nil
+	}
+	return m
+}
+
+// the number of segments of the toolpath up to the end of line
+func segmentsUpToLine(segments []Segment, line int) int {
+	return sort.Search(len(segments), func(k int) bool { return segments[k].Line > line })
+}
+
+func (sp *SimPanel) Layout(gtx C) D {
+	if !sp.visible {
+		return D{}
+	}
+
+	tp := sp.app.tp
+	if sp.stockProgram != tp.program {
+		sp.stockProgram = tp.program
+		sp.FitStock()
+		sp.scrub.Value = 1
+	}
+	for sp.shapeBtn.Clicked(gtx) {
+		sp.cutter.Shape = (sp.cutter.Shape + 1) % 3
+	}
+	for sp.fitBtn.Clicked(gtx) {
+		sp.FitStock()
+	}
+	for sp.hideBtn.Clicked(gtx) {
+		sp.visible = false
+	}
+
+	// simulate up to the line chosen by the scrubber
+	lines := tp.program.Len()
+	line := int(float64(sp.scrub.Value)*float64(lines)) - 1
+	req := &stockRequest{segments: tp.segments, stock: sp.stock, cutter: sp.cutter, upTo: segmentsUpToLine(tp.segments, line)}
+	if !req.sameJob(sp.last) || req.upTo != sp.last.upTo {
+		sp.last = req
+		sp.sim.Request(req)
+	}
+
+	status := fmt.Sprintf("to line %d of %d", max(line+1, 0), lines)
+	if _, done := sp.sim.Result(); done != sp.last {
+		status += " ..."
+	}
+
+	tools := []layout.Widget{
+		material.Button(sp.app.th, &sp.shapeBtn, sp.cutter.Shape.String()).Layout,
+		func(gtx C) D { return sp.diaEdit.Layout(gtx, sp.cutter.Diameter) },
+	}
+	if sp.cutter.Shape == CutterVBit {
+		tools = append(tools, func(gtx C) D { return sp.angleEdit.Layout(gtx, sp.cutter.Angle) })
+	}
+
+	return Panel{Width: 1, CornerRadius: 5, Color: grey(128), BackgroundColor: grey(16), Margin: layout.UniformInset(5), Padding: layout.UniformInset(5)}.Layout(gtx, func(gtx C) D {
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+			layout.Rigid(func(gtx C) D {
+				return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx,
+					material.H6(sp.app.th, "Simulate ").Layout,
+					material.Button(sp.app.th, &sp.fitBtn, "FIT STOCK").Layout,
+					material.Button(sp.app.th, &sp.hideBtn, "HIDE").Layout,
+				)
+			}),
+			layout.Rigid(func(gtx C) D {
+				return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx,
+					func(gtx C) D { return sp.minXEdit.Layout(gtx, sp.stock.Min.X) },
+					func(gtx C) D { return sp.minYEdit.Layout(gtx, sp.stock.Min.Y) },
+					func(gtx C) D { return sp.sizeXEdit.Layout(gtx, sp.stock.Max.X-sp.stock.Min.X) },
+					func(gtx C) D { return sp.sizeYEdit.Layout(gtx, sp.stock.Max.Y-sp.stock.Min.Y) },
+					func(gtx C) D { return sp.thickEdit.Layout(gtx, sp.stock.Max.Z-sp.stock.Min.Z) },
+				)
+			}),
+			layout.Rigid(func(gtx C) D {
+				return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx, tools...)
+			}),
+			layout.Rigid(material.Slider(sp.app.th, &sp.scrub).Layout),
+			layout.Rigid(material.Body1(sp.app.th, status).Layout),
+		)
+	})
+}
+
+func (sp *SimPanel) SetTextSize(sz unit.Sp) {
+	for _, e := range []*EditableNum{&sp.minXEdit, &sp.minYEdit, &sp.sizeXEdit, &sp.sizeYEdit, &sp.thickEdit, &sp.diaEdit, &sp.angleEdit} {
+		e.TextSize = sz
+	}
+}
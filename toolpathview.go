@@ -3,11 +3,15 @@ package main
 import (
 	"fmt"
 	"image"
+	"math"
+	"sync"
+	"sync/atomic"
 
 	"gioui.org/f32"
 	"gioui.org/io/key"
 	"gioui.org/io/pointer"
 	"gioui.org/layout"
+	"gioui.org/op"
 	"gioui.org/op/clip"
 	"gioui.org/op/paint"
 	"gioui.org/widget"
@@ -16,103 +20,206 @@ import (
 
 type ToolpathView struct {
 	app             *App
-	path            *Path
+	path            *Path    // owned by the render goroutine while "rendering" is set
+	opts            PathOpts // the view we want; copied to path when a render starts
+	program         *Program // the program whose toolpath was most recently given to path
+	traceGen        int      // the generation of the trace that path has positions from
+	traceLen        int      // the number of trace points that path has
 	dragStart       f32.Point
 	dragStartCentre V4d
+	dragStartYaw    float64
+	dragStartPitch  float64
+	orbiting        bool
 	dragPoint       V4d
 	dragging        bool
 	hovering        bool
 	hoverPoint      V4d
-	rendering       bool
-	imageOp         paint.ImageOp
+	rendering       atomic.Bool
+	renderOpts      PathOpts    // the view being rendered
+	cancelRender    atomic.Bool // set when the view changes during a render
+
+	imageMu   sync.Mutex
+	imageOp   paint.ImageOp
+	imageOpts PathOpts // the view that imageOp shows
+
+	// toolpaths are parsed in the background, and picked up by StartRender()
+	parseProgress Progress
+	wantProgram   atomic.Pointer[Program] // the program we want a toolpath for
+	parsedMu      sync.Mutex
+	parsedProgram *Program
+	parsedPath    []Segment
+	programBounds Bounds // of the toolpath given to path, in work coordinates
+
+	// the toolpath given to path, for picking and highlighting on the UI goroutine
+	segments  []Segment
+	index     *SegmentIndex // built when first needed for each view direction
+	hoverLine int           // line hovered in the G-code view, or -1
+	measure   Measure
+
+	// zoom to fit, reset, centre, and follow
+	controls    ViewControls
+	animating   bool
+	animTarget  V4d // centre to move towards
+	animPxPerMm float64
+	following   bool // keep the tool in the middle while running
+
+	// the view for view.conf, published for the config writer
+	viewState   atomic.Pointer[ViewState]
+	writtenMu   sync.Mutex
+	writtenView ViewState
 }
 
 func NewToolpathView(app *App) *ToolpathView {
 	tp := &ToolpathView{}
 	tp.app = app
+	tp.hoverLine = -1
 	tp.path = NewPath()
 	tp.path.showCrossHair = true
 	tp.path.showAxes = true
 	tp.path.showGridLines = true
+	tp.path.showEnvelope = true
+	tp.path.showOffsets = true
+	tp.path.palette = ReadPalette()
+	tp.path.doneLine = -1
+	tp.path.Cancel = &tp.cancelRender
 	tp.path.Render()
+	tp.opts = tp.path.PathOpts
+	tp.imageOpts = tp.path.PathOpts
+	if vs, ok := ReadViewState(); ok {
+		tp.SetViewState(vs)
+		tp.writtenView = vs
+	}
 	tp.imageOp = paint.NewImageOp(tp.path.Image)
 	return tp
 }
 
 func (tp *ToolpathView) Layout(gtx C) D {
-	tp.path.Update(tp.app.gs.Mpos)
-	tp.path.crossHair = tp.app.gs.Mpos
-	tp.path.axes.X = tp.app.gs.Wco.X
-	tp.path.axes.Y = tp.app.gs.Wco.Y
+	tp.opts.crossHair = tp.app.gs.Mpos
+	tp.opts.axes.X = tp.app.gs.Wco.X
+	tp.opts.axes.Y = tp.app.gs.Wco.Y
+	tp.opts.axes.Z = tp.app.gs.Wco.Z
+	tp.opts.envelope, tp.opts.haveEnvelope = tp.app.gs.Envelope()
+	tp.opts.offsets = tp.app.gs.CoordOffsets
+	tp.opts.g28, tp.opts.g30 = tp.app.gs.G28Pos, tp.app.gs.G30Pos
+	tp.opts.haveOffsets = tp.app.gs.HaveOffsets
+	tp.opts.activeWCS = tp.app.gs.ActiveWCS()
+	tp.opts.doneLine = -1
+	if tp.app.rs.Program == tp.program {
+		tp.opts.doneLine = tp.app.rs.LastAcked
+	}
+	tp.Animate()
+	if vs := tp.ViewState(); tp.viewState.Load() == nil || *tp.viewState.Load() != vs {
+		tp.viewState.Store(&vs)
+	}
 
 	// render the toolpath in a different goroutine so as not to
-	// block the main UI
-	if !tp.rendering {
-		tp.rendering = true
-		go func() {
-			if tp.path.Render() {
-				tp.imageOp = paint.NewImageOp(tp.path.Image)
-				tp.app.w.Invalidate()
-			}
-			tp.rendering = false
-		}()
+	// block the main UI; abandon a render of a view we no longer want,
+	// unless we're orbiting, where the last image can't stand in for it
+	if !tp.rendering.Load() {
+		tp.StartRender()
+	} else if !tp.opts.SameView(tp.renderOpts) && tp.opts.yaw == tp.renderOpts.yaw && tp.opts.pitch == tp.renderOpts.pitch {
+		tp.cancelRender.Store(true)
 	}
 
 	borderColour := rgb(128, 128, 128)
 	return Panel{Margin: layout.UniformInset(5), Width: 1, CornerRadius: 5, Color: borderColour}.Layout(gtx, func(gtx C) D {
-		tp.path.widthPx = gtx.Constraints.Min.X
-		tp.path.heightPx = gtx.Constraints.Min.Y
-		if tp.hovering {
-			return layout.Stack{Alignment: layout.NE}.Layout(gtx,
-				layout.Expanded(func(gtx C) D {
-					return layout.Stack{Alignment: layout.SE}.Layout(gtx,
-						layout.Expanded(tp.LayoutImage),
-						layout.Stacked(func(gtx C) D {
-							// get hover point in work coordinates
-							xMm, yMm := tp.path.PxToMm(tp.hoverPoint.X, tp.hoverPoint.Y)
-							xMm -= tp.app.gs.Wco.X
-							yMm -= tp.app.gs.Wco.Y
-							return material.H6(tp.app.th, fmt.Sprintf("X%.03f Y%.03f", xMm, yMm)).Layout(gtx)
-						}),
-					)
-				}),
-				layout.Stacked(func(gtx C) D {
-					label := " Ctrl-click = jog\nShift-click = set WCO"
-					if !tp.app.CanJog() {
-						label = ""
-					}
-					return material.H6(tp.app.th, label).Layout(gtx)
-				}),
-			)
-		} else {
-			return tp.LayoutImage(gtx)
-		}
+		tp.opts.widthPx = gtx.Constraints.Min.X
+		tp.opts.heightPx = gtx.Constraints.Min.Y
+		return layout.Stack{Alignment: layout.NW}.Layout(gtx,
+			layout.Expanded(func(gtx C) D {
+				return layout.Stack{Alignment: layout.SW}.Layout(gtx,
+					layout.Expanded(func(gtx C) D {
+						return layout.Stack{Alignment: layout.NE}.Layout(gtx,
+							layout.Expanded(func(gtx C) D {
+								return layout.Stack{Alignment: layout.SE}.Layout(gtx,
+									layout.Expanded(tp.LayoutImage),
+									layout.Stacked(tp.LayoutReadout),
+								)
+							}),
+							layout.Stacked(func(gtx C) D {
+								if !tp.hovering || !tp.opts.IsTop() || !tp.app.CanJog() || tp.measure.Active {
+									return D{}
+								}
+								return material.H6(tp.app.th, " Ctrl-click = jog\nShift-click = set WCO").Layout(gtx)
+							}),
+						)
+					}),
+					layout.Stacked(tp.LayoutLegend),
+				)
+			}),
+			layout.Stacked(tp.LayoutViewControls),
+		)
 	})
 }
 
+// show the coordinates under the mouse, and the move of the selected line
+func (tp *ToolpathView) LayoutReadout(gtx C) D {
+	children := make([]layout.FlexChild, 0, 3)
+	if text := tp.MeasureText(); text != "" {
+		children = append(children, layout.Rigid(material.Body1(tp.app.th, text).Layout))
+	}
+	if move := tp.SelectedMove(); move != "" {
+		children = append(children, layout.Rigid(material.Body1(tp.app.th, move).Layout))
+	}
+	if tp.hovering && tp.opts.IsTop() {
+		// get hover point in work coordinates
+		xMm, yMm := tp.opts.PxToMm(tp.hoverPoint.X, tp.hoverPoint.Y)
+		xMm -= tp.app.gs.Wco.X
+		yMm -= tp.app.gs.Wco.Y
+		children = append(children, layout.Rigid(material.H6(tp.app.th, fmt.Sprintf("X%.03f Y%.03f", xMm, yMm)).Layout))
+	}
+	return layout.Flex{Axis: layout.Vertical, Alignment: layout.End}.Layout(gtx, children...)
+}
+
 func (tp *ToolpathView) LayoutImage(gtx C) D {
 	for _, gtxEvent := range gtx.Events(tp.path) {
 		switch gtxE := gtxEvent.(type) {
 		case pointer.Event:
 			// get click point in work coordinates
-			xMm, yMm := tp.path.PxToMm(tp.hoverPoint.X, tp.hoverPoint.Y)
+			xMm, yMm := tp.opts.PxToMm(tp.hoverPoint.X, tp.hoverPoint.Y)
 			xMm -= tp.app.gs.Wco.X
 			yMm -= tp.app.gs.Wco.Y
 
 			if gtxE.Kind == pointer.Scroll {
-				tp.path.pxPerMm *= 1.0 - float64(gtxE.Scroll.Y)/100.0
+				// keep following the tool, but at the new zoom
+				tp.animating = false
+				tp.opts.pxPerMm *= 1.0 - float64(gtxE.Scroll.Y)/100.0
+				tp.opts.pxPerMm = math.Max(MinPxPerMm, math.Min(MaxPxPerMm, tp.opts.pxPerMm))
 			} else if gtxE.Kind == pointer.Drag {
 				if !tp.dragging {
 					tp.dragging = true
 					tp.dragStart = gtxE.Position
-					tp.dragStartCentre = tp.path.centre
+					tp.dragStartCentre = tp.opts.centre
+					tp.dragStartYaw, tp.dragStartPitch = tp.opts.yaw, tp.opts.pitch
 					tp.dragPoint = V4d{X: xMm, Y: yMm}
+					// right-drag or alt-drag orbits, plain drag pans
+					tp.orbiting = gtxE.Buttons.Contain(pointer.ButtonSecondary) || gtxE.Modifiers.Contain(key.ModAlt)
+					tp.StopAnimating()
+				}
+				if tp.orbiting {
+					d := gtxE.Position.Sub(tp.dragStart)
+					yaw := tp.dragStartYaw - float64(d.X)*0.01
+					pitch := tp.dragStartPitch - float64(d.Y)*0.01
+					tp.opts = tp.opts.Rotate(yaw, pitch, tp.pivot())
+					break
 				}
 				origCentre := f32.Point{X: float32(tp.dragStartCentre.X), Y: float32(tp.dragStartCentre.Y)}
-				newCentre := origCentre.Add((tp.dragStart.Sub(gtxE.Position)).Div(float32(tp.path.pxPerMm)))
-				tp.path.centre = V4d{X: float64(newCentre.X), Y: float64(newCentre.Y)}
+				newCentre := origCentre.Add((tp.dragStart.Sub(gtxE.Position)).Div(float32(tp.opts.pxPerMm)))
+				tp.opts.centre = V4d{X: float64(newCentre.X), Y: float64(newCentre.Y)}
 			} else if gtxE.Kind == pointer.Release {
-				if !tp.dragging {
+				if !tp.dragging && tp.measure.Active {
+					// click = measure to a point, ctrl-click = measure a move
+					if gtxE.Modifiers.Contain(key.ModCtrl) {
+						tp.MeasureSegment(float64(gtxE.Position.X), float64(gtxE.Position.Y))
+					} else {
+						tp.MeasureClick(float64(gtxE.Position.X), float64(gtxE.Position.Y))
+					}
+				} else if !tp.dragging && gtxE.Modifiers == 0 {
+					// plain click = select the line that made the segment under the mouse
+					if line, ok := tp.PickLine(float64(gtxE.Position.X), float64(gtxE.Position.Y)); ok {
+						tp.app.ScrollGCodeTo(line)
+					}
+				} else if !tp.dragging && tp.opts.IsTop() {
 					if gtxE.Modifiers.Contain(key.ModCtrl) {
 						// ctrl-click = jog
 						tp.app.jog.JogTo(xMm, yMm)
@@ -127,6 +234,9 @@ func (tp *ToolpathView) LayoutImage(gtx C) D {
 				tp.dragging = false
 			} else if gtxE.Kind == pointer.Move {
 				tp.hovering = true
+				if tp.measure.Active {
+					tp.MeasureHover(float64(gtxE.Position.X), float64(gtxE.Position.Y))
+				}
 			} else if gtxE.Kind == pointer.Leave {
 				tp.hovering = false
 			}
@@ -141,14 +251,26 @@ func (tp *ToolpathView) LayoutImage(gtx C) D {
 		}
 	}
 
+	tp.imageMu.Lock()
+	imageOp, imageOpts := tp.imageOp, tp.imageOpts
+	tp.imageMu.Unlock()
+
+	dims := D{Size: gtx.Constraints.Min}
+	defer clip.Rect(image.Rectangle{Max: dims.Size}).Push(gtx.Ops).Pop()
+
+	// until the new view has been rendered, move and scale the last image
+	// to match it; it'll have blank edges, or be blurry, but it won't lag
+	stack := op.Affine(tp.opts.ImageTransform(imageOpts)).Push(gtx.Ops)
 	im := widget.Image{
-		Src:   tp.imageOp,
+		Src:   imageOp,
 		Scale: 1.0 / gtx.Metric.PxPerDp,
 	}
+	im.Layout(gtx)
+	stack.Pop()
 
-	dims := im.Layout(gtx)
-
-	defer clip.Rect(image.Rectangle{Max: dims.Size}).Push(gtx.Ops).Pop()
+	tp.LayoutHighlight(gtx)
+	tp.LayoutMarkerLabels(gtx)
+	tp.LayoutMeasure(gtx)
 	pointer.InputOp{
 		Kinds:        pointer.Scroll | pointer.Drag | pointer.Release | pointer.Move | pointer.Leave,
 		Tag:          tp.path,
@@ -157,3 +279,87 @@ func (tp *ToolpathView) LayoutImage(gtx C) D {
 
 	return dims
 }
+
+// hand the latest view options, positions, and program to the path, and render
+// it in a new goroutine; only call this when not already rendering
+func (tp *ToolpathView) StartRender() {
+	tp.path.PathOpts = tp.opts
+	tp.renderOpts = tp.opts
+	tp.cancelRender.Store(false)
+	positions, gen, n, reset := tp.app.trace.Positions(tp.traceGen, tp.traceLen)
+	if reset {
+		tp.path.ClearPositions()
+	}
+	for _, pos := range positions {
+		tp.path.Update(pos)
+	}
+	tp.traceGen, tp.traceLen = gen, n
+
+	if prog := tp.app.rs.Program; prog != tp.wantProgram.Load() {
+		tp.wantProgram.Store(prog)
+		go tp.ParseProgram(prog, tp.app.gs.GrblConfig[12])
+	}
+	tp.parsedMu.Lock()
+	if tp.parsedProgram != tp.program && tp.parsedProgram == tp.wantProgram.Load() {
+		tp.program = tp.parsedProgram
+		tp.path.SetGCode(tp.parsedPath)
+		tp.segments = tp.parsedPath
+		tp.programBounds = EmptyBounds()
+		for _, seg := range tp.parsedPath {
+			tp.programBounds = tp.programBounds.Add(seg.End)
+		}
+		var copies []Bounds
+		var skipped []bool
+		if prog := tp.program; prog != nil && !prog.Array.IsIdentity() {
+			if b, known := prog.Bounds(); known && !b.Empty() {
+				copies, skipped = prog.Array.Boxes(b)
+			}
+		}
+		tp.path.SetCopies(copies, skipped)
+	}
+	tp.parsedMu.Unlock()
+
+	if hm := tp.app.hmap.Map(); hm != tp.path.heightMap {
+		tp.path.SetHeightMap(hm)
+	}
+	if m := tp.app.sim.Stock(); m != tp.path.stock {
+		tp.path.SetStock(m)
+	}
+
+	tp.rendering.Store(true)
+	go func() {
+		if tp.path.Render() {
+			imageOp := paint.NewImageOp(tp.path.Image)
+			tp.imageMu.Lock()
+			tp.imageOp = imageOp
+			tp.imageOpts = tp.path.PathOpts
+			tp.imageMu.Unlock()
+			tp.app.w.Invalidate()
+		} else if tp.cancelRender.Load() {
+			// start rendering the new view
+			tp.app.w.Invalidate()
+		}
+		tp.rendering.Store(false)
+	}()
+}
+
+// parse the program's toolpath, splitting arcs like Grbl does with the given
+// $12, and leave it for StartRender() to pick up; gives up early if a
+// different program is loaded in the meantime
+func (tp *ToolpathView) ParseProgram(prog *Program, arcTolerance float64) {
+	var path []Segment
+	if prog != nil {
+		path = prog.ParseSegments(arcTolerance, &tp.parseProgress, func() bool {
+			return tp.wantProgram.Load() != prog
+		})
+		if path == nil {
+			return
+		}
+	}
+
+	tp.parsedMu.Lock()
+	tp.parsedProgram = prog
+	tp.parsedPath = path
+	tp.parsedMu.Unlock()
+	tp.app.w.Invalidate()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"gioui.org/app"
+	"gioui.org/x/explorer"
+)
+
+const traceMaxPoints = 200000 // thin out the oldest points beyond this many, never keeping more
+
+// a position that the machine actually reported, from a status update
+type TracePoint struct {
+	Time    time.Time
+	Mpos    V4d
+	Wco     V4d
+	Feed    float64 // mm/min
+	Spindle float64 // rpm
+	Status  string
+}
+
+func (tp TracePoint) Wpos() V4d {
+	return tp.Mpos.Sub(tp.Wco)
+}
+
+// the history of where the machine has been, with timestamps; safe to use
+// from any goroutine
+type Trace struct {
+	mu     sync.Mutex
+	points []TracePoint
+	gen    int // incremented whenever points are removed
+}
+
+// record the status if the machine has moved, or its state has changed,
+// since the last point
+func (t *Trace) Add(gs GrblStatus) {
+	if !gs.Ready || gs.Closed {
+		return
+	}
+	pt := TracePoint{Time: gs.UpdateTime, Mpos: gs.Mpos, Wco: gs.Wco, Feed: gs.FeedRate, Spindle: gs.SpindleSpeed, Status: gs.Status}
+	if pt.Time.IsZero() {
+		pt.Time = time.Now()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l := len(t.points); l > 0 {
+		last := t.points[l-1]
+		if last.Mpos.Sub(pt.Mpos).Length() < 0.001 && last.Status == pt.Status && last.Feed == pt.Feed && last.Spindle == pt.Spindle {
+			return
+		}
+	}
+	t.points = append(t.points, pt)
+	if len(t.points) > traceMaxPoints {
+		t.decimate()
+	}
+}
+
+// drop every other point from the oldest half of the trace, except where
+// the status changed, so that recent motion keeps the most detail; if that
+// still leaves more than 3/4 of traceMaxPoints (because the status kept
+// changing), drop the oldest points, so that this only runs once every
+// traceMaxPoints/4 points
+//
+// works in place, so it doesn't allocate
+func (t *Trace) decimate() {
+	half := len(t.points) / 2
+	n := 0
+	for i, pt := range t.points {
+		// t.points[i-1] is still the original point, because we've either
+		// written nothing past it, or dropped nothing yet
+		if i < half && i%2 == 1 && t.points[i-1].Status == pt.Status {
+			continue
+		}
+		t.points[n] = pt
+		n++
+	}
+	if limit := traceMaxPoints * 3 / 4; n > limit {
+		n = copy(t.points, t.points[n-limit:n])
+	}
+	clear(t.points[n:])
+	t.points = t.points[:n]
+	t.gen++
+}
+
+func (t *Trace) Clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.points = nil
+	t.gen++
+}
+
+func (t *Trace) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.points)
+}
+
+// return the machine positions recorded since the caller last had n points
+// of generation gen, and the new n and gen; if points have been removed
+// since then, return all of them, with reset set
+func (t *Trace) Positions(gen, n int) ([]V4d, int, int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	reset := gen != t.gen || n > len(t.points)
+	if reset {
+		n = 0
+	}
+	pos := make([]V4d, 0, len(t.points)-n)
+	for _, pt := range t.points[n:] {
+		pos = append(pos, pt.Mpos)
+	}
+	return pos, t.gen, len(t.points), reset
+}
+
+// return a copy of the points
+func (t *Trace) Points() []TracePoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TracePoint(nil), t.points...)
+}
+
+// write the trace as CSV, one row per point, in machine and work coordinates
+func WriteTraceCSV(w io.Writer, points []TracePoint) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "time,seconds,mx,my,mz,ma,wx,wy,wz,wa,feed,spindle,status\n")
+	for _, pt := range points {
+		secs := 0.0
+		if len(points) > 0 {
+			secs = pt.Time.Sub(points[0].Time).Seconds()
+		}
+		wpos := pt.Wpos()
+		fmt.Fprintf(bw, "%s,%.3f,%.3f,%.3f,%.3f,%.3f,%.3f,%.3f,%.3f,%.3f,%g,%g,%s\n",
+			pt.Time.Format(time.RFC3339Nano), secs,
+			pt.Mpos.X, pt.Mpos.Y, pt.Mpos.Z, pt.Mpos.A,
+			wpos.X, wpos.Y, wpos.Z, wpos.A,
+			pt.Feed, pt.Spindle, pt.Status)
+	}
+	return bw.Flush()
+}
+
+// write the trace as a G-code program in work coordinates, so that it can be
+// loaded and compared with the program that was run
+//
+// Grbl reports a feed rate for rapids too, so we can't tell them apart, and
+// every move is written as G1 at the feed rate Grbl reported; points where
+// Grbl reported no feed rate (stopped) keep the previous one
+func WriteTraceGCode(w io.Writer, points []TracePoint) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "(pugsender trace of %d points)\n", len(points))
+	if len(points) > 0 {
+		fmt.Fprintf(bw, "(from %s to %s)\n", points[0].Time.Format(time.RFC3339), points[len(points)-1].Time.Format(time.RFC3339))
+	}
+	fmt.Fprintf(bw, "G21 G90\n")
+
+	// G1 needs a feed rate, so start with the first one there is
+	feed := float64(defaultRapidRate)
+	for _, pt := range points {
+		if pt.Feed > 0 {
+			feed = pt.Feed
+			break
+		}
+	}
+	fmt.Fprintf(bw, "G1 F%g\n", feed)
+
+	for _, pt := range points {
+		wpos := pt.Wpos()
+		if pt.Feed > 0 && pt.Feed != feed {
+			fmt.Fprintf(bw, "G1 X%.3f Y%.3f Z%.3f F%g\n", wpos.X, wpos.Y, wpos.Z, pt.Feed)
+			feed = pt.Feed
+		} else {
+			fmt.Fprintf(bw, "G1 X%.3f Y%.3f Z%.3f\n", wpos.X, wpos.Y, wpos.Z)
+		}
+	}
+	fmt.Fprintf(bw, "M2\n")
+	return bw.Flush()
+}
+
+// ask for a file to save the trace in, as CSV or as G-code
+func (t *Trace) SaveFile(csv bool) {
+	points := t.Points()
+	if len(points) == 0 {
+		fmt.Fprintf(os.Stderr, "no trace to save\n")
+		return
+	}
+	go func() {
+		name, write := "trace.nc", WriteTraceGCode
+		if csv {
+			name, write = "trace.csv", WriteTraceCSV
+		}
+		w := app.NewWindow(app.Title("Save trace"))
+		e := explorer.NewExplorer(w)
+		f, err := e.CreateFile(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "explorer.CreateFile(): %v\n", err)
+			return
+		}
+		defer f.Close()
+		if err := write(f, points); err != nil {
+			fmt.Fprintf(os.Stderr, "save trace: %v\n", err)
+		}
+	}()
+}
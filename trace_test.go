@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the status flips on every point, so thinning can't drop anything and the
+// hard limit has to do it, without decimating on every Add
+func TestTraceDecimateLimit(t *testing.T) {
+	var tr Trace
+	start := time.Now()
+	n := 3 * traceMaxPoints
+	for i := 0; i < n; i++ {
+		status := "Run"
+		if i%2 == 1 {
+			status = "Hold"
+		}
+		tr.Add(GrblStatus{Ready: true, Status: status, FeedRate: float64(i), Mpos: V4d{X: float64(i)}, UpdateTime: start.Add(time.Duration(i) * time.Millisecond)})
+		if tr.Len() > traceMaxPoints {
+			t.Fatalf("trace has %d points after %d adds", tr.Len(), i+1)
+		}
+	}
+	if max := n/(traceMaxPoints/4) + 1; tr.gen > max {
+		t.Errorf("decimated %d times, want at most %d", tr.gen, max)
+	}
+
+	// the newest points are never dropped
+	pts := tr.Points()
+	if last := pts[len(pts)-1]; last.Mpos.X != float64(n-1) {
+		t.Errorf("last point is at X%v, want X%d", last.Mpos.X, n-1)
+	}
+}
+
+// Grbl reports a feed rate for rapids too, so the trace is all G1 moves, and
+// stopped points keep the feed rate before them
+func TestWriteTraceGCode(t *testing.T) {
+	points := []TracePoint{
+		{Mpos: V4d{X: 1}, Feed: 0},
+		{Mpos: V4d{X: 2}, Feed: 500},
+		{Mpos: V4d{X: 3}, Feed: 0},
+		{Mpos: V4d{X: 4}, Feed: 800},
+	}
+	var sb strings.Builder
+	if err := WriteTraceGCode(&sb, points); err != nil {
+		t.Fatal(err)
+	}
+	out := sb.String()
+	if strings.Contains(out, "G0") {
+		t.Errorf("trace claims a rapid:\n%s", out)
+	}
+
+	p, err := LoadProgram(strings.NewReader(out), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeds := make([]float64, 0)
+	for _, seg := range p.ParseSegments(0, nil, nil) {
+		feeds = append(feeds, seg.Feed)
+	}
+	want := []float64{500, 500, 500, 800}
+	if fmt.Sprint(feeds) != fmt.Sprint(want) {
+		t.Errorf("feeds are %v, want %v", feeds, want)
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"gioui.org/layout"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+
+	"github.com/256dpi/gcode"
+)
+
+// a transform applied to a loaded program; the zero value does nothing
+//
+// points are scaled about the origin, then mirrored, then rotated about the
+// Z axis, then translated; all in the program's own units and work
+// coordinates
+type Transform struct {
+	Move    V4d     // translation
+	Rotate  float64 // degrees, anticlockwise about Z
+	MirrorX bool    // negate X
+	MirrorY bool    // negate Y
+	Scale   float64 // 0 means 1
+
+	FeedScale  float64 // 0 means 1
+	FeedMax    float64 // 0 means no limit
+	SpeedScale float64 // 0 means 1
+	SpeedMax   float64 // 0 means no limit
+}
+
+func (t Transform) IsIdentity() bool {
+	return t.String() == ""
+}
+
+func orOne(v float64) float64 {
+	if v == 0 {
+		return 1
+	}
+	return v
+}
+
+// format the transform for config files, e.g. "move=10,0,0 rotate=90 mirror=x"
+func (t Transform) String() string {
+	parts := make([]string, 0)
+	if t.Move.X != 0 || t.Move.Y != 0 || t.Move.Z != 0 {
+		parts = append(parts, fmt.Sprintf("move=%s,%s,%s", formatNumber(t.Move.X), formatNumber(t.Move.Y), formatNumber(t.Move.Z)))
+	}
+	if math.Mod(t.Rotate, 360) != 0 {
+		parts = append(parts, "rotate="+formatNumber(t.Rotate))
+	}
+	if t.MirrorX || t.MirrorY {
+		mirror := ""
+		if t.MirrorX {
+			mirror += "x"
+		}
+		if t.MirrorY {
+			mirror += "y"
+		}
+		parts = append(parts, "mirror="+mirror)
+	}
+	if orOne(t.Scale) != 1 {
+		parts = append(parts, "scale="+formatNumber(t.Scale))
+	}
+	if orOne(t.FeedScale) != 1 || t.FeedMax != 0 {
+		parts = append(parts, fmt.Sprintf("feed=%s,%s", formatNumber(orOne(t.FeedScale)), formatNumber(t.FeedMax)))
+	}
+	if orOne(t.SpeedScale) != 1 || t.SpeedMax != 0 {
+		parts = append(parts, fmt.Sprintf("speed=%s,%s", formatNumber(orOne(t.SpeedScale)), formatNumber(t.SpeedMax)))
+	}
+	return strings.Join(parts, " ")
+}
+
+// parse the output of Transform.String()
+func ParseTransform(s string) (Transform, error) {
+	t := Transform{}
+	for _, part := range strings.Fields(s) {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return t, fmt.Errorf("bad transform: [%s]", part)
+		}
+		vals := make([]float64, 0)
+		if kv[0] != "mirror" {
+			for _, v := range strings.Split(kv[1], ",") {
+				f, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return t, fmt.Errorf("bad transform: [%s]: %v", part, err)
+				}
+				vals = append(vals, f)
+			}
+		}
+		want := 1
+		if kv[0] == "move" {
+			want = 3
+		} else if kv[0] == "feed" || kv[0] == "speed" {
+			want = 2
+		} else if kv[0] == "mirror" {
+			want = 0
+		}
+		if len(vals) != want {
+			return t, fmt.Errorf("bad transform: [%s]", part)
+		}
+
+		if kv[0] == "move" {
+			t.Move = V4d{X: vals[0], Y: vals[1], Z: vals[2]}
+		} else if kv[0] == "rotate" {
+			t.Rotate = vals[0]
+		} else if kv[0] == "mirror" {
+			t.MirrorX = strings.Contains(kv[1], "x")
+			t.MirrorY = strings.Contains(kv[1], "y")
+		} else if kv[0] == "scale" {
+			t.Scale = vals[0]
+		} else if kv[0] == "feed" {
+			t.FeedScale = vals[0]
+			t.FeedMax = vals[1]
+		} else if kv[0] == "speed" {
+			t.SpeedScale = vals[0]
+			t.SpeedMax = vals[1]
+		} else {
+			return t, fmt.Errorf("unrecognised transform: [%s]", part)
+		}
+	}
+	return t, nil
+}
+
+// apply the linear part of the transform (scale, mirror, rotate) to a vector
+func (t Transform) linear(v V4d) V4d {
+	v = v.Mul(orOne(t.Scale))
+	if t.MirrorX {
+		v.X = -v.X
+	}
+	if t.MirrorY {
+		v.Y = -v.Y
+	}
+	if t.Rotate != 0 {
+		rad := t.Rotate * math.Pi / 180
+		sin, cos := math.Sin(rad), math.Cos(rad)
+		v.X, v.Y = v.X*cos-v.Y*sin, v.X*sin+v.Y*cos
+	}
+	return v
+}
+
+// apply the whole transform to a point
+func (t Transform) Point(v V4d) V4d {
+	return t.linear(v).Add(V4d{X: t.Move.X, Y: t.Move.Y, Z: t.Move.Z})
+}
+
+// true if arcs in the given plane change direction
+func (t Transform) swapsArcs(plane int) bool {
+	if plane == 18 {
+		return t.MirrorX
+	} else if plane == 19 {
+		return t.MirrorY
+	}
+	return t.MirrorX != t.MirrorY
+}
+
+func (t Transform) limit(v, scale, max float64) float64 {
+	v *= orOne(scale)
+	if max > 0 && v > max {
+		v = max
+	}
+	return v
+}
+
+// return a new program with the transform applied to every line of src
+func (t Transform) Apply(src *Program, progress *Progress) (*Program, error) {
+	if orOne(t.Scale) < 0 {
+		return nil, fmt.Errorf("can't scale by a negative amount")
+	}
+
+	pw, err := NewProgramWriter(src.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// follows the untransformed program
+	in := NewInterpreter(defaultArcTolerance)
+	var applyErr error
+	src.Each(func(i int, str string) bool {
+		if progress != nil && i%programBlockLines == 0 {
+			progress.Set(int64(i), int64(src.Len()))
+		}
+		out, err := t.applyLine(i, str, in)
+		if err != nil {
+			applyErr = &ProgramError{Line: i, Msg: err.Error()}
+			return false
+		}
+		pw.WriteLine(out)
+		return true
+	})
+	if progress != nil {
+		progress.Set(int64(src.Len()), int64(src.Len()))
+	}
+	if applyErr != nil {
+		pw.Discard()
+		return nil, applyErr
+	}
+
+	p, err := pw.Program()
+	if err != nil {
+		return nil, err
+	}
+	p.Source = src
+	p.Transform = t
+	return p, nil
+}
+
+// transform line i of the program; in follows the untransformed program
+func (t Transform) applyLine(i int, str string, in *Interpreter) (string, error) {
+	if strings.HasPrefix(strings.TrimSpace(str), "$") {
+		// Grbl system command
+		return str, nil
+	}
+	line, err := ParseWords(str)
+	if err != nil {
+		return "", err
+	}
+
+	before := *in
+	if _, err := in.Line(i, str); err != nil {
+		return "", err
+	}
+	// the untransformed position before this line, in work coordinates and
+	// in the units of the axis words on this line
+	pos := before.WorkPos()
+	if in.inches {
+		pos.X, pos.Y, pos.Z = pos.X/25.4, pos.Y/25.4, pos.Z/25.4
+	}
+	// true if the axis is at a position the program has given, or given
+	// on this line
+	known := func(axis string, given bool) bool {
+		return given || (in.wcs == before.wcs && before.Known(axis))
+	}
+
+	// find whether the axis words on this line are a position in work coordinates
+	notPosition := false
+	hasArc := false
+	for _, c := range line.Codes {
+		if c.Letter == "G" {
+			if c.Value == 53 || c.Value == 10 || c.Value == 92 || c.Value == 28.1 || c.Value == 30.1 {
+				// machine coordinates, or setting offsets
+				notPosition = true
+			}
+		} else if c.Letter == "I" || c.Letter == "J" || c.Letter == "K" || c.Letter == "R" {
+			hasArc = true
+		}
+	}
+	arc := in.motion == 2 || in.motion == 3
+	rotating := math.Mod(t.Rotate, 360) != 0
+	if arc && hasArc && rotating && in.plane != 17 {
+		return "", fmt.Errorf("can't rotate an arc in the G%d plane", in.plane)
+	}
+
+	// work out the new position
+	given := V4d{}
+	hasX, hasY, hasZ := false, false, false
+	for _, c := range line.Codes {
+		if c.Letter == "X" {
+			given.X, hasX = c.Value, true
+		} else if c.Letter == "Y" {
+			given.Y, hasY = c.Value, true
+		} else if c.Letter == "Z" {
+			given.Z, hasZ = c.Value, true
+		}
+	}
+	var newXY V4d
+	var newZ float64
+	if !notPosition {
+		if !in.incremental {
+			if rotating && (hasX || hasY) && !(known("X", hasX) && known("Y", hasY)) {
+				// rotation mixes X and Y, so a move along one needs the other
+				return "", fmt.Errorf("can't rotate until both X and Y are known (they aren't at the start, or after G28, G30, G53, or probing)")
+			}
+			if hasX {
+				pos.X = given.X
+			}
+			if hasY {
+				pos.Y = given.Y
+			}
+			if hasZ {
+				pos.Z = given.Z
+			}
+			p := t.Point(pos)
+			newXY = p
+			newZ = p.Z
+		} else {
+			p := t.linear(given)
+			newXY = p
+			newZ = p.Z
+		}
+	}
+
+	// rewrite the words
+	ij := V4d{}
+	for _, c := range line.Codes {
+		if c.Letter == "I" {
+			ij.X = c.Value
+		} else if c.Letter == "J" {
+			ij.Y = c.Value
+		}
+	}
+	newIJ := t.linear(ij)
+
+	swap := arc && t.swapsArcs(in.plane)
+	haveMotionWord := false
+	codes := make([]gcode.GCode, 0, len(line.Codes)+2)
+	doneXY := false
+	doneIJ := false
+	for _, c := range line.Codes {
+		if c.Comment != "" {
+			codes = append(codes, c)
+			continue
+		}
+		if c.Letter == "G" && (c.Value == 2 || c.Value == 3) {
+			haveMotionWord = true
+			if swap {
+				c.Value = 5 - c.Value
+			}
+		} else if c.Letter == "G" && (c.Value <= 1 || (c.Value >= 38 && c.Value < 39) || c.Value == 80) {
+			haveMotionWord = true
+		} else if !notPosition && (c.Letter == "X" || c.Letter == "Y") {
+			if rotating {
+				// rotation mixes X and Y, so always give both
+				if !doneXY {
+					codes = append(codes, gcode.GCode{Letter: "X", Value: newXY.X}, gcode.GCode{Letter: "Y", Value: newXY.Y})
+					doneXY = true
+				}
+				continue
+			}
+			if c.Letter == "X" {
+				c.Value = newXY.X
+			} else {
+				c.Value = newXY.Y
+			}
+		} else if !notPosition && c.Letter == "Z" {
+			c.Value = newZ
+		} else if c.Letter == "I" || c.Letter == "J" {
+			if rotating {
+				if !doneIJ {
+					codes = append(codes, gcode.GCode{Letter: "I", Value: newIJ.X}, gcode.GCode{Letter: "J", Value: newIJ.Y})
+					doneIJ = true
+				}
+				continue
+			}
+			if c.Letter == "I" {
+				c.Value = newIJ.X
+			} else {
+				c.Value = newIJ.Y
+			}
+		} else if c.Letter == "K" || c.Letter == "R" {
+			c.Value *= orOne(t.Scale)
+		} else if c.Letter == "F" {
+			c.Value = t.limit(c.Value, t.FeedScale, t.FeedMax)
+		} else if c.Letter == "S" {
+			c.Value = t.limit(c.Value, t.SpeedScale, t.SpeedMax)
+		}
+		codes = append(codes, c)
+	}
+
+	if swap && hasArc && !haveMotionWord {
+		// the arc direction is modal, so say which way it goes now
+		codes = append([]gcode.GCode{{Letter: "G", Value: 5 - in.motion}}, codes...)
+	}
+
+	line.Codes = codes
+	return FormatWords(line), nil
+}
+
+// the panel for editing the transform of the loaded program
+type TransformPanel struct {
+	app     *App
+	visible bool
+	base    *Program    // the untransformed program that undo applies to
+	undo    []Transform // earlier transforms of base
+
+	xEdit          EditableNum
+	yEdit          EditableNum
+	zEdit          EditableNum
+	rotateEdit     EditableNum
+	scaleEdit      EditableNum
+	feedScaleEdit  EditableNum
+	feedMaxEdit    EditableNum
+	speedScaleEdit EditableNum
+	speedMaxEdit   EditableNum
+
+	mirrorXBtn widget.Clickable
+	mirrorYBtn widget.Clickable
+	undoBtn    widget.Clickable
+	resetBtn   widget.Clickable
+}
+
+func NewTransformPanel(app *App) *TransformPanel {
+	tp := &TransformPanel{app: app}
+
+	edit := func(e *EditableNum, label string, set func(t *Transform, v float64)) {
+		e.app = app
+		e.Label = label
+		e.Callback = func(v float64) {
+			t := tp.Current()
+			set(&t, v)
+			tp.Set(t)
+		}
+	}
+	edit(&tp.xEdit, "  Move X", func(t *Transform, v float64) { t.Move.X = v })
+	edit(&tp.yEdit, "  Move Y", func(t *Transform, v float64) { t.Move.Y = v })
+	edit(&tp.zEdit, "  Move Z", func(t *Transform, v float64) { t.Move.Z = v })
+	edit(&tp.rotateEdit, "  Rotate", func(t *Transform, v float64) { t.Rotate = v })
+	edit(&tp.scaleEdit, "   Scale", func(t *Transform, v float64) { t.Scale = v })
+	edit(&tp.feedScaleEdit, "  Feed x", func(t *Transform, v float64) { t.FeedScale = v })
+	edit(&tp.feedMaxEdit, "Feed max", func(t *Transform, v float64) { t.FeedMax = v })
+	edit(&tp.speedScaleEdit, " Speed x", func(t *Transform, v float64) { t.SpeedScale = v })
+	edit(&tp.speedMaxEdit, "Spd. max", func(t *Transform, v float64) { t.SpeedMax = v })
+
+	return tp
+}
+
+// return the transform of the loaded program
+func (tp *TransformPanel) Current() Transform {
+	if tp.app.rs.Program == nil {
+		return Transform{}
+	}
+	return tp.app.rs.Program.Transform
+}
+
+// apply a new transform to the untransformed program, remembering the
+// current one for undo
+func (tp *TransformPanel) Set(t Transform) {
+	if !tp.apply(t) {
+		return
+	}
+	tp.undo = append(tp.undo, tp.Current())
+}
+
+func (tp *TransformPanel) Undo() {
+	l := len(tp.undo)
+	if l == 0 {
+		return
+	}
+	if tp.apply(tp.undo[l-1]) {
+		tp.undo = tp.undo[:l-1]
+	}
+}
+
+// apply the transform to the unprocessed program, keeping any array and height map
+func (tp *TransformPanel) apply(t Transform) bool {
+	prog := tp.app.rs.Program
+	if prog == nil {
+		return false
+	}
+	return tp.app.Reprocess(t, prog.Array, prog.HeightMap)
+}
+
+// reprocess the loaded program with a new transform, array, and height map in the
+// background, and load the result; returns false if the program can't be
+// changed now
+func (a *App) Reprocess(t Transform, arr Array, hm *HeightMap) bool {
+	base := a.rs.Program
+	if base == nil {
+		return false
+	}
+	if a.rs.Running || a.rs.NextLine > 0 {
+		fmt.Fprintf(os.Stderr, "can't change the program after it has started\n")
+		return false
+	}
+	if base.Source != nil {
+		base = base.Source
+	}
+
+	// if the program is reprocessed again before this is done, only load the latest
+	gen := a.processGen.Add(1)
+	go func() {
+		p, err := ProcessProgram(base, t, arr, hm, &a.loadProgress)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "process %s: %v\n", base.Name, err)
+			return
+		}
+		if a.processGen.Load() == gen {
+			if err := a.gcode.Load(p); err != nil {
+				fmt.Fprintf(os.Stderr, "process %s: %v\n", base.Name, err)
+			}
+		}
+	}()
+	return true
+}
+
+func (tp *TransformPanel) Layout(gtx C) D {
+	if !tp.visible {
+		return D{}
+	}
+
+	prog := tp.app.rs.Program
+	if prog != nil && prog.Source != nil {
+		prog = prog.Source
+	}
+	if prog != tp.base {
+		// a different program was loaded, so there is nothing to undo
+		tp.base = prog
+		tp.undo = nil
+	}
+
+	t := tp.Current()
+	for tp.mirrorXBtn.Clicked(gtx) {
+		t.MirrorX = !t.MirrorX
+		tp.Set(t)
+	}
+	for tp.mirrorYBtn.Clicked(gtx) {
+		t.MirrorY = !t.MirrorY
+		tp.Set(t)
+	}
+	for tp.undoBtn.Clicked(gtx) {
+		tp.Undo()
+	}
+	for tp.resetBtn.Clicked(gtx) {
+		tp.Set(Transform{})
+	}
+
+	mirrorXLbl := "+MIRROR X"
+	if t.MirrorX {
+		mirrorXLbl = "-MIRROR X"
+	}
+	mirrorYLbl := "+MIRROR Y"
+	if t.MirrorY {
+		mirrorYLbl = "-MIRROR Y"
+	}
+
+	return Panel{Width: 1, CornerRadius: 5, Color: grey(128), BackgroundColor: grey(16), Margin: layout.UniformInset(5), Padding: layout.UniformInset(5)}.Layout(gtx, func(gtx C) D {
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+			layout.Rigid(func(gtx C) D {
+				return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx,
+					material.H6(tp.app.th, "Transform ").Layout,
+					material.Button(tp.app.th, &tp.mirrorXBtn, mirrorXLbl).Layout,
+					material.Button(tp.app.th, &tp.mirrorYBtn, mirrorYLbl).Layout,
+					material.Button(tp.app.th, &tp.undoBtn, "UNDO").Layout,
+					material.Button(tp.app.th, &tp.resetBtn, "RESET").Layout,
+				)
+			}),
+			layout.Rigid(func(gtx C) D {
+				return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx,
+					func(gtx C) D { return tp.xEdit.Layout(gtx, t.Move.X) },
+					func(gtx C) D { return tp.yEdit.Layout(gtx, t.Move.Y) },
+					func(gtx C) D { return tp.zEdit.Layout(gtx, t.Move.Z) },
+					func(gtx C) D { return tp.rotateEdit.Layout(gtx, t.Rotate) },
+					func(gtx C) D { return tp.scaleEdit.Layout(gtx, orOne(t.Scale)) },
+				)
+			}),
+			layout.Rigid(func(gtx C) D {
+				return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx,
+					func(gtx C) D { return tp.feedScaleEdit.Layout(gtx, orOne(t.FeedScale)) },
+					func(gtx C) D { return tp.feedMaxEdit.Layout(gtx, t.FeedMax) },
+					func(gtx C) D { return tp.speedScaleEdit.Layout(gtx, orOne(t.SpeedScale)) },
+					func(gtx C) D { return tp.speedMaxEdit.Layout(gtx, t.SpeedMax) },
+				)
+			}),
+		)
+	})
+}
+
+func (tp *TransformPanel) SetTextSize(sz unit.Sp) {
+	for _, e := range []*EditableNum{&tp.xEdit, &tp.yEdit, &tp.zEdit, &tp.rotateEdit, &tp.scaleEdit, &tp.feedScaleEdit, &tp.feedMaxEdit, &tp.speedScaleEdit, &tp.speedMaxEdit} {
+		e.TextSize = sz
+	}
+}
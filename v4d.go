@@ -37,6 +37,21 @@ func ParseV4d(coords string) (V4d, int, error) {
 	return v, len(parts), nil
 }
 
+// return a pointer to the named coordinate ("X", "Y", "Z", or "A"), or nil
+func (a *V4d) Select(axis string) *float64 {
+	if axis == "X" {
+		return &a.X
+	} else if axis == "Y" {
+		return &a.Y
+	} else if axis == "Z" {
+		return &a.Z
+	} else if axis == "A" {
+		return &a.A
+	} else {
+		return nil
+	}
+}
+
 func (a V4d) Add(b V4d) V4d {
 	return V4d{X: a.X + b.X, Y: a.Y + b.Y, Z: a.Z + b.Z, A: a.A + b.A}
 }
@@ -46,13 +61,17 @@ func (a V4d) Sub(b V4d) V4d {
 }
 
 func (a V4d) Mul(k float64) V4d {
-	return V4d{X: a.X * k, Y: a.Y * k, Z: a.Z * k, A: a.Z * k}
+	return V4d{X: a.X * k, Y: a.Y * k, Z: a.Z * k, A: a.A * k}
 }
 
 func (a V4d) Div(k float64) V4d {
 	return a.Mul(1 / k)
 }
 
+func (a V4d) Dot(b V4d) float64 {
+	return a.X*b.X + a.Y*b.Y + a.Z*b.Z + a.A*b.A
+}
+
 func (a V4d) Length() float64 {
 	return math.Sqrt(a.X*a.X + a.Y*a.Y + a.Z*a.Z + a.A*a.A)
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"image/color"
+	"math"
+
+	"github.com/llgcode/draw2d/draw2dimg"
+)
+
+const depthCueLevels = 8 // shades of grey to draw the toolpath in, from far to near
+
+// a standard direction to look at the toolpath from
+type ViewPreset struct {
+	Name  string
+	Yaw   float64 // radians anticlockwise about Z, 0 looks from the front
+	Pitch float64 // radians down from straight above, pi/2 looks horizontally
+}
+
+var viewPresets = []ViewPreset{
+	{"top", 0, 0},
+	{"front", 0, math.Pi / 2},
+	{"right", math.Pi / 2, math.Pi / 2},
+	{"iso", math.Pi / 4, math.Atan(math.Sqrt2)},
+}
+
+// true if looking straight down, in which case the view is the same as the
+// flat XY view we always had, and pixels map back to X and Y
+func (p PathOpts) IsTop() bool {
+	return p.yaw == 0 && p.pitch == 0
+}
+
+// rotate pos into view space: X to the right, Y up the screen, and Z
+// towards the viewer
+func (p PathOpts) ViewPos(pos V4d) V4d {
+	sy, cy := math.Sincos(p.yaw)
+	sp, cp := math.Sincos(p.pitch)
+	x := pos.X*cy + pos.Y*sy
+	y := -pos.X*sy + pos.Y*cy
+	return V4d{X: x, Y: y*cp + pos.Z*sp, Z: -y*sp + pos.Z*cp, A: pos.A}
+}
+
+// the inverse of ViewPos
+func (p PathOpts) WorldPos(v V4d) V4d {
+	sy, cy := math.Sincos(p.yaw)
+	sp, cp := math.Sincos(p.pitch)
+	y := v.Y*cp - v.Z*sp
+	z := v.Y*sp + v.Z*cp
+	return V4d{X: v.X*cy - y*sy, Y: v.X*sy + y*cy, Z: z, A: v.A}
+}
+
+// return the pixel that pos is drawn at
+func (p PathOpts) Project(pos V4d) (float64, float64) {
+	v := p.ViewPos(pos)
+	halfWidth := float64(p.widthPx / 2)
+	halfHeight := float64(p.heightPx / 2)
+	return p.pxPerMm*(v.X-p.centre.X) + halfWidth, p.pxPerMm*(-v.Y-p.centre.Y) + halfHeight
+}
+
+// return the view options looking from the new direction, with the point
+// pivot staying where it is on the screen
+func (p PathOpts) Rotate(yaw, pitch float64, pivot V4d) PathOpts {
+	before := p.ViewPos(pivot)
+	p.yaw = math.Mod(yaw, 2*math.Pi)
+	p.pitch = math.Max(0, math.Min(math.Pi, pitch))
+	after := p.ViewPos(pivot)
+	p.centre.X += after.X - before.X
+	p.centre.Y -= after.Y - before.Y
+	return p
+}
+
+// draw the edges of the box; just the outline in the top view
+func (p *Path) DrawBox(gc *draw2dimg.GraphicContext, b Bounds, col color.NRGBA) {
+	gc.SetStrokeColor(col)
+	if p.IsTop() {
+		gc.MoveTo(p.MmToPx(b.Min.X, b.Min.Y))
+		gc.LineTo(p.MmToPx(b.Max.X, b.Min.Y))
+		gc.LineTo(p.MmToPx(b.Max.X, b.Max.Y))
+		gc.LineTo(p.MmToPx(b.Min.X, b.Max.Y))
+		gc.Close()
+		gc.Stroke()
+		return
+	}
+	corner := func(i int) V4d {
+		c := b.Min
+		if i&1 != 0 {
+			c.X = b.Max.X
+		}
+		if i&2 != 0 {
+			c.Y = b.Max.Y
+		}
+		if i&4 != 0 {
+			c.Z = b.Max.Z
+		}
+		return c
+	}
+	for i := 0; i < 8; i++ {
+		for _, bit := range []int{1, 2, 4} {
+			if i&bit == 0 {
+				gc.MoveTo(p.Project(corner(i)))
+				gc.LineTo(p.Project(corner(i | bit)))
+			}
+		}
+	}
+	gc.Stroke()
+}
+
+// draw the X, Y, and Z axes through the work origin
+func (p *Path) DrawAxes3D(gc *draw2dimg.GraphicContext) {
+	length := float64(p.widthPx+p.heightPx) / p.pxPerMm
+	for _, axis := range []struct {
+		dir V4d
+		col color.NRGBA
+	}{
+		{V4d{X: 1}, rgb(96, 0, 0)},
+		{V4d{Y: 1}, rgb(0, 96, 0)},
+		{V4d{Z: 1}, rgb(0, 0, 160)},
+	} {
+		gc.SetStrokeColor(axis.col)
+		gc.MoveTo(p.Project(p.axes.Sub(axis.dir.Mul(length))))
+		gc.LineTo(p.Project(p.axes.Add(axis.dir.Mul(length))))
+		gc.Stroke()
+	}
+}
+
+// return the depths of the nearest and furthest segment ends in the current view
+func (p *Path) depthRange(segments []Segment, offset V4d) (float64, float64) {
+	near, far := math.Inf(-1), math.Inf(1)
+	for _, seg := range segments {
+		d := p.ViewPos(seg.End.Add(offset)).Z
+		near = math.Max(near, d)
+		far = math.Min(far, d)
+	}
+	return near, far
+}
+
+// draw the segments, brighter the nearer they are (from far to near), so
+// that the depth is visible when the view is rotated; in the top view
+// they're all the same
+func (p *Path) RenderSegmentsDepthCued(gc *draw2dimg.GraphicContext, segments []Segment, offset V4d, col color.NRGBA, near, far float64) {
+	if p.IsTop() || len(segments) == 0 {
+		gc.SetStrokeColor(col)
+		p.RenderSegments(gc, segments, offset)
+		return
+	}
+
+	// one path per shade, so that we only stroke a few times
+	levels := make([][]Segment, depthCueLevels)
+	for _, seg := range segments {
+		mid := seg.Start.Add(seg.End).Mul(0.5).Add(offset)
+		level := depthCueLevels - 1
+		if near > far {
+			level = int((p.ViewPos(mid).Z - far) / (near - far) * depthCueLevels)
+			level = int(math.Max(0, math.Min(depthCueLevels-1, float64(level))))
+		}
+		levels[level] = append(levels[level], seg)
+	}
+	for i, segs := range levels {
+		// fade to a quarter of the brightness at the back
+		f := 0.25 + 0.75*float64(i+1)/depthCueLevels
+		gc.SetStrokeColor(color.NRGBA{R: uint8(float64(col.R) * f), G: uint8(float64(col.G) * f), B: uint8(float64(col.B) * f), A: col.A})
+		p.RenderSegments(gc, segs, offset)
+	}
+}
+
+// look from one of the presets, keeping the middle of the program in the
+// middle of the view
+func (tp *ToolpathView) SetView(i int) {
+	if i < 0 || i >= len(viewPresets) {
+		return
+	}
+	v := viewPresets[i]
+	tp.opts.yaw, tp.opts.pitch = v.Yaw, v.Pitch
+	centre := tp.pivot()
+	view := tp.opts.ViewPos(centre)
+	tp.opts.centre = V4d{X: view.X, Y: -view.Y}
+}
+
+// the point to orbit around: the middle of the program, or the work origin
+func (tp *ToolpathView) pivot() V4d {
+	axes := V4d{X: tp.app.gs.Wco.X, Y: tp.app.gs.Wco.Y, Z: tp.app.gs.Wco.Z}
+	if tp.programBounds.Empty() {
+		return axes
+	}
+	return tp.programBounds.Min.Add(tp.programBounds.Max).Mul(0.5).Add(axes)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gioui.org/f32"
+	"gioui.org/layout"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+)
+
+const (
+	defaultPxPerMm = 10.0
+	fitMargin      = 0.9 // fraction of the view to fill when zooming to fit
+	animateRate    = 0.3 // fraction of the way to the target to move each frame
+)
+
+// the parts of the view that we save between sessions, in view.conf
+type ViewState struct {
+	Yaw     float64
+	Pitch   float64
+	Centre  V4d
+	PxPerMm float64
+	Follow  bool
+
+	ShowEnvelope bool
+	ShowOffsets  bool
+}
+
+func ViewFile() string {
+	return filepath.Join(ConfDir(), "view.conf")
+}
+
+// read view.conf; returns false if there's nothing to restore
+func ReadViewState() (ViewState, bool) {
+	filename := ViewFile()
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "read %s: %v\n", filename, err)
+		}
+		return ViewState{}, false
+	}
+	defer f.Close()
+
+	vs := ViewState{PxPerMm: defaultPxPerMm, ShowEnvelope: true, ShowOffsets: true}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			fmt.Fprintf(os.Stderr, "%s: bad line: [%s]\n", filename, line)
+			continue
+		}
+		key, val := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if key == "follow" || key == "envelope" || key == "origins" {
+			b := val == "true"
+			if key == "follow" {
+				vs.Follow = b
+			} else if key == "envelope" {
+				vs.ShowEnvelope = b
+			} else {
+				vs.ShowOffsets = b
+			}
+			continue
+		}
+		if key == "centre" {
+			v, _, err := ParseV4d(val)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s: %v\n", filename, key, err)
+				continue
+			}
+			vs.Centre = V4d{X: v.X, Y: v.Y}
+			continue
+		}
+		v, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s: %v\n", filename, key, err)
+			continue
+		}
+		if key == "yaw" {
+			vs.Yaw = v
+		} else if key == "pitch" {
+			vs.Pitch = v
+		} else if key == "zoom" {
+			vs.PxPerMm = v
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: unrecognised view key: [%s]\n", filename, key)
+		}
+	}
+	return vs, true
+}
+
+func (vs ViewState) Write() {
+	filename := ViewFile()
+	f, err := os.Create(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "write %s: %v\n", filename, err)
+		return
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "yaw=%g\n", vs.Yaw)
+	fmt.Fprintf(f, "pitch=%g\n", vs.Pitch)
+	fmt.Fprintf(f, "centre=%.3f,%.3f\n", vs.Centre.X, vs.Centre.Y)
+	fmt.Fprintf(f, "zoom=%g\n", vs.PxPerMm)
+	fmt.Fprintf(f, "follow=%v\n", vs.Follow)
+	fmt.Fprintf(f, "envelope=%v\n", vs.ShowEnvelope)
+	fmt.Fprintf(f, "origins=%v\n", vs.ShowOffsets)
+}
+
+// the buttons for the view controls
+type ViewControls struct {
+	fitBtn      widget.Clickable
+	envelopeBtn widget.Clickable
+	resetBtn    widget.Clickable
+	toolBtn     widget.Clickable
+	followBtn   widget.Clickable
+	showEnvBtn  widget.Clickable
+	showWcsBtn  widget.Clickable
+	measureBtn  widget.Clickable
+	clearBtn    widget.Clickable
+	csvBtn      widget.Clickable
+	gcodeBtn    widget.Clickable
+}
+
+// start moving the view towards the given centre and zoom
+func (tp *ToolpathView) AnimateTo(centre V4d, pxPerMm float64) {
+	tp.animTarget = centre
+	tp.animPxPerMm = math.Max(MinPxPerMm, math.Min(MaxPxPerMm, pxPerMm))
+	tp.animating = true
+	tp.app.w.Invalidate()
+}
+
+// move the view a step towards the animation target; call once per frame
+func (tp *ToolpathView) Animate() {
+	if tp.following && tp.app.rs.Running {
+		// keep the tool in the middle of the view
+		v := tp.opts.ViewPos(tp.app.gs.Mpos)
+		if !tp.animating || tp.animTarget != (V4d{X: v.X, Y: -v.Y}) {
+			tp.AnimateTo(V4d{X: v.X, Y: -v.Y}, tp.opts.pxPerMm)
+		}
+	}
+	if !tp.animating {
+		return
+	}
+
+	// zoom in log space, so that zooming in and out look the same
+	logZoom := math.Log(tp.opts.pxPerMm)
+	logZoom += (math.Log(tp.animPxPerMm) - logZoom) * animateRate
+	tp.opts.pxPerMm = math.Exp(logZoom)
+	tp.opts.centre = tp.opts.centre.Add(tp.animTarget.Sub(tp.opts.centre).Mul(animateRate))
+
+	// stop when within a pixel of the target
+	distPx := tp.animTarget.Sub(tp.opts.centre).Length() * tp.opts.pxPerMm
+	zoomErr := math.Abs(tp.opts.pxPerMm/tp.animPxPerMm - 1)
+	if distPx < 0.5 && zoomErr < 0.001 {
+		tp.opts.centre = tp.animTarget
+		tp.opts.pxPerMm = tp.animPxPerMm
+		tp.animating = false
+	} else {
+		tp.app.w.Invalidate()
+	}
+}
+
+// stop any animation, because the user has moved the view themselves
+func (tp *ToolpathView) StopAnimating() {
+	tp.animating = false
+	tp.following = false
+}
+
+// return the transform that moves an image rendered with the old options to
+// where it would be with these, as near as a 2D transform can; none if the
+// view direction has changed
+func (p PathOpts) ImageTransform(old PathOpts) f32.Affine2D {
+	if p.yaw != old.yaw || p.pitch != old.pitch || old.pxPerMm <= 0 {
+		return f32.Affine2D{}
+	}
+	scale := float32(p.pxPerMm / old.pxPerMm)
+	oldHalf := f32.Pt(float32(old.widthPx/2), float32(old.heightPx/2))
+	newHalf := f32.Pt(float32(p.widthPx/2), float32(p.heightPx/2))
+	shift := old.centre.Sub(p.centre).Mul(p.pxPerMm)
+	return f32.Affine2D{}.
+		Offset(oldHalf.Mul(-1)).
+		Scale(f32.Point{}, f32.Pt(scale, scale)).
+		Offset(newHalf.Add(f32.Pt(float32(shift.X), float32(shift.Y))))
+}
+
+// return the centre and zoom that make the box (in machine coordinates)
+// fill the view
+func (p PathOpts) Fit(b Bounds) (V4d, float64) {
+	vb := EmptyBounds()
+	for i := 0; i < 8; i++ {
+		c := b.Min
+		if i&1 != 0 {
+			c.X = b.Max.X
+		}
+		if i&2 != 0 {
+			c.Y = b.Max.Y
+		}
+		if i&4 != 0 {
+			c.Z = b.Max.Z
+		}
+		vb = vb.Add(p.ViewPos(c))
+	}
+	w, h := vb.Max.X-vb.Min.X, vb.Max.Y-vb.Min.Y
+	pxPerMm := MaxPxPerMm
+	if w > 0 {
+		pxPerMm = math.Min(pxPerMm, float64(p.widthPx)*fitMargin/w)
+	}
+	if h > 0 {
+		pxPerMm = math.Min(pxPerMm, float64(p.heightPx)*fitMargin/h)
+	}
+	mid := vb.Min.Add(vb.Max).Mul(0.5)
+	return V4d{X: mid.X, Y: -mid.Y}, math.Max(MinPxPerMm, pxPerMm)
+}
+
+// zoom and pan so that the box (in machine coordinates) fills the view
+func (tp *ToolpathView) FitBounds(b Bounds) {
+	if b.Empty() || tp.opts.widthPx == 0 || tp.opts.heightPx == 0 {
+		return
+	}
+	tp.following = false
+	tp.AnimateTo(tp.opts.Fit(b))
+}
+
+// zoom to fit the loaded program
+func (tp *ToolpathView) ZoomToProgram() {
+	if tp.programBounds.Empty() {
+		return
+	}
+	tp.FitBounds(tp.programBounds.Offset(tp.opts.axes))
+}
+
+// zoom to fit the machine's travel, if we know it
+func (tp *ToolpathView) ZoomToEnvelope() {
+	if !tp.opts.haveEnvelope {
+		return
+	}
+	tp.FitBounds(tp.opts.envelope)
+}
+
+// go back to the top view of the work origin at the default zoom
+func (tp *ToolpathView) ResetView() {
+	tp.following = false
+	tp.opts.yaw, tp.opts.pitch = 0, 0
+	tp.AnimateTo(V4d{X: tp.opts.axes.X, Y: -tp.opts.axes.Y}, defaultPxPerMm)
+}
+
+// put the tool in the middle of the view
+func (tp *ToolpathView) CentreOnTool() {
+	v := tp.opts.ViewPos(tp.app.gs.Mpos)
+	tp.AnimateTo(V4d{X: v.X, Y: -v.Y}, tp.opts.pxPerMm)
+}
+
+// keep the tool in the middle of the view while a program runs, or stop doing so
+func (tp *ToolpathView) ToggleFollow() {
+	tp.following = !tp.following
+	if !tp.following {
+		tp.animating = false
+	}
+}
+
+// the view to save between sessions
+func (tp *ToolpathView) ViewState() ViewState {
+	return ViewState{
+		Yaw:          tp.opts.yaw,
+		Pitch:        tp.opts.pitch,
+		Centre:       tp.opts.centre,
+		PxPerMm:      tp.opts.pxPerMm,
+		Follow:       tp.following,
+		ShowEnvelope: tp.opts.showEnvelope,
+		ShowOffsets:  tp.opts.showOffsets,
+	}
+}
+
+func (tp *ToolpathView) SetViewState(vs ViewState) {
+	tp.opts.yaw, tp.opts.pitch = vs.Yaw, vs.Pitch
+	tp.opts.centre = vs.Centre
+	if vs.PxPerMm > 0 {
+		tp.opts.pxPerMm = math.Max(MinPxPerMm, math.Min(MaxPxPerMm, vs.PxPerMm))
+	}
+	tp.following = vs.Follow
+	tp.opts.showEnvelope = vs.ShowEnvelope
+	tp.opts.showOffsets = vs.ShowOffsets
+	tp.animating = false
+}
+
+// write view.conf if the view has changed since it was last written; safe
+// to call from any goroutine
+func (tp *ToolpathView) WriteViewState() {
+	tp.writtenMu.Lock()
+	defer tp.writtenMu.Unlock()
+	vs := tp.viewState.Load()
+	if vs == nil || *vs == tp.writtenView {
+		return
+	}
+	tp.writtenView = *vs
+	vs.Write()
+}
+
+func (tp *ToolpathView) LayoutViewControls(gtx C) D {
+	vc := &tp.controls
+	for vc.fitBtn.Clicked(gtx) {
+		tp.ZoomToProgram()
+	}
+	for vc.envelopeBtn.Clicked(gtx) {
+		tp.ZoomToEnvelope()
+	}
+	for vc.resetBtn.Clicked(gtx) {
+		tp.ResetView()
+	}
+	for vc.toolBtn.Clicked(gtx) {
+		tp.CentreOnTool()
+	}
+	for vc.followBtn.Clicked(gtx) {
+		tp.ToggleFollow()
+	}
+	for vc.showEnvBtn.Clicked(gtx) {
+		tp.ToggleEnvelope()
+	}
+	for vc.showWcsBtn.Clicked(gtx) {
+		tp.ToggleOffsets()
+	}
+	for vc.measureBtn.Clicked(gtx) {
+		tp.ToggleMeasure()
+	}
+	for vc.clearBtn.Clicked(gtx) {
+		tp.app.trace.Clear()
+	}
+	for vc.csvBtn.Clicked(gtx) {
+		tp.app.trace.SaveFile(true)
+	}
+	for vc.gcodeBtn.Clicked(gtx) {
+		tp.app.trace.SaveFile(false)
+	}
+
+	haveTrace := tp.app.trace.Len() > 0
+	th := *tp.app.th
+	th.TextSize = th.TextSize * 0.7
+	btn := func(c *widget.Clickable, label string, active bool) layout.Widget {
+		b := material.Button(&th, c, label)
+		if !active {
+			b.Background = grey(64)
+		}
+		return b.Layout
+	}
+	return Toolbar{Inset: layout.UniformInset(2)}.Layout(gtx,
+		btn(&vc.fitBtn, "FIT (V)", !tp.programBounds.Empty()),
+		btn(&vc.envelopeBtn, "TRAVEL (E)", tp.opts.haveEnvelope),
+		btn(&vc.resetBtn, "RESET (0)", true),
+		btn(&vc.toolBtn, "TOOL (C)", true),
+		btn(&vc.followBtn, "FOLLOW (W)", tp.following),
+		btn(&vc.showEnvBtn, "ENVELOPE", tp.opts.showEnvelope),
+		btn(&vc.showWcsBtn, "ORIGINS", tp.opts.showOffsets),
+		btn(&vc.measureBtn, "MEASURE (B)", tp.measure.Active),
+		btn(&vc.clearBtn, "CLEAR TRACE", haveTrace),
+		btn(&vc.csvBtn, "TRACE CSV", haveTrace),
+		btn(&vc.gcodeBtn, "TRACE G-CODE", haveTrace),
+	)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/256dpi/gcode"
+)
+
+// split a line of G-code into words, like gcode.ParseLine(), but also
+// accepting lowercase letters, missing spaces ("g0x5y-2.5"), and spaces
+// between a letter and its number ("X 5")
+func ParseWords(s string) (gcode.Line, error) {
+	l := gcode.Line{}
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		if c == ' ' || c == '\t' || c == '\r' || c == '%' {
+			i++
+			continue
+		}
+		if c == ';' {
+			l.Comment = s[i+1:]
+			break
+		}
+		if c == '(' {
+			j := strings.IndexByte(s[i:], ')')
+			if j < 0 {
+				return l, fmt.Errorf("missing ) for comment")
+			}
+			l.Codes = append(l.Codes, gcode.GCode{Comment: s[i+1 : i+j]})
+			i += j + 1
+			continue
+		}
+		if !isLetter(c) {
+			return l, fmt.Errorf("expected a letter, got '%c'", c)
+		}
+
+		j := skipSpaces(s, i+1)
+		start := j
+		if j < len(s) && (s[j] == '-' || s[j] == '+') {
+			j++
+		}
+		for j < len(s) && (s[j] == '.' || (s[j] >= '0' && s[j] <= '9')) {
+			j++
+		}
+		val, err := strconv.ParseFloat(s[start:j], 64)
+		if err != nil {
+			return l, fmt.Errorf("bad number for %c: [%s]", c, s[start:j])
+		}
+		l.Codes = append(l.Codes, gcode.GCode{Letter: strings.ToUpper(string(c)), Value: val})
+		i = j
+	}
+	return l, nil
+}
+
+// format a line of words, without the trailing newline that gcode.Line.String() adds
+func FormatWords(l gcode.Line) string {
+	return strings.TrimSuffix(l.String(), "\n")
+}